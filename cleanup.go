@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// unless MaxDeletePercent or MaxDeletePercentPerVM say otherwise, cleanup
+// won't delete more than this percent of backups at once
+const defaultMaxDeletePercent = 50
+
+// set by --force: delete backups even if that trips the safety checks
+var forceCleanup bool
+
+func addForceFlag(flags *flag.FlagSet) {
+	flags.BoolVar(
+		&forceCleanup,
+		"force",
+		false,
+		"delete backups even if more than MaxDeletePercent(PerVM) would be deleted",
+	)
+}
+
+// a backup Cleanup will delete, and why
+type plannedDeletion struct {
+	BackupName string
+	Reason     string
+	// why the safety checks stopped us deleting it, if they did
+	Skipped string
+}
+
+type cleanupPlan struct {
+	Deletions []plannedDeletion
+	// deletions the safety checks stopped
+	Skipped []plannedDeletion
+}
+
+func maxDeletePercent(configured int) int {
+	if configured == 0 {
+		return defaultMaxDeletePercent
+	}
+	return configured
+}
+
+// work out which backups their VM's policy doesn't keep. If that would
+// delete more than MaxDeletePercentPerVM of a VM's backups, or more than
+// MaxDeletePercent of all backups, something is probably wrong (ex: the
+// clock or the config), so those deletions are skipped unless --force was
+// given. A VM's newest backup is never deleted (see applyRetention).
+// Failed backups are deleted once there is a newer good one, and don't
+// count towards the safety checks. Backups are grouped by VM UUID (see
+// groupBackups), so a renamed VM's old backups count as its own.
+func planCleanup(ctx context.Context) (*cleanupPlan, error) {
+	folders, err := BackupFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	// we need tags to pick policies (and UUIDs to group backups). If we
+	// guessed without them we could apply the wrong retention, so give up
+	// instead.
+	vms, err := Scale.VMList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := groupBackups(folders, vms)
+
+	perVMLimit := maxDeletePercent(Config.Schedule.MaxDeletePercentPerVM)
+	plan := &cleanupPlan{}
+	totalBackups := 0
+	for _, group := range groups {
+		var usable []BackupFolder
+		for _, folder := range group.Folders {
+			if folder.Usable() {
+				usable = append(usable, folder)
+			}
+		}
+		if len(usable) == 0 {
+			continue
+		}
+		backupTimes := group.Usable()
+		totalBackups += len(backupTimes)
+
+		// backups of deleted VMs can only match policies by name
+		vmName := group.Name
+		var tags string
+		if group.VM != nil {
+			tags = group.VM.Tags
+		}
+		policy := PolicyFor(vmName, tags)
+
+		var vmDeletions []plannedDeletion
+		for i, kept := range applyRetention(policy, backupTimes) {
+			if kept.Kept() {
+				continue
+			}
+			vmDeletions = append(vmDeletions, plannedDeletion{
+				BackupName: usable[i].Name,
+				Reason:     policy.deletionReason(kept, i, len(backupTimes)),
+			})
+		}
+
+		percent := 100 * len(vmDeletions) / len(backupTimes)
+		if percent > perVMLimit && !forceCleanup {
+			skipped := fmt.Sprintf(
+				"would delete %d of %s's %d backups (%d%%), MaxDeletePercentPerVM is %d%%",
+				len(vmDeletions),
+				vmName,
+				len(backupTimes),
+				percent,
+				perVMLimit,
+			)
+			for _, deletion := range vmDeletions {
+				deletion.Skipped = skipped
+				plan.Skipped = append(plan.Skipped, deletion)
+			}
+			continue
+		}
+		plan.Deletions = append(plan.Deletions, vmDeletions...)
+	}
+
+	globalLimit := maxDeletePercent(Config.Schedule.MaxDeletePercent)
+	if totalBackups != 0 && !forceCleanup {
+		percent := 100 * len(plan.Deletions) / totalBackups
+		if percent > globalLimit {
+			skipped := fmt.Sprintf(
+				"would delete %d of all %d backups (%d%%), MaxDeletePercent is %d%%",
+				len(plan.Deletions),
+				totalBackups,
+				percent,
+				globalLimit,
+			)
+			for _, deletion := range plan.Deletions {
+				deletion.Skipped = skipped
+				plan.Skipped = append(plan.Skipped, deletion)
+			}
+			plan.Deletions = nil
+		}
+	}
+
+	// failed backups are only worth keeping to see what went wrong, and
+	// only until a backup of the same VM works
+	for _, group := range groups {
+		newest := group.Usable()
+		for _, folder := range group.Folders {
+			if folder.Status != BackupFailed {
+				continue
+			}
+			if len(newest) == 0 || !newest[0].After(folder.Time) {
+				continue
+			}
+			plan.Deletions = append(plan.Deletions, plannedDeletion{
+				BackupName: folder.Name,
+				Reason:     fmt.Sprintf("failed (%s) and there is a newer backup", folder.FailReason),
+			})
+		}
+	}
+
+	for _, list := range [][]plannedDeletion{plan.Deletions, plan.Skipped} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].BackupName < list[j].BackupName
+		})
+	}
+	return plan, nil
+}
+
+// delete backups that their VM's policy doesn't keep. With --dry-run it only
+// says what it would delete. Deletions the safety checks stop are emailed
+// (not treated as an error) so the rest of the schedule carries on.
+func Cleanup(ctx context.Context) error {
+	debugReturn := DebugCall()
+
+	plan, err := planCleanup(ctx)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	if dryRun {
+		for _, deletion := range plan.Deletions {
+			fmt.Printf("Would delete %s: %s\n", deletion.BackupName, deletion.Reason)
+		}
+		for _, deletion := range plan.Skipped {
+			fmt.Printf(
+				"Would not delete %s (%s): %s\n",
+				deletion.BackupName,
+				deletion.Reason,
+				deletion.Skipped,
+			)
+		}
+		if len(plan.Deletions) == 0 && len(plan.Skipped) == 0 {
+			fmt.Println("No backups would be deleted")
+		}
+		debugReturn(nil)
+		return nil
+	}
+
+	if len(plan.Skipped) != 0 {
+		var msg bytes.Buffer
+		msg.WriteString("Cleanup did not delete these backups because of its safety checks.\n")
+		msg.WriteString("Check them with `scale-backup cleanup --dry-run`, then run\n")
+		msg.WriteString("`scale-backup cleanup --force` to delete them anyway.\n\n")
+		for _, deletion := range plan.Skipped {
+			fmt.Fprintf(&msg, "%s\n", deletion.BackupName)
+			fmt.Fprintf(&msg, "\tto be deleted because: %s\n", deletion.Reason)
+			fmt.Fprintf(&msg, "\tskipped because: %s\n", deletion.Skipped)
+		}
+		fmt.Fprint(os.Stderr, msg.String())
+		Email("Cleanup skipped some backups", msg.String())
+	}
+
+	// delete backups
+	for _, deletion := range plan.Deletions {
+		fmt.Printf("Deleting %s: %s\n", deletion.BackupName, deletion.Reason)
+		err := os.RemoveAll(filepath.Join(Config.SMB.LocalPath, deletion.BackupName))
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+	}
+
+	debugReturn(nil)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupSafetyChecks(t *testing.T) {
+	const day = 24 * time.Hour
+	setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.MaxBackups = 1
+	makeBackups(t, map[string][]time.Duration{
+		// 3 of 4 is more than MaxDeletePercentPerVM
+		"a": {1 * day, 2 * day, 3 * day, 4 * day},
+		// 1 of 2 is exactly the limit
+		"b": {1 * day, 2 * day},
+		"c": {1 * day},
+		"d": {1 * day},
+		"e": {1 * day},
+	})
+
+	plan, err := planCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Deletions) != 1 || !strings.HasSuffix(plan.Deletions[0].BackupName, " b") {
+		t.Errorf("expected only b's old backup to be deleted, got %+v", plan.Deletions)
+	}
+	if len(plan.Skipped) != 3 {
+		t.Fatalf("expected 3 of a's backups to be skipped, got %+v", plan.Skipped)
+	}
+	for _, skipped := range plan.Skipped {
+		if !strings.HasSuffix(skipped.BackupName, " a") || !strings.Contains(skipped.Skipped, "MaxDeletePercentPerVM") {
+			t.Errorf("unexpected skipped deletion: %+v", skipped)
+		}
+	}
+
+	// with a low global limit, nothing is deleted
+	Config.Schedule.MaxDeletePercent = 5
+	plan, err = planCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Deletions) != 0 || len(plan.Skipped) != 4 {
+		t.Errorf("expected everything to be skipped, got %+v", plan)
+	}
+	err = Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backupAges(t); len(got["a"]) != 4 || len(got["b"]) != 2 {
+		t.Errorf("nothing should have been deleted, got %v", got)
+	}
+
+	// --force overrides both limits, but still keeps the newest backups
+	forceCleanup = true
+	err = Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]time.Duration{
+		"a": {1 * day},
+		"b": {1 * day},
+		"c": {1 * day},
+		"d": {1 * day},
+		"e": {1 * day},
+	}
+	if got := backupAges(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("backups after forced Cleanup() = %v, want %v", got, want)
+	}
+}
+
+// a backup that breaks more than one rule is only one deletion, for the
+// plan and for the safety checks
+func TestCleanupCountsEachBackupOnce(t *testing.T) {
+	const day = 24 * time.Hour
+	setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.MaxBackups = 3
+	Config.Schedule.MaxAge = "10 days"
+	Config.Schedule.MaxDeletePercentPerVM = 25
+	makeBackups(t, map[string][]time.Duration{
+		"a": {1 * day, 5 * day, 8 * day, 20 * day},
+		"b": {2 * day},
+	})
+
+	plan, err := planCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Deletions) != 1 || len(plan.Skipped) != 0 {
+		t.Errorf("expected a's 20 day old backup to be deleted once, got %+v", plan)
+	}
+}
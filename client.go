@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tofu "github.com/9072997/golang-tofu"
+)
+
+// the shared client used by all commands. It is set up after the config
+// has been loaded and validated.
+var Scale *ScaleClient
+
+var (
+	ErrScaleAuth     = errors.New("scale authentication failed")
+	ErrScaleNotFound = errors.New("scale resource not found")
+	ErrScaleServer   = errors.New("scale server error")
+)
+
+// the body Scale sends along with most non-2xx responses
+type ScaleErrorPayload struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// ScaleError is returned for any non-2xx response from the Scale API. Use
+// errors.Is with ErrScaleAuth, ErrScaleNotFound, or ErrScaleServer to
+// check what kind of failure it was.
+type ScaleError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Payload    ScaleErrorPayload
+	Body       []byte
+}
+
+func (e *ScaleError) Error() string {
+	msg := e.Payload.Error
+	if msg == "" {
+		msg = e.Payload.Message
+	}
+	if msg == "" {
+		msg = strings.TrimSpace(string(e.Body))
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf(
+		"%s %s: HTTP %d: %s",
+		e.Method,
+		e.Path,
+		e.StatusCode,
+		msg,
+	)
+}
+
+func (e *ScaleError) Is(target error) bool {
+	switch target {
+	case ErrScaleAuth:
+		return e.StatusCode == http.StatusUnauthorized ||
+			e.StatusCode == http.StatusForbidden
+	case ErrScaleNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrScaleServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+type ScaleClient struct {
+	BaseURL  url.URL
+	Username string
+	Password string
+	HTTP     *http.Client
+
+	// transient failures are retried this many times, waiting
+	// RetryBackoff before the first retry and doubling each time after
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// build a client from the global config
+func NewScaleClient() (*ScaleClient, error) {
+	httpClient, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	// we make a lot of small requests to the same host while polling
+	// tasks, so keep a few connections around
+	if transport, ok := httpClient.Transport.(*http.Transport); ok {
+		transport.MaxIdleConnsPerHost = 4
+		transport.IdleConnTimeout = 90 * time.Second
+	}
+
+	return &ScaleClient{
+		BaseURL: url.URL{
+			Scheme: "https",
+			Host:   Config.Scale.Host,
+		},
+		Username:     Config.Scale.Username,
+		Password:     Config.Scale.Password,
+		HTTP:         httpClient,
+		MaxRetries:   4,
+		RetryBackoff: 2 * time.Second,
+	}, nil
+}
+
+// return true if a request that failed this way is worth trying again.
+// Requests that change things (anything but GET) are only retried when we
+// can be confident Scale did not act on them.
+func retryable(method string, resp *http.Response, err error) bool {
+	if err != nil {
+		// the request may or may not have made it to the server
+		return method == http.MethodGet
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusGatewayTimeout:
+		return method == http.MethodGet
+	}
+	return false
+}
+
+// send a JSON request to the Scale API and decode the JSON response into
+// out (if out is not nil). reqBody is marshalled to JSON if it is not nil.
+func (c *ScaleClient) do(ctx context.Context, method, apiPath string, query url.Values, reqBody, out any) error {
+	var bodyBytes []byte
+	if reqBody != nil {
+		var err error
+		bodyBytes, err = json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+	}
+
+	apiURL := c.BaseURL
+	apiURL.Path = apiPath
+	apiURL.RawQuery = query.Encode()
+
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		if bodyBytes != nil {
+			body = bytes.NewReader(bodyBytes)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, apiURL.String(), body)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.Username, c.Password)
+		if bodyBytes != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := DebugHTTP(c.HTTP, req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return ctx.Err()
+		}
+		if attempt < c.MaxRetries && retryable(method, resp, err) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return decodeResponse(req, resp, out)
+	}
+}
+
+// check the status code of a response and decode the body into out
+func decodeResponse(req *http.Request, resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		scaleErr := &ScaleError{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			StatusCode: resp.StatusCode,
+			Body:       respBody,
+		}
+		// not all errors have a JSON body, so ignore decode errors
+		json.Unmarshal(respBody, &scaleErr.Payload)
+		return scaleErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	err = json.Unmarshal(respBody, out)
+	if err != nil {
+		return fmt.Errorf(
+			"error decoding response from %s %s: %w\n%s",
+			req.Method,
+			req.URL.Path,
+			err,
+			respBody,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScaleErrors(t *testing.T) {
+	setupFakeScale(t)
+	ctx := context.Background()
+
+	_, err := Scale.VMDisks(ctx, "no-such-vm")
+	if !errors.Is(err, ErrScaleNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	var scaleErr *ScaleError
+	if !errors.As(err, &scaleErr) || scaleErr.Payload.Error != "VirDomain not found" {
+		t.Errorf("expected error to carry the Scale payload, got %#v", err)
+	}
+
+	Scale.Password = "wrong"
+	_, err = Scale.VMs(ctx, "")
+	if !errors.Is(err, ErrScaleAuth) {
+		t.Errorf("expected auth error, got %v", err)
+	}
+}
+
+func TestScaleRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if r.Method == "GET" && n < 3 {
+			writeJSON(w, http.StatusBadGateway, ScaleErrorPayload{Error: "try again"})
+			return
+		}
+		if r.Method == "POST" {
+			writeJSON(w, http.StatusInternalServerError, ScaleErrorPayload{Error: "boom"})
+			return
+		}
+		writeJSON(w, http.StatusOK, []VM{})
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	client := &ScaleClient{
+		BaseURL:      url.URL{Scheme: "http", Host: serverURL.Host},
+		HTTP:         server.Client(),
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	}
+
+	_, err := client.VMs(context.Background(), "")
+	if err != nil {
+		t.Fatalf("GET should have been retried: %s", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+
+	// a 500 on a POST might mean the export started, so don't retry it
+	calls.Store(0)
+	_, err = client.Export(context.Background(), "vm", "folder", TransferSettingsFor("vm", ""))
+	if !errors.Is(err, ErrScaleServer) {
+		t.Errorf("expected server error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("POST should not be retried, got %d calls", calls.Load())
+	}
+}
+
+func TestScaleUploadDebugLog(t *testing.T) {
+	fake := setupFakeScale(t)
+	Config.Debug.LogFile = filepath.Join(t.TempDir(), "debug.log")
+
+	data := strings.Repeat("disk image ", 1000)
+	// not a bytes.Reader, so it can only be read once, like a file
+	body := io.MultiReader(strings.NewReader(data))
+	_, err := Scale.Upload(context.Background(), "disk.vhdx", int64(len(data)), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.uploads["disk.vhdx"]) != data {
+		t.Error("upload did not arrive intact")
+	}
+	logged, err := os.ReadFile(Config.Debug.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logged), "=== PUT /rest/v1/VirtualDisk/upload") {
+		t.Errorf("upload is missing from the debug log:\n%s", logged)
+	}
+	if strings.Contains(string(logged), "disk image disk image") {
+		t.Error("the uploaded file should not be logged")
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// Clock is where the scheduling code gets the current time, so tests can
+// control it
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = systemClock{}
+
+// like time.Since, but using clock
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
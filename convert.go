@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backups can have a copy of each qcow2 disk image converted to a fixed
+// VHDX (which Windows can mount) or a raw image, set with the Convert
+// transfer option. This is done right after the export, before encryption,
+// so nothing else has to read the qcow2 images.
+
+// formats disk images can be converted to
+var convertFormats = []string{"vhdx", "raw"}
+
+// converted images are written in blocks this big, at offsets that are a
+// multiple of it. That matches the qcow2 clusters (up to 2MB) and ZFS
+// records (with recordsize=2M), so with dedup on a converted copy takes up
+// almost no space.
+const convertBlockSize = 2 << 20
+
+// convert the qcow2 image src to dst in format (one of convertFormats). The
+// copy is written to dst.part, which is picked back up if an earlier
+// conversion was interrupted, and only renamed to dst once it is done.
+// Blocks of zeros are skipped instead of written, so it stays sparse.
+// progress is called with the percent done as it goes.
+func convertImage(ctx context.Context, src, dst, format string, progress func(int)) error {
+	debugReturn := DebugCall(src, dst, format)
+
+	image, err := openQcow2(src)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer image.Close()
+
+	var prefix []byte
+	size := image.Size
+	switch format {
+	case "vhdx":
+		seed := filepath.Base(filepath.Dir(dst)) + "/" + filepath.Base(dst)
+		prefix, size = vhdxPrefix(image.Size, seed)
+	case "raw":
+	default:
+		err := fmt.Errorf("can't convert to %s", format)
+		debugReturn(err)
+		return err
+	}
+
+	tmpFile := dst + ".part"
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer out.Close()
+
+	// carry on from the last whole block of an earlier attempt. Anything
+	// after that is thrown away, so skipped blocks read back as zeros.
+	partInfo, err := out.Stat()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	offset := partInfo.Size()/convertBlockSize*convertBlockSize - int64(len(prefix))
+	if offset < 0 || offset > size {
+		offset = 0
+	}
+	err = out.Truncate(int64(len(prefix)) + offset)
+	if err == nil {
+		// the headers are small, so they are always rewritten
+		_, err = out.WriteAt(prefix, 0)
+	}
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	buf := make([]byte, convertBlockSize)
+	for offset < size {
+		if ctx.Err() != nil {
+			debugReturn(ctx.Err())
+			return ctx.Err()
+		}
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		_, err = image.ReadAt(buf[:n], offset)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", src, err)
+			debugReturn(err)
+			return err
+		}
+		if !isZeroBlock(buf[:n]) {
+			_, err = out.WriteAt(buf[:n], int64(len(prefix))+offset)
+			if err != nil {
+				debugReturn(err)
+				return err
+			}
+		}
+		offset += n
+		if progress != nil && size > 0 {
+			progress(int(offset * 100 / size))
+		}
+	}
+	// skipped blocks at the end still have to count towards the size
+	err = out.Truncate(int64(len(prefix)) + size)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, dst)
+	}
+
+	debugReturn(err)
+	return err
+}
+
+// convert each qcow2 disk image in a backup to format. Images that were
+// already converted are skipped. If a conversion fails (other than being
+// interrupted), its partial copy is deleted, so it isn't mistaken for part
+// of the backup.
+func convertBackup(ctx context.Context, backupName, format string) error {
+	debugReturn := DebugCall(backupName, format)
+
+	encrypted, err := backupEncrypted(backupName)
+	if err == nil && encrypted {
+		err = fmt.Errorf("%s is encrypted", backupName)
+	}
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	folder := filepath.Join(Config.SMB.LocalPath, backupName)
+	images, err := diskImages(folder)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	converted := 0
+	for _, image := range images {
+		if !strings.EqualFold(filepath.Ext(image), ".qcow2") {
+			continue
+		}
+		src := filepath.Join(folder, image)
+		dst := strings.TrimSuffix(src, filepath.Ext(src)) + "." + format
+		converted++
+		if _, err := os.Stat(dst); err == nil {
+			// finished by an earlier attempt (it is only renamed into place
+			// once it is done)
+			continue
+		}
+
+		fmt.Printf("Converting %s to %s\n", filepath.Join(backupName, image), format)
+		start := clock.Now()
+		reported := 0
+		err = convertImage(ctx, src, dst, format, func(percent int) {
+			if percent/10 > reported/10 {
+				reported = percent
+				fmt.Printf("%s: %d%% converted\n", filepath.Join(backupName, image), percent)
+			}
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				os.Remove(dst + ".part")
+			}
+			debugReturn(err)
+			return err
+		}
+		fmt.Printf("Converted %s in %s\n", filepath.Join(backupName, image), describeDuration(since(start)))
+	}
+	if converted == 0 {
+		err = errors.New("no qcow2 disk images to convert (Convert needs Format qcow2)")
+	}
+
+	debugReturn(err)
+	return err
+}
+
+// convert a backup whose export just finished, if format (the Convert
+// setting it was started with) says to. The export itself is fine either
+// way, so failures are emailed rather than failing the backup. Only an
+// interruption is returned, and the job should be kept so `resume` can
+// finish the conversion.
+func convertAfterBackup(ctx context.Context, vmName, backupName, format string) error {
+	if format == "" || format == "none" {
+		return nil
+	}
+	err := convertBackup(ctx, backupName, format)
+	if ctx.Err() != nil {
+		recordInterruption("Conversion of %s to %s was interrupted, run `scale-backup resume` to finish it", backupName, format)
+		return ctx.Err()
+	}
+	if err != nil {
+		emailError(
+			"Conversion failed",
+			"Backup of %s completed, but its disk images could not be converted to %s: %s",
+			vmName,
+			format,
+			err,
+		)
+	}
+	return nil
+}
+
+// return true if path is a converted copy of a qcow2 image (encrypted or
+// not) next to it, rather than a disk image Scale exported
+func isConvertedImage(path string) bool {
+	path = strings.TrimSuffix(path, encryptedSuffix)
+	ext := filepath.Ext(path)
+	converted := false
+	for _, format := range convertFormats {
+		if strings.EqualFold(ext, "."+format) {
+			converted = true
+		}
+	}
+	if !converted {
+		return false
+	}
+	original := strings.TrimSuffix(path, ext) + ".qcow2"
+	for _, name := range []string{original, original + encryptedSuffix} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testClusterBits = 16
+
+// build a version 3 qcow2 image of data with 64KiB clusters. Clusters of
+// zeros are left unallocated, unless they are in zero (then they get the
+// zero flag). Clusters in compressed are deflated.
+func makeQcow2(t *testing.T, data []byte, compressed, zero map[int]bool) []byte {
+	be := binary.BigEndian
+	clusterSize := 1 << testClusterBits
+	clusters := (len(data) + clusterSize - 1) / clusterSize
+	l2Entries := clusterSize / 8
+	l2Tables := (clusters + l2Entries - 1) / l2Entries
+
+	// header, L1 table, L2 tables, then the data
+	image := make([]byte, (2+l2Tables)*clusterSize)
+	copy(image, qcow2Magic)
+	be.PutUint32(image[4:], 3)
+	be.PutUint32(image[20:], testClusterBits)
+	be.PutUint64(image[24:], uint64(len(data)))
+	be.PutUint32(image[36:], uint32(l2Tables))
+	be.PutUint64(image[40:], uint64(clusterSize))
+	be.PutUint32(image[96:], 4)
+	be.PutUint32(image[100:], 104)
+	for i := 0; i < l2Tables; i++ {
+		l2Offset := uint64((2 + i) * clusterSize)
+		be.PutUint64(image[clusterSize+8*i:], l2Offset|1<<63)
+	}
+
+	for i := 0; i < clusters; i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, data[i*clusterSize:])
+		var entry uint64
+		switch {
+		case zero[i]:
+			entry = qcow2ZeroFlag
+		case compressed[i]:
+			var deflated bytes.Buffer
+			w, err := flate.NewWriter(&deflated, flate.BestCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(cluster)
+			w.Close()
+			// start part way into a sector, like qemu does
+			offset := len(image) + 100
+			sectors := (100 + deflated.Len() + 511) / 512
+			image = append(image, make([]byte, 100)...)
+			image = append(image, deflated.Bytes()...)
+			sizeShift := 62 - (testClusterBits - 8)
+			entry = qcow2Compressed | uint64(sectors-1)<<sizeShift | uint64(offset)
+		case !isZeroBlock(cluster):
+			entry = uint64(len(image)) | 1<<63
+			image = append(image, cluster...)
+		}
+		be.PutUint64(image[(2+i/l2Entries)*clusterSize+8*(i%l2Entries):], entry)
+		// keep clusters aligned for the next one
+		image = append(image, make([]byte, (clusterSize-len(image)%clusterSize)%clusterSize)...)
+	}
+	return image
+}
+
+// a disk with a bit of everything: data, a compressed cluster, a zero
+// cluster, a 2MB block of nothing, and a partial last cluster
+func testDisk(t *testing.T) ([]byte, []byte) {
+	clusterSize := 1 << testClusterBits
+	data := make([]byte, 5<<20+3*512+7)
+	fill := func(cluster int) {
+		for i := cluster * clusterSize; i < (cluster+1)*clusterSize && i < len(data); i++ {
+			data[i] = byte(i%251 + cluster)
+		}
+	}
+	for _, cluster := range []int{0, 1, 2, 31, 64, 70, 80} {
+		fill(cluster)
+	}
+	compressed := map[int]bool{1: true, 70: true}
+	zero := map[int]bool{5: true, 40: true}
+	return data, makeQcow2(t, data, compressed, zero)
+}
+
+func TestQcow2Read(t *testing.T) {
+	data, image := testDisk(t)
+	file := filepath.Join(t.TempDir(), "disk.qcow2")
+	err := os.WriteFile(file, image, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := openQcow2(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Size != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), q.Size)
+	}
+	// reads that straddle clusters and run past the end
+	for _, offset := range []int{0, 1000, 70<<testClusterBits - 10, len(data) - 100} {
+		got := make([]byte, 200)
+		_, err := q.ReadAt(got, int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, 200)
+		copy(want, data[offset:])
+		if !bytes.Equal(got, want) {
+			t.Errorf("read at %d does not match", offset)
+		}
+	}
+
+	// and images it can't read
+	be := binary.BigEndian
+	bad := map[string]func([]byte){
+		"not a qcow2 image":   func(b []byte) { copy(b, "QFI\x00") },
+		"backing file":        func(b []byte) { be.PutUint64(b[8:], 4096) },
+		"version 4":           func(b []byte) { be.PutUint32(b[4:], 4) },
+		"features 0x2":        func(b []byte) { be.PutUint64(b[72:], 2) },
+		"encrypted":           func(b []byte) { be.PutUint32(b[32:], 1) },
+		"L1 table size 0":     func(b []byte) { be.PutUint32(b[36:], 0) },
+		"cluster size 2^30":   func(b []byte) { be.PutUint32(b[20:], 30) },
+		"too short":           func(b []byte) {},
+		"header is truncated": func(b []byte) {},
+	}
+	for what, change := range bad {
+		damaged := append([]byte(nil), image...)
+		change(damaged)
+		switch what {
+		case "too short":
+			damaged = damaged[:50]
+		case "header is truncated":
+			damaged = damaged[:80]
+		}
+		err := os.WriteFile(file, damaged, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := openQcow2(file)
+		if err == nil {
+			q.Close()
+			t.Errorf("%s: image was opened", what)
+		} else if !strings.Contains(err.Error(), what) {
+			t.Errorf("%s: unexpected error %s", what, err)
+		}
+	}
+}
+
+// check a fixed VHDX is put together right and holds data
+func checkVHDX(t *testing.T, vhdx, data []byte) {
+	le := binary.LittleEndian
+	if string(vhdx[:8]) != "vhdxfile" {
+		t.Fatal("missing file type identifier")
+	}
+	checksum := func(what string, b []byte) {
+		sum := le.Uint32(b[4:])
+		b = append([]byte(nil), b...)
+		le.PutUint32(b[4:], 0)
+		if crc32.Checksum(b, crc32c) != sum {
+			t.Errorf("%s checksum does not match", what)
+		}
+	}
+	for _, offset := range []int{64 << 10, 128 << 10} {
+		header := vhdx[offset : offset+4<<10]
+		if string(header[:4]) != "head" {
+			t.Fatalf("missing header at %d", offset)
+		}
+		checksum("header", header)
+		if le.Uint64(header[72:]) != vhdxLogOffset || le.Uint32(header[68:]) != vhdxLogLength {
+			t.Error("header has the wrong log")
+		}
+	}
+
+	regions := make(map[string][2]int64)
+	for _, offset := range []int{192 << 10, 256 << 10} {
+		table := vhdx[offset : offset+64<<10]
+		if string(table[:4]) != "regi" {
+			t.Fatalf("missing region table at %d", offset)
+		}
+		checksum("region table", table)
+		for i := 0; i < int(le.Uint32(table[8:])); i++ {
+			entry := table[16+32*i:]
+			regions[string(entry[:16])] = [2]int64{int64(le.Uint64(entry[16:])), int64(le.Uint32(entry[24:]))}
+		}
+	}
+	batRegion := regions[string(vhdxBATRegion)]
+	metadataRegion := regions[string(vhdxMetadataRegion)]
+	if batRegion[1] == 0 || metadataRegion[1] == 0 {
+		t.Fatalf("missing regions: %v", regions)
+	}
+
+	metadata := vhdx[metadataRegion[0] : metadataRegion[0]+metadataRegion[1]]
+	if string(metadata[:8]) != "metadata" {
+		t.Fatal("missing metadata table")
+	}
+	items := make(map[string][]byte)
+	for i := 0; i < int(le.Uint16(metadata[10:])); i++ {
+		entry := metadata[32+32*i:]
+		offset := le.Uint32(entry[16:])
+		items[string(entry[:16])] = metadata[offset : offset+le.Uint32(entry[20:])]
+	}
+	blockSize := int64(le.Uint32(items[string(vhdxFileParameters)]))
+	if blockSize != convertBlockSize {
+		t.Errorf("expected %d byte blocks, got %d", convertBlockSize, blockSize)
+	}
+	size := int64(le.Uint64(items[string(vhdxVirtualDiskSize)]))
+	if size != roundUp(int64(len(data)), 512) {
+		t.Errorf("expected virtual size %d, got %d", roundUp(int64(len(data)), 512), size)
+	}
+	if len(items[string(vhdxVirtualDiskID)]) != 16 || len(items[string(vhdxLogicalSectorSize)]) != 4 {
+		t.Error("missing metadata items")
+	}
+
+	padded := make([]byte, roundUp(int64(len(data)), blockSize))
+	copy(padded, data)
+	bat := vhdx[batRegion[0] : batRegion[0]+batRegion[1]]
+	for block := int64(0); block*blockSize < int64(len(padded)); block++ {
+		entry := le.Uint64(bat[8*block:])
+		if entry&7 != vhdxBlockFullyPresent {
+			t.Fatalf("block %d is not present", block)
+		}
+		offset := int64(entry >> 20 << 20)
+		if offset%convertBlockSize != 0 {
+			t.Errorf("block %d at %d is not aligned", block, offset)
+		}
+		if !bytes.Equal(vhdx[offset:offset+blockSize], padded[block*blockSize:(block+1)*blockSize]) {
+			t.Errorf("block %d does not match", block)
+		}
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	ctx := context.Background()
+	data, image := testDisk(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.qcow2")
+	err := os.WriteFile(src, image, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := filepath.Join(dir, "disk.raw")
+	err = convertImage(ctx, src, raw, "raw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("raw image does not match")
+	}
+
+	vhdx := filepath.Join(dir, "disk.vhdx")
+	var progress []int
+	err = convertImage(ctx, src, vhdx, "vhdx", func(percent int) {
+		progress = append(progress, percent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = os.ReadFile(vhdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVHDX(t, got, data)
+	if len(progress) == 0 || progress[len(progress)-1] != 100 {
+		t.Errorf("expected progress up to 100%%, got %v", progress)
+	}
+
+	// an interrupted conversion, with a good first block and then some
+	// garbage, is finished and matches
+	for _, dst := range []string{raw, vhdx} {
+		want, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part := append(append([]byte(nil), want[:len(want)-convertBlockSize]...), "garbage"...)
+		part[10] ^= 1
+		err = os.WriteFile(dst+".part", part, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Remove(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		format := strings.TrimPrefix(filepath.Ext(dst), ".")
+		err = convertImage(ctx, src, dst, format, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == "vhdx" {
+			// the headers are rewritten every time
+			if !bytes.Equal(got, want) {
+				t.Errorf("resumed %s does not match", format)
+			}
+		} else if !bytes.Equal(got[convertBlockSize:], want[convertBlockSize:]) {
+			t.Errorf("resumed %s does not match", format)
+		}
+		if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+			t.Error(".part file was left behind")
+		}
+	}
+}
+
+func TestConvertedBackup(t *testing.T) {
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	data, image := testDisk(t)
+	fake.SetDiskImage(func(disk BlockDev) []byte {
+		return image
+	})
+	Config.Transfer.Overrides = []TransferOverride{{
+		VMName:          "web*",
+		TransferOptions: TransferOptions{Convert: ptr("vhdx")},
+	}}
+
+	err := Backup(ctx, "web01", "manual web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(Config.SMB.LocalPath, "manual web01")
+	disk := filepath.Join(folder, vm.BlockDevs[0].UUID)
+	vhdx, err := os.ReadFile(disk + ".vhdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVHDX(t, vhdx, data)
+	manifest, err := readManifest("manual web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Size != uint64(len(image)) {
+		t.Errorf("expected the size to only count the qcow2 image (%d), got %d", len(image), manifest.Size)
+	}
+	listed := false
+	for _, file := range manifest.Files {
+		listed = listed || file.Name == vm.BlockDevs[0].UUID+".vhdx"
+	}
+	if !listed {
+		t.Errorf("the converted image should be in the manifest: %+v", manifest.Files)
+	}
+
+	// a flag wins over the config, and the converted copy is encrypted too
+	setupEncryption(t)
+	savedFlags := transferFlags
+	t.Cleanup(func() { transferFlags = savedFlags })
+	transferFlags.Convert = ptr("raw")
+	err = Backup(ctx, "web01", "manual web01 encrypted", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk = filepath.Join(Config.SMB.LocalPath, "manual web01 encrypted", vm.BlockDevs[0].UUID)
+	if _, err := os.Stat(disk + ".raw" + encryptedSuffix); err != nil {
+		t.Error("converted image was not encrypted")
+	}
+	if _, err := os.Stat(disk + ".raw"); !os.IsNotExist(err) {
+		t.Error("unencrypted converted image was left behind")
+	}
+	qcow2Info, err := os.Stat(disk + ".qcow2" + encryptedSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := BackupSize("manual web01 encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(qcow2Info.Size()) {
+		t.Errorf("expected the size to only count the qcow2 image (%d), got %d", qcow2Info.Size(), size)
+	}
+
+	// only the qcow2 image is decrypted to restore
+	Restore(ctx, "manual web01 encrypted", "web01-restored")
+	if fake.VM("web01-restored") == nil {
+		t.Fatal("restored VM was not created")
+	}
+	if _, exists := fake.importedFiles[vm.BlockDevs[0].UUID+".raw"]; exists {
+		t.Error("the converted image should not be decrypted for a restore")
+	}
+}
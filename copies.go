@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hyperjumptech/jiffy"
+)
+
+// Complete backups can be copied to other places (the [Offsite] bucket and
+// [[Replicas]]), each with its own retention. This is what they share.
+
+// retention rules for the copies in one place. They work like the ones in
+// [Schedule], but apply to every VM.
+type CopyRetention struct {
+	MaxBackups  int
+	MaxAge      string
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+}
+
+// check the rules, warning (but not failing) if they would keep every copy
+// forever. what names the copies for the warning, ex: "Offsite".
+func (r CopyRetention) validate(what string) error {
+	keep := map[string]int{
+		"MaxBackups":  r.MaxBackups,
+		"KeepDaily":   r.KeepDaily,
+		"KeepWeekly":  r.KeepWeekly,
+		"KeepMonthly": r.KeepMonthly,
+		"KeepYearly":  r.KeepYearly,
+	}
+	limited := r.MaxAge != ""
+	for field, value := range keep {
+		if value < 0 {
+			return fmt.Errorf("%s can not be negative", field)
+		}
+		if value != 0 {
+			limited = true
+		}
+	}
+	if r.MaxAge != "" {
+		_, err := jiffy.DurationOf(r.MaxAge)
+		if err != nil {
+			return errors.New("MaxAge is not a valid duration")
+		}
+	}
+	if !limited {
+		fmt.Fprintf(os.Stderr, "WARNING: None of %s MaxBackups, MaxAge, or Keep* is set. Those copies will never be deleted.\n", what)
+	}
+	return nil
+}
+
+// the rules as a policy, so applyRetention can use them
+func (r CopyRetention) policy(name string) BackupPolicy {
+	policy := BackupPolicy{
+		Name:        name,
+		MaxBackups:  math.MaxInt64,
+		MaxAge:      configDuration(r.MaxAge, time.Duration(math.MaxInt64)),
+		KeepDaily:   r.KeepDaily,
+		KeepWeekly:  r.KeepWeekly,
+		KeepMonthly: r.KeepMonthly,
+		KeepYearly:  r.KeepYearly,
+	}
+	if r.MaxBackups != 0 {
+		policy.MaxBackups = r.MaxBackups
+	}
+	return policy
+}
+
+// a copy of a backup somewhere other than LocalPath
+type backupCopy struct {
+	Name string
+	// empty if we can't tell (ex: a partial copy)
+	VMUUID string
+	Time   time.Time
+	// false if it was interrupted (it has no manifest)
+	Complete bool
+}
+
+type copyDeletion struct {
+	// index into the copies given to planCopies
+	Index  int
+	Reason string
+}
+
+// work out which local backups to copy and which copies to delete, so a
+// place ends up with what policy keeps. Local backups and copies of each VM
+// are considered together, so backups that would be deleted right away
+// aren't copied. Only complete backups (with a manifest) are copied.
+// Partial copies of backups that are gone from LocalPath can never be
+// finished, so they are deleted. Copies are returned oldest first, so if we
+// run out of time the backups most likely to be deleted locally soon are
+// already safe.
+func planCopies(policy BackupPolicy, folders []BackupFolder, copies []backupCopy) ([]BackupFolder, []copyDeletion) {
+	// a backup, here and/or copied. Backup names are unique, so they are
+	// matched up by name.
+	type backup struct {
+		Name   string
+		VMUUID string
+		Time   time.Time
+		Local  *BackupFolder
+		Copy   int
+	}
+	byName := make(map[string]*backup)
+	var backups []*backup
+	add := func(name, vmUUID string, t time.Time) *backup {
+		b, exists := byName[name]
+		if !exists {
+			b = &backup{Name: name, Time: t, Copy: -1}
+			byName[name] = b
+			backups = append(backups, b)
+		}
+		if b.VMUUID == "" {
+			b.VMUUID = vmUUID
+		}
+		return b
+	}
+	for i, folder := range folders {
+		if folder.Status == BackupComplete && folder.VMUUID != "" {
+			add(folder.Name, folder.VMUUID, folder.Time).Local = &folders[i]
+		}
+	}
+	for i, c := range copies {
+		add(c.Name, c.VMUUID, c.Time).Copy = i
+	}
+
+	var deletions []copyDeletion
+	byVM := make(map[string][]*backup)
+	var vmUUIDs []string
+	for _, b := range backups {
+		if b.Local == nil && !copies[b.Copy].Complete {
+			deletions = append(deletions, copyDeletion{
+				Index:  b.Copy,
+				Reason: "partial copy of a backup that is no longer here",
+			})
+			continue
+		}
+		// a copy with a damaged manifest, leave it for a person to sort out
+		if b.VMUUID == "" {
+			continue
+		}
+		if byVM[b.VMUUID] == nil {
+			vmUUIDs = append(vmUUIDs, b.VMUUID)
+		}
+		byVM[b.VMUUID] = append(byVM[b.VMUUID], b)
+	}
+
+	var toCopy []BackupFolder
+	for _, vmUUID := range vmUUIDs {
+		list := byVM[vmUUID]
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Time.After(list[j].Time)
+		})
+		var times []time.Time
+		for _, b := range list {
+			times = append(times, b.Time)
+		}
+
+		for i, kept := range applyRetention(policy, times) {
+			b := list[i]
+			switch {
+			case kept.Kept() && (b.Copy == -1 || !copies[b.Copy].Complete):
+				toCopy = append(toCopy, *b.Local)
+			case !kept.Kept() && b.Copy != -1:
+				deletions = append(deletions, copyDeletion{
+					Index:  b.Copy,
+					Reason: policy.deletionReason(kept, i, len(times)),
+				})
+			}
+		}
+	}
+
+	sort.Slice(toCopy, func(i, j int) bool {
+		return toCopy[i].Time.Before(toCopy[j].Time)
+	})
+	sort.Slice(deletions, func(i, j int) bool {
+		return copies[deletions[i].Index].Name < copies[deletions[j].Index].Name
+	})
+	return toCopy, deletions
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the daemon writes its status here (under LocalPath) whenever it changes
+const daemonStatusFileName = ".scale-backup-daemon.json"
+
+// longest we sleep without checking the time again, in case the system
+// clock jumps or the machine is suspended
+const daemonMaxSleep = 10 * time.Minute
+
+type DaemonStatus struct {
+	PID     int
+	Started time.Time
+	// waiting, running, or stopped
+	State string
+	// the backup window we are in, or the next one
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// when the config was last (re)loaded, and why the last reload failed
+	ConfigLoaded time.Time
+	ConfigError  string `json:",omitempty"`
+	// the most recent run of the schedule
+	LastRunStarted  time.Time
+	LastRunFinished time.Time
+	LastRunError    string `json:",omitempty"`
+	Updated         time.Time
+}
+
+var daemonStatus struct {
+	sync.Mutex
+	DaemonStatus
+}
+
+func daemonStatusFile() string {
+	return filepath.Join(Config.SMB.LocalPath, daemonStatusFileName)
+}
+
+// change the daemon's status and write it out
+func updateDaemonStatus(update func(status *DaemonStatus)) {
+	daemonStatus.Lock()
+	defer daemonStatus.Unlock()
+
+	update(&daemonStatus.DaemonStatus)
+	daemonStatus.Updated = clock.Now()
+
+	statusJSON, err := json.MarshalIndent(daemonStatus.DaemonStatus, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	err = writeFileAtomic(daemonStatusFile(), statusJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write daemon status: %s\n", err)
+	}
+}
+
+// run as a service, running the schedule whenever a backup window opens.
+// SIGHUP reloads the config.
+func Daemon(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	return runDaemon(ctx, hup)
+}
+
+func runDaemon(ctx context.Context, reload <-chan os.Signal) error {
+	DebugCall()
+
+	if !ScheduleConfigured() {
+		return emailError(
+			"Daemon not started",
+			"The daemon can't run because the schedule is not configured",
+		)
+	}
+
+	updateDaemonStatus(func(status *DaemonStatus) {
+		*status = DaemonStatus{
+			PID:          os.Getpid(),
+			Started:      clock.Now(),
+			State:        "waiting",
+			ConfigLoaded: clock.Now(),
+		}
+	})
+	defer updateDaemonStatus(func(status *DaemonStatus) {
+		status.State = "stopped"
+	})
+	fmt.Println("Daemon started")
+
+	// sleep until `until`, a config reload, or we are stopped
+	sleep := func(until time.Time) {
+		wait := until.Sub(clock.Now())
+		if wait > daemonMaxSleep {
+			wait = daemonMaxSleep
+		}
+		select {
+		case <-ctx.Done():
+		case <-reload:
+			reloadDaemonConfig()
+		case <-time.After(wait):
+		}
+	}
+
+	// the end of the last window we ran the schedule in, so we only run
+	// once per window
+	var lastWindowEnd time.Time
+	for ctx.Err() == nil {
+		window, ok := NextWindow()
+		if !ok {
+			updateDaemonStatus(func(status *DaemonStatus) {
+				status.State = "waiting"
+				status.WindowStart = time.Time{}
+				status.WindowEnd = time.Time{}
+			})
+			sleep(clock.Now().Add(daemonMaxSleep))
+			continue
+		}
+		updateDaemonStatus(func(status *DaemonStatus) {
+			status.State = "waiting"
+			status.WindowStart = window.Start
+			status.WindowEnd = window.End
+		})
+
+		// wait for the window to open, or to close if we already ran
+		// the schedule in this one
+		if clock.Now().Before(window.Start) {
+			sleep(window.Start)
+			continue
+		}
+		if window.End.Equal(lastWindowEnd) || !ScheduleIsActive() {
+			sleep(window.End)
+			continue
+		}
+
+		fmt.Printf("Backup window open until %s\n", window.End.Format("03:04 PM"))
+		updateDaemonStatus(func(status *DaemonStatus) {
+			status.State = "running"
+			status.LastRunStarted = clock.Now()
+			status.LastRunFinished = time.Time{}
+			status.LastRunError = ""
+		})
+		err := Schedule(ctx)
+		lastWindowEnd = window.End
+		updateDaemonStatus(func(status *DaemonStatus) {
+			status.LastRunFinished = clock.Now()
+			if err != nil {
+				status.LastRunError = err.Error()
+			}
+		})
+		// a SIGHUP that came in during the run is still waiting in
+		// reload and will be picked up by the next sleep
+	}
+
+	fmt.Println("Daemon stopped")
+	return ctx.Err()
+}
+
+// reload the config, keeping the old one if the new one is broken or has
+// no schedule for us to run
+func reloadDaemonConfig() {
+	fmt.Println("Reloading config")
+	savedConfig := Config
+	savedScale := Scale
+	savedOffsite := Offsite
+	err := ReloadConfig()
+	if err == nil && !ScheduleConfigured() {
+		Config = savedConfig
+		Scale = savedScale
+		Offsite = savedOffsite
+		err = errors.New("the schedule is not configured")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config reload failed, keeping the old config: %s\n", err)
+		Email(
+			"Config reload failed",
+			fmt.Sprintf("Config reload failed, keeping the old config: %s", err),
+		)
+		updateDaemonStatus(func(status *DaemonStatus) {
+			status.ConfigError = err.Error()
+		})
+		return
+	}
+	updateDaemonStatus(func(status *DaemonStatus) {
+		status.ConfigLoaded = clock.Now()
+		status.ConfigError = ""
+	})
+}
+
+// read the status the daemon last wrote
+func ReadDaemonStatus() (*DaemonStatus, error) {
+	return readDaemonStatus(daemonStatusFile())
+}
+
+func readDaemonStatus(statusFile string) (*DaemonStatus, error) {
+	statusJSON, err := os.ReadFile(statusFile)
+	if err != nil {
+		return nil, err
+	}
+	var status DaemonStatus
+	err = json.Unmarshal(statusJSON, &status)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", statusFile, err)
+	}
+	if status.State != "stopped" && !processAlive(status.PID) {
+		// it died without getting a chance to say so
+		status.State = "stopped"
+	}
+	return &status, nil
+}
+
+func ShowDaemonStatus() {
+	DebugCall()
+
+	status, err := ReadDaemonStatus()
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("The daemon has never run")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read daemon status: %s\n", err)
+		return
+	}
+
+	const layout = "2006-01-02 03:04 PM"
+	fmt.Printf("State: %s (PID %d, started %s)\n", status.State, status.PID, status.Started.Format(layout))
+	if !status.WindowStart.IsZero() {
+		fmt.Printf(
+			"Backup window: %s to %s\n",
+			status.WindowStart.Format(layout),
+			status.WindowEnd.Format(layout),
+		)
+	}
+	fmt.Printf("Config loaded: %s\n", status.ConfigLoaded.Format(layout))
+	if status.ConfigError != "" {
+		fmt.Printf("Last config reload failed: %s\n", status.ConfigError)
+	}
+	if !status.LastRunStarted.IsZero() {
+		fmt.Printf("Last run started: %s\n", status.LastRunStarted.Format(layout))
+		if !status.LastRunFinished.IsZero() {
+			fmt.Printf("Last run finished: %s\n", status.LastRunFinished.Format(layout))
+		}
+		if status.LastRunError != "" {
+			fmt.Printf("Last run failed: %s\n", status.LastRunError)
+		}
+	}
+
+	jobs, err := loadJobs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of running backups: %s\n", err)
+		return
+	}
+	var running []Job
+	for _, job := range jobs {
+		running = append(running, job)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Started.Before(running[j].Started)
+	})
+	for _, job := range running {
+		fmt.Printf("Running: %s (task %s, started %s)\n", job.VMName, job.TaskTag, job.Started.Format(layout))
+	}
+}
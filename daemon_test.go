@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// poll the daemon status file until check returns true. Config belongs to
+// the daemon while it is running, so the file name is worked out up front.
+func waitForDaemonStatus(t *testing.T, statusFile string, check func(*DaemonStatus) bool) *DaemonStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := readDaemonStatus(statusFile)
+		if err == nil && check(status) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for daemon status")
+	return nil
+}
+
+func TestDaemon(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.Tag = "BackMeUp"
+	Config.Schedule.Concurrency = 2
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	fake.AddVM("dc01", "BackMeUp")
+
+	statusFile := daemonStatusFile()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- runDaemon(ctx, reload)
+	}()
+
+	// the window is already open, so it should run the schedule once and
+	// then wait for the window to close
+	status := waitForDaemonStatus(t, statusFile, func(status *DaemonStatus) bool {
+		return !status.LastRunFinished.IsZero() && status.State == "waiting"
+	})
+	if status.LastRunError != "" {
+		t.Errorf("unexpected error from run: %s", status.LastRunError)
+	}
+	if status.PID != os.Getpid() {
+		t.Errorf("expected PID %d, got %d", os.Getpid(), status.PID)
+	}
+
+	// a broken config is reported and the old one is kept
+	configFile := filepath.Join(t.TempDir(), "scale-backup.toml")
+	err := os.WriteFile(configFile, []byte("[Schedule]\nTag = 'Other'\nthis is not toml\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCALE_BACKUP_CONFIG", configFile)
+	reload <- syscall.SIGHUP
+	status = waitForDaemonStatus(t, statusFile, func(status *DaemonStatus) bool {
+		return status.ConfigError != ""
+	})
+
+	cancel()
+	<-done
+	if Config.Schedule.Tag != "BackMeUp" {
+		t.Errorf("config should not have changed, Tag is %q", Config.Schedule.Tag)
+	}
+
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["dc01"]) != 1 {
+		t.Errorf("expected 1 backup of dc01, got %d", len(backups["dc01"]))
+	}
+	status, err = ReadDaemonStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "stopped" {
+		t.Errorf("expected daemon to be stopped, got %s", status.State)
+	}
+}
+
+func TestDaemonReloadWithoutSchedule(t *testing.T) {
+	setupFakeScale(t)
+	Config.Schedule.StartTime = "5:00 PM"
+	Config.Schedule.EndTime = "6:00 AM"
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.MaxBackups = 2
+
+	// valid, but the daemon would have nothing to do
+	configFile := filepath.Join(t.TempDir(), "scale-backup.toml")
+	err := os.WriteFile(configFile, []byte(`
+[SMB]
+Username = "user"
+Password = "pass"
+Host = "localhost"
+ShareName = "backups"
+LocalPath = `+strconv.Quote(Config.SMB.LocalPath)+`
+
+[Scale]
+Username = "admin"
+Password = "admin"
+Host = "localhost"
+CertFingerprint = "00"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SCALE_BACKUP_CONFIG", configFile)
+
+	reloadDaemonConfig()
+	if !ScheduleConfigured() || Config.Schedule.StartTime != "5:00 PM" {
+		t.Errorf("the old schedule should have been kept, got %+v", Config.Schedule)
+	}
+	status, err := ReadDaemonStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ConfigError == "" {
+		t.Error("expected the rejected reload to be reported")
+	}
+	// this would panic if the schedule had been dropped
+	NextWindow()
+}
+
+func TestDaemonWaitsForWindow(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(3 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.MaxBackups = 2
+	fake.AddVM("dc01")
+
+	statusFile := daemonStatusFile()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runDaemon(ctx, nil)
+	}()
+
+	status := waitForDaemonStatus(t, statusFile, func(status *DaemonStatus) bool {
+		return !status.WindowStart.IsZero()
+	})
+	cancel()
+	<-done
+
+	if status.State != "waiting" || status.WindowStart.Before(now) {
+		t.Errorf("expected to be waiting for a later window: %+v", status)
+	}
+	if !status.LastRunStarted.IsZero() {
+		t.Error("schedule should not run outside the window")
+	}
+	for _, req := range fake.Requests() {
+		if req == "POST /rest/v1/VirDomain/"+fake.VM("dc01").UUID+"/export" {
+			t.Error("no backups should have been started")
+		}
+	}
+}
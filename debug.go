@@ -103,12 +103,18 @@ func DebugHTTP(c *http.Client, r *http.Request) (*http.Response, error) {
 		r.URL.RequestURI(),
 	))
 
-	// get request body
+	// get request body. Bodies that can only be read once (ex: a disk
+	// image being uploaded) are streamed and not logged.
 	var reqBody []byte
-	if r.Body != nil {
+	if r.Body != nil && r.GetBody != nil {
 		reqBody, _ = io.ReadAll(r.Body)
 		r.Body.Close()
 		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+	} else if r.Body != nil {
+		logEntry.WriteString(fmt.Sprintf(
+			"Request body: %d bytes, not logged\n",
+			r.ContentLength,
+		))
 	}
 	if Config.Debug.RedactPasswords {
 		r := regexp.MustCompile("smb://[^@]+@")
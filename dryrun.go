@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// set by --dry-run: show what schedule and cleanup would do without
+// exporting or deleting anything
+var dryRun bool
+
+func addDryRunFlag(flags *flag.FlagSet) {
+	flags.BoolVar(
+		&dryRun,
+		"dry-run",
+		false,
+		"print what would be exported and deleted, and why, without doing it",
+	)
+}
+
+// go through the schedule without starting any exports, printing what would
+// be backed up (and roughly when), what would be skipped, and what the
+// replica and offsite syncs and cleanup would do. Exports are assumed to
+// take as long as their history predicts (no time at all if they have no
+// history), and nothing else is assumed to be running on the cluster.
+func planSchedule(ctx context.Context) error {
+	DebugCall()
+
+	fmt.Println("Dry run: nothing will be exported or deleted")
+	window, ok := NextWindow()
+	if !ok {
+		fmt.Println("No backups would run: there is no backup window in the next year")
+		return nil
+	}
+	if ScheduleIsActive() {
+		fmt.Printf("Schedule: %s\n", describeNextWindow())
+	} else {
+		fmt.Printf("Not in a backup window, so schedule would not start now. Planning for the %s.\n", describeNextWindow())
+	}
+
+	orphans, err := OrphanedJobs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check for unfinished backups: %s\n", err)
+	}
+	for _, job := range orphans {
+		fmt.Printf("Would reattach to backup of %s (task %s)\n", job.VMName, job.TaskTag)
+	}
+
+	queue, err := backupQueue(ctx, false)
+	if err != nil {
+		return err
+	}
+	history, err := loadHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load backup history: %s\n", err)
+	}
+	if len(queue) == 0 {
+		fmt.Println("No backups are due")
+	}
+
+	// when each of our Concurrency export slots is next free
+	start := clock.Now()
+	if window.Start.After(start) {
+		start = window.Start
+	}
+	slots := make([]time.Time, Config.Schedule.Concurrency)
+	if len(slots) == 0 {
+		slots = make([]time.Time, 1)
+	}
+	for i := range slots {
+		slots[i] = start
+	}
+
+	const layout = "03:04 PM"
+	for _, vm := range queue {
+		// the same check Schedule makes when a slot frees up
+		slot := 0
+		for i := range slots {
+			if slots[i].Before(slots[slot]) {
+				slot = i
+			}
+		}
+		startAt := slots[slot]
+		if !startAt.Before(window.End) {
+			fmt.Printf("Would not get to %s before the window closes\n", vm.Name)
+			continue
+		}
+		remaining := window.End.Sub(startAt)
+		predicted, tooLong := wontFit(history, vm.UUID, vm.Name, remaining)
+		if tooLong {
+			fmt.Printf(
+				"Would skip %s: it usually takes %s and would start at %s with %s left in the window\n",
+				vm.Name,
+				describeDuration(predicted),
+				startAt.Format(layout),
+				describeDuration(remaining),
+			)
+			continue
+		}
+
+		expected := "unknown"
+		if _, known := predictDuration(history, vm.UUID, vm.Name); known {
+			expected = describeDuration(predicted)
+		}
+		fmt.Printf(
+			"Would back up %s at about %s (takes %s): %s\n",
+			vm.Name,
+			startAt.Format(layout),
+			expected,
+			vm.Why(),
+		)
+		slots[slot] = startAt.Add(predicted)
+	}
+
+	if len(Config.Replicas) != 0 {
+		err = SyncReplicas(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if OffsiteConfigured() {
+		err = SyncOffsite(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return Cleanup(ctx)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleDryRun(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.Concurrency = 2
+	fake.AddVM("web01")
+	fake.AddVM("big")
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {2 * day, 3 * day, 4 * day},
+		"big":   {2 * day},
+	})
+	recordBackup("", "big", BackupRecord{Duration: 6 * time.Hour})
+	dryRun = true
+
+	err := Schedule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range fake.Requests() {
+		if strings.HasSuffix(req, "/export") {
+			t.Errorf("dry run should not start exports, got %s", req)
+		}
+	}
+	ages := backupAges(t)
+	if len(ages["web01"]) != 3 || len(ages["big"]) != 1 {
+		t.Errorf("dry run should not create or delete backups, got %v", ages)
+	}
+}
+
+func TestPlanCleanup(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.MaxAge = "10 days"
+	fake.AddVM("web01")
+	fake.AddVM("web02")
+	fake.AddVM("web03")
+	fake.AddVM("web04")
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {day, 2 * day, 3 * day},
+		"web02": {day, 11 * day},
+		"web03": {day},
+		"web04": {day},
+	})
+
+	plan, err := planCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Skipped) != 0 {
+		t.Fatalf("cleanup should be allowed: %+v", plan.Skipped)
+	}
+	if len(plan.Deletions) != 2 {
+		t.Fatalf("expected 2 deletions, got %+v", plan.Deletions)
+	}
+	// sorted by name, so oldest first
+	web02, web01 := plan.Deletions[0], plan.Deletions[1]
+	if !strings.HasSuffix(web01.BackupName, " web01") || !strings.Contains(web01.Reason, "MaxBackups is 2") {
+		t.Errorf("unexpected deletion: %+v", web01)
+	}
+	if !strings.HasSuffix(web02.BackupName, " web02") || !strings.Contains(web02.Reason, "MaxAge") {
+		t.Errorf("unexpected deletion: %+v", web02)
+	}
+
+	dryRun = true
+	err = Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages := backupAges(t)
+	if len(ages["web01"]) != 3 || len(ages["web02"]) != 2 {
+		t.Errorf("dry run should not delete backups, got %v", ages)
+	}
+}
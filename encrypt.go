@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// When [Encryption] is configured, disk images are encrypted as soon as an
+// export finishes, so only the private key (which doesn't need to be on
+// this machine until a restore) can read them. Each file gets a random key,
+// which is wrapped for the configured X25519 public key. The file itself
+// is encrypted with AES-256-GCM in chunks, so it can be streamed and any
+// change or truncation is caught.
+//
+// An encrypted file is:
+//
+//	encryptedMagic
+//	ephemeral X25519 public key (32 bytes)
+//	the file key, sealed with a key derived from the ephemeral key and the
+//	  recipient key (48 bytes)
+//	chunks of up to encryptedChunkSize bytes, each sealed with the file key
+//	  (16 more bytes each). The nonce is the chunk number, with the last
+//	  byte set on the final chunk.
+
+// added to the name of an encrypted file, ex: disk.qcow2.enc
+const encryptedSuffix = ".enc"
+
+const encryptedMagic = "scale-backup encrypted v1\n"
+
+const encryptedChunkSize = 64 << 10
+
+// encrypted backups are decrypted into this folder under LocalPath to be
+// restored, since Scale imports straight from the share
+const stagingFolderName = ".scale-backup-staging"
+
+func EncryptionConfigured() bool {
+	return Config.Encryption.PublicKey != ""
+}
+
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("is not valid base64")
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errors.New("is not an X25519 public key")
+	}
+	return key, nil
+}
+
+// read a private key written by encryption-keygen. Lines starting with #
+// are comments.
+func readPrivateKey(file string) (*ecdh.PrivateKey, error) {
+	keyFile, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(keyFile), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a private key", file)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an X25519 private key", file)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s has no private key in it", file)
+}
+
+// check Config.Encryption
+func validateEncryption() error {
+	publicKey, err := parsePublicKey(Config.Encryption.PublicKey)
+	if err != nil {
+		return fmt.Errorf("PublicKey %w", err)
+	}
+	// only needed for restores, but if it is set it has to be the right one
+	if Config.Encryption.PrivateKeyFile != "" {
+		privateKey, err := readPrivateKey(Config.Encryption.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("PrivateKeyFile: %w", err)
+		}
+		if !privateKey.PublicKey().Equal(publicKey) {
+			return errors.New("PrivateKeyFile does not match PublicKey")
+		}
+	}
+	return nil
+}
+
+// make a key pair, writing the private key to file (which must not exist
+// yet) and returning the public key
+func GenerateKey(file string) (string, error) {
+	debugReturn := DebugCall(file)
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		debugReturn("", err)
+		return "", err
+	}
+	publicKey := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		debugReturn("", err)
+		return "", err
+	}
+	_, err = fmt.Fprintf(
+		f,
+		"# scale-backup private key, keep it secret and keep a copy somewhere safe\n# public key: %s\n%s\n",
+		publicKey,
+		base64.StdEncoding.EncodeToString(key.Bytes()),
+	)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	debugReturn(publicKey, err)
+	return publicKey, err
+}
+
+// HKDF-SHA256 (RFC 5869) for a single 32 byte key
+func deriveKey(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	return newGCM(deriveKey(shared, salt, "scale-backup file key"))
+}
+
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypt src for recipient, writing dst
+func encryptFile(src, dst string, recipient *ecdh.PublicKey) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fileKey := make([]byte, 32)
+	_, err = rand.Read(fileKey)
+	if err != nil {
+		return err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return err
+	}
+	wrap, err := wrapKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return err
+	}
+	payload, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	w.WriteString(encryptedMagic)
+	w.Write(ephemeral.PublicKey().Bytes())
+	w.Write(wrap.Seal(nil, make([]byte, wrap.NonceSize()), fileKey, []byte(encryptedMagic)))
+
+	r := bufio.NewReaderSize(in, encryptedChunkSize)
+	buf := make([]byte, encryptedChunkSize)
+	sealed := make([]byte, 0, encryptedChunkSize+payload.Overhead())
+	for n := uint64(0); ; n++ {
+		length, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// the last chunk is the one with nothing after it, which may be
+		// empty
+		_, peekErr := r.Peek(1)
+		last := peekErr == io.EOF
+		if peekErr != nil && !last {
+			return peekErr
+		}
+		_, err = w.Write(payload.Seal(sealed[:0], chunkNonce(n, last), buf[:length], nil))
+		if err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// decrypt src with key, writing dst. An error means src was damaged,
+// truncated, or encrypted for a different key.
+func decryptFile(ctx context.Context, src, dst string, key *ecdh.PrivateKey) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReaderSize(in, encryptedChunkSize+16)
+
+	header := make([]byte, len(encryptedMagic)+32+48)
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return fmt.Errorf("%s is not an encrypted file", src)
+	}
+	ephemeralBytes := header[len(encryptedMagic) : len(encryptedMagic)+32]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return fmt.Errorf("%s has a damaged header", src)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return err
+	}
+	wrap, err := wrapKey(shared, ephemeralBytes, key.PublicKey().Bytes())
+	if err != nil {
+		return err
+	}
+	fileKey, err := wrap.Open(nil, make([]byte, wrap.NonceSize()), header[len(encryptedMagic)+32:], []byte(encryptedMagic))
+	if err != nil {
+		return fmt.Errorf("%s was encrypted for a different key (or is damaged)", src)
+	}
+	payload, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	buf := make([]byte, encryptedChunkSize+payload.Overhead())
+	plain := make([]byte, 0, encryptedChunkSize)
+	for n := uint64(0); ; n++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		length, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return fmt.Errorf("%s is truncated", src)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := r.Peek(1)
+		last := peekErr == io.EOF
+		if peekErr != nil && !last {
+			return peekErr
+		}
+		chunk, err := payload.Open(plain[:0], chunkNonce(n, last), buf[:length], nil)
+		if err != nil {
+			return fmt.Errorf("%s is damaged or truncated (chunk %d)", src, n)
+		}
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// return the disk images in a backup folder, relative to it
+func diskImages(folder string) ([]string, error) {
+	var images []string
+	err := filepath.WalkDir(
+		folder,
+		func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			if isDiskImage(path) && !strings.HasSuffix(path, encryptedSuffix) {
+				name, err := filepath.Rel(folder, path)
+				if err != nil {
+					return err
+				}
+				images = append(images, name)
+			}
+			return nil
+		},
+	)
+	return images, err
+}
+
+// encrypt each disk image in a backup that just finished, replacing it with
+// an encrypted copy. If that fails, only the unfinished encrypted copy is
+// deleted. The plain disk images are kept (the caller marks the backup
+// failed), so a full disk doesn't cost us a good export, and running this
+// again carries on with the ones that are left.
+func encryptBackup(backupName string) error {
+	debugReturn := DebugCall(backupName)
+
+	recipient, err := parsePublicKey(Config.Encryption.PublicKey)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	folder := filepath.Join(Config.SMB.LocalPath, backupName)
+	images, err := diskImages(folder)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	for _, image := range images {
+		file := filepath.Join(folder, image)
+		err = encryptFile(file, file+encryptedSuffix+".part", recipient)
+		if err == nil {
+			err = os.Rename(file+encryptedSuffix+".part", file+encryptedSuffix)
+		}
+		if err == nil {
+			err = os.Remove(file)
+		}
+		if err != nil {
+			os.Remove(file + encryptedSuffix + ".part")
+			break
+		}
+	}
+
+	debugReturn(err)
+	return err
+}
+
+// return true if a backup has encrypted files in it
+func backupEncrypted(backupName string) (bool, error) {
+	encrypted := false
+	err := filepath.WalkDir(
+		filepath.Join(Config.SMB.LocalPath, backupName),
+		func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && strings.HasSuffix(path, encryptedSuffix) {
+				encrypted = true
+				return filepath.SkipAll
+			}
+			return err
+		},
+	)
+	return encrypted, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decrypt a backup into its own folder under stagingFolderName, returning
+// that folder relative to LocalPath (even if there was an error). Files
+// already decrypted by an earlier attempt are kept. Remove the folder with
+// removeStaging when the import is done.
+func stageBackup(ctx context.Context, backupName string) (string, error) {
+	debugReturn := DebugCall(backupName)
+
+	staged := filepath.Join(stagingFolderName, backupName)
+	if Config.Encryption.PrivateKeyFile == "" {
+		err := fmt.Errorf("%s is encrypted, set Encryption PrivateKeyFile to restore it", backupName)
+		debugReturn(staged, err)
+		return staged, err
+	}
+	key, err := readPrivateKey(Config.Encryption.PrivateKeyFile)
+	if err != nil {
+		debugReturn(staged, err)
+		return staged, err
+	}
+
+	src := filepath.Join(Config.SMB.LocalPath, backupName)
+	dst := filepath.Join(Config.SMB.LocalPath, staged)
+	fmt.Printf("Decrypting %s into %s\n", backupName, dst)
+	err = filepath.WalkDir(
+		src,
+		func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return os.MkdirAll(filepath.Join(dst, name), 0755)
+			}
+			// converted copies aren't needed to restore
+			if name == manifestFileName || name == failedMarkerName || isConvertedImage(path) {
+				return nil
+			}
+
+			target := filepath.Join(dst, strings.TrimSuffix(name, encryptedSuffix))
+			if _, err := os.Stat(target); err == nil {
+				// finished by an earlier attempt (it is only renamed into
+				// place once it has all been checked)
+				return nil
+			}
+			if strings.HasSuffix(name, encryptedSuffix) {
+				err = decryptFile(ctx, path, target+".part", key)
+			} else {
+				err = copyFile(path, target+".part")
+			}
+			if err != nil {
+				os.Remove(target + ".part")
+				return err
+			}
+			return os.Rename(target+".part", target)
+		},
+	)
+
+	debugReturn(staged, err)
+	return staged, err
+}
+
+// delete a decrypted copy made by stageBackup
+func removeStaging(staged string) error {
+	if !strings.HasPrefix(staged, stagingFolderName+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not a decrypted copy", staged)
+	}
+	err := os.RemoveAll(filepath.Join(Config.SMB.LocalPath, staged))
+	if err != nil {
+		return err
+	}
+	// only remove the staging folder itself if nothing else is in it
+	os.Remove(filepath.Join(Config.SMB.LocalPath, stagingFolderName))
+	return nil
+}
+
+// return true if path looks like a disk image (or an encrypted one),
+// including ones we converted
+func isDiskImage(path string) bool {
+	path = strings.TrimSuffix(path, encryptedSuffix)
+	formats := make([]string, 0, len(exportFormats)+len(convertFormats))
+	formats = append(formats, exportFormats...)
+	formats = append(formats, convertFormats...)
+	for _, format := range formats {
+		if strings.EqualFold(filepath.Ext(path), "."+format) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// make a key pair and turn on encryption
+func setupEncryption(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "scale-backup.key")
+	publicKey, err := GenerateKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Encryption.PublicKey = publicKey
+	Config.Encryption.PrivateKeyFile = keyFile
+	err = validateEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptFile(t *testing.T) {
+	setupFakeScale(t)
+	setupEncryption(t)
+	ctx := context.Background()
+	recipient, err := parsePublicKey(Config.Encryption.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := readPrivateKey(Config.Encryption.PrivateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		plain := filepath.Join(dir, "disk.qcow2")
+		encrypted := plain + encryptedSuffix
+		decrypted := filepath.Join(dir, "decrypted.qcow2")
+		err := os.WriteFile(plain, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = encryptFile(plain, encrypted, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := os.ReadFile(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 16 && bytes.Contains(sealed, data[:16]) {
+			t.Errorf("%d bytes: encrypted file contains the plain text", size)
+		}
+
+		err = decryptFile(ctx, encrypted, decrypted, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		got, err := os.ReadFile(decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted file does not match", size)
+		}
+
+		// damage and truncation (including whole chunks) are caught
+		header := len(encryptedMagic) + 32 + 48
+		chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		damaged := map[string][]byte{
+			"flipped": append([]byte(nil), sealed...),
+			"no last": sealed[:header+(chunks-1)*(encryptedChunkSize+16)],
+			"extra":   append(append([]byte(nil), sealed...), sealed[header:]...),
+		}
+		damaged["flipped"][len(sealed)-1] ^= 1
+		for what, contents := range damaged {
+			err = os.WriteFile(encrypted, contents, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = decryptFile(ctx, encrypted, decrypted, key)
+			if err == nil {
+				t.Errorf("%d bytes: %s file was decrypted", size, what)
+			}
+		}
+	}
+
+	// and so is the wrong key
+	err = os.WriteFile(filepath.Join(dir, "disk.qcow2"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encryptFile(filepath.Join(dir, "disk.qcow2"), filepath.Join(dir, "disk.qcow2.enc"), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := GenerateKey(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := readPrivateKey(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherKey == Config.Encryption.PublicKey {
+		t.Fatal("generated the same key twice")
+	}
+	err = decryptFile(ctx, filepath.Join(dir, "disk.qcow2.enc"), filepath.Join(dir, "out"), other)
+	if err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Errorf("expected a wrong key error, got %v", err)
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	setupEncryption(t)
+	vm := fake.AddVM("web01")
+
+	err := Backup(ctx, "web01", "manual web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(Config.SMB.LocalPath, "manual web01")
+	disk := vm.BlockDevs[0].UUID + ".qcow2"
+	if _, err := os.Stat(filepath.Join(folder, disk)); !os.IsNotExist(err) {
+		t.Error("unencrypted disk image was left behind")
+	}
+	if _, err := os.Stat(filepath.Join(folder, disk+encryptedSuffix)); err != nil {
+		t.Error("encrypted disk image is missing")
+	}
+	manifest, err := readManifest("manual web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.EncryptedFor != Config.Encryption.PublicKey {
+		t.Errorf("manifest should say which key the backup is encrypted for: %+v", manifest)
+	}
+	if manifest.Size == 0 {
+		t.Error("encrypted disk images should count towards the backup size")
+	}
+
+	Restore(ctx, "manual web01", "web01-restored")
+	if fake.VM("web01-restored") == nil {
+		t.Fatal("restored VM was not created")
+	}
+	if !strings.Contains(fake.lastImport.Source.PathURI, stagingFolderName) {
+		t.Errorf("expected the import to be from the staging folder, got %s", fake.lastImport.Source.PathURI)
+	}
+	want := "QFI\xfb fake disk " + vm.BlockDevs[0].UUID
+	if got := string(fake.importedFiles[disk]); got != want {
+		t.Errorf("expected the import to see the decrypted disk image %q, got %q", want, got)
+	}
+	if _, exists := fake.importedFiles[disk+encryptedSuffix]; exists {
+		t.Error("the encrypted disk image should not be imported")
+	}
+	if _, err := os.Stat(filepath.Join(Config.SMB.LocalPath, stagingFolderName)); !os.IsNotExist(err) {
+		t.Error("the decrypted copy was not deleted")
+	}
+
+	// without the private key it can't be restored
+	Config.Encryption.PrivateKeyFile = ""
+	Restore(ctx, "manual web01", "web01-again")
+	if fake.VM("web01-again") != nil {
+		t.Error("restore should fail without the private key")
+	}
+	if _, err := os.Stat(folder); err != nil {
+		t.Errorf("the backup should not be touched: %s", err)
+	}
+}
+
+func TestEncryptBackupFailureKeepsImages(t *testing.T) {
+	setupFakeScale(t)
+	setupEncryption(t)
+	folder := filepath.Join(Config.SMB.LocalPath, "manual web01")
+	err := os.Mkdir(folder, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.qcow2", "b.qcow2"} {
+		err = os.WriteFile(filepath.Join(folder, name), []byte("disk "+name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// something in the way of the second image's encrypted copy
+	err = os.Mkdir(filepath.Join(folder, "b.qcow2"+encryptedSuffix+".part"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encryptBackup("manual web01")
+	if err == nil {
+		t.Fatal("expected encryption to fail")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "a.qcow2"+encryptedSuffix)); err != nil {
+		t.Error("the first image should have been encrypted")
+	}
+	if data, err := os.ReadFile(filepath.Join(folder, "b.qcow2")); string(data) != "disk b.qcow2" {
+		t.Errorf("the second image should be kept, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "b.qcow2"+encryptedSuffix+".part")); !os.IsNotExist(err) {
+		t.Error("the unfinished encrypted copy should be removed")
+	}
+
+	// and it can be retried
+	err = encryptBackup("manual web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := diskImages(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("expected every image to be encrypted, still have %v", images)
+	}
+}
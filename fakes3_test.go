@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an in-memory stand-in for an S3-compatible server (like MinIO) with one
+// bucket. It checks request signatures, payload hashes, and Content-MD5
+// the way a real server would.
+type fakeS3 struct {
+	t      *testing.T
+	server *httptest.Server
+	client *S3Client
+
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	uploads map[string]*fakeS3Upload
+	nextID  int
+	// after this many more UploadPart requests, fail the rest with a 500
+	// (-1 to never fail)
+	failPartsAfter int
+	// fail this many more requests for an S3 operation with a 500, either
+	// before doing anything (failNext) or after doing the work, as if the
+	// response got lost (loseNext)
+	failNext map[string]int
+	loseNext map[string]int
+	// every request we received, as "METHOD key" plus the S3 operation
+	requests []string
+}
+
+type fakeS3Object struct {
+	Data []byte
+	Meta map[string]string
+	ETag string
+}
+
+type fakeS3Upload struct {
+	Key   string
+	Meta  map[string]string
+	Parts map[int][]byte
+}
+
+const fakeS3Bucket = "backups"
+
+// listings are paged this small so paging gets tested
+const fakeS3PageSize = 3
+
+func setupFakeS3(t *testing.T) *fakeS3 {
+	savedOffsite := Offsite
+	t.Cleanup(func() {
+		Offsite = savedOffsite
+	})
+
+	f := &fakeS3{
+		t:       t,
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]*fakeS3Upload),
+		// never fail
+		failPartsAfter: -1,
+		failNext:       make(map[string]int),
+		loseNext:       make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	endpoint, err := url.Parse(f.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Offsite.Endpoint = f.server.URL
+	Config.Offsite.Region = "us-east-1"
+	Config.Offsite.Bucket = fakeS3Bucket
+	Config.Offsite.Prefix = "site1/"
+	Config.Offsite.AccessKey = "minio"
+	Config.Offsite.SecretKey = "minio-secret"
+	Config.Offsite.PartSize = defaultPartSize
+	f.client = &S3Client{
+		Endpoint:     *endpoint,
+		Region:       Config.Offsite.Region,
+		Bucket:       fakeS3Bucket,
+		AccessKey:    Config.Offsite.AccessKey,
+		SecretKey:    Config.Offsite.SecretKey,
+		HTTP:         f.server.Client(),
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	}
+	Offsite = f.client
+	return f
+}
+
+// let n more parts upload, then fail every part (retries included) until
+// called again with -1
+func (f *fakeS3) FailPartsAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failPartsAfter = n
+}
+
+// fail the next n requests for op (an S3 operation name as recorded by
+// Requests) with a 500 before carrying them out
+func (f *fakeS3) FailNext(op string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNext[op] = n
+}
+
+// carry out the next n requests for op, but answer them with a 500
+func (f *fakeS3) LoseNext(op string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loseNext[op] = n
+}
+
+func (f *fakeS3) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// return an object's contents, or nil if there isn't one
+func (f *fakeS3) Object(key string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if object, exists := f.objects[key]; exists {
+		return object.Data
+	}
+	return nil
+}
+
+// replace an object's contents without updating its checksum, as if it
+// had been corrupted
+func (f *fakeS3) Corrupt(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key].Data = append([]byte("corrupt"), f.objects[key].Data...)
+}
+
+func (f *fakeS3) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// sign a copy of the request the way the client should have and compare
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) bool {
+	auth := r.Header.Get("Authorization")
+	_, signed, found := strings.Cut(auth, "SignedHeaders=")
+	if !found {
+		return false
+	}
+	signed, _, _ = strings.Cut(signed, ",")
+	signedAt, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return false
+	}
+
+	check, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for _, name := range strings.Split(signed, ";") {
+		if name != "host" {
+			check.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	f.client.sign(check, sha256Hex(body), signedAt)
+	return check.Header.Get("Authorization") == auth
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	if !f.checkSignature(r, body) {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if md5Header := r.Header.Get("Content-Md5"); md5Header != "" {
+		sum := md5.Sum(body)
+		if md5Header != base64.StdEncoding.EncodeToString(sum[:]) {
+			f.error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	op := r.Method
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		op = "ListObjectsV2"
+	case query.Has("uploads"):
+		op = "CreateMultipartUpload"
+	case query.Has("partNumber"):
+		op = "UploadPart"
+	case uploadID != "" && r.Method == http.MethodGet:
+		op = "ListParts"
+	case uploadID != "" && r.Method == http.MethodPost:
+		op = "CompleteMultipartUpload"
+	case uploadID != "" && r.Method == http.MethodDelete:
+		op = "AbortMultipartUpload"
+	}
+	f.requests = append(f.requests, op+" "+key)
+	if f.failNext[op] > 0 {
+		f.failNext[op]--
+		f.error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	if f.loseNext[op] > 0 {
+		f.loseNext[op]--
+		defer f.error(w, http.StatusInternalServerError, "InternalError")
+		w = httptest.NewRecorder()
+	}
+
+	meta := make(map[string]string)
+	for name, values := range r.Header {
+		if m, found := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); found {
+			meta[m] = values[0]
+		}
+	}
+
+	switch op {
+	case http.MethodPut:
+		sum := md5.Sum(body)
+		object := &fakeS3Object{Data: body, Meta: meta, ETag: hex.EncodeToString(sum[:])}
+		f.objects[key] = object
+		w.Header().Set("ETag", `"`+object.ETag+`"`)
+	case http.MethodHead, http.MethodGet:
+		object, exists := f.objects[key]
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, value := range object.Meta {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", `"`+object.ETag+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.Data)))
+		if r.Method == http.MethodGet {
+			w.Write(object.Data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "ListObjectsV2":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		start, _ := strconv.Atoi(query.Get("continuation-token"))
+		end := start + fakeS3PageSize
+		truncated := end < len(keys)
+		if !truncated {
+			end = len(keys)
+		}
+		fmt.Fprint(w, "<ListBucketResult>")
+		for _, k := range keys[start:end] {
+			object := f.objects[k]
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%s"</ETag></Contents>`, xmlEscape(k), len(object.Data), object.ETag)
+		}
+		fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated>", truncated)
+		if truncated {
+			fmt.Fprintf(w, "<NextContinuationToken>%d</NextContinuationToken>", end)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case "CreateMultipartUpload":
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeS3Upload{Key: key, Meta: meta, Parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case "UploadPart":
+		upload, exists := f.uploads[uploadID]
+		if !exists || upload.Key != key {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if f.failPartsAfter == 0 {
+			f.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		if f.failPartsAfter > 0 {
+			f.failPartsAfter--
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.Parts[number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case "ListParts":
+		upload, exists := f.uploads[uploadID]
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for number := range upload.Parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult>")
+		for _, number := range numbers {
+			sum := md5.Sum(upload.Parts[number])
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>"%s"</ETag><Size>%d</Size></Part>`, number, hex.EncodeToString(sum[:]), len(upload.Parts[number]))
+		}
+		fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListPartsResult>")
+	case "CompleteMultipartUpload":
+		upload, exists := f.uploads[uploadID]
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var request struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		err := xml.Unmarshal(body, &request)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		var sums [][]byte
+		for _, part := range request.Parts {
+			partData, exists := upload.Parts[part.PartNumber]
+			sum := md5.Sum(partData)
+			if !exists || strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum[:]) {
+				f.error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, partData...)
+			sums = append(sums, sum[:])
+		}
+		object := &fakeS3Object{Data: data, Meta: upload.Meta, ETag: multipartETag(sums)}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, object.ETag)
+	case "AbortMultipartUpload":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeScale is an in-process stand-in for the parts of the Scale REST API
+// we use. Tasks advance one state every time they are polled:
+// QUEUED -> RUNNING -> COMPLETE (or ERROR if they were set up to fail).
+type fakeScale struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	vms       []*VM
+	tasks     map[string]*fakeTask
+	snapshots map[string]Snapshot
+	uploads   map[string][]byte
+	nextID    int
+	// the next task started for each of these kinds ends in ERROR.
+	// kinds are: export, import, snapshot, delete-snapshot, clone,
+	// update-nic, vm-action
+	failNext map[string]bool
+	// tasks of these kinds stay RUNNING until they are released
+	hold map[string]bool
+	// options from the most recent export and import
+	lastExport ExportOptions
+	lastImport ImportOptions
+	// the files in the folder the most recent import was from
+	importedFiles map[string][]byte
+	// the state VMs are in once an import completes (default SHUTOFF)
+	importedState string
+	// what exports write for each disk (default a fake qcow2 header and
+	// the disk's UUID)
+	diskImage func(disk BlockDev) []byte
+	// every request we received, as "METHOD /path"
+	requests []string
+}
+
+type fakeTask struct {
+	Task
+	kind string
+	// states the task will move through on future polls
+	states     []string
+	onComplete func()
+}
+
+func newFakeScale(t *testing.T) *fakeScale {
+	f := &fakeScale{
+		t:         t,
+		tasks:     make(map[string]*fakeTask),
+		snapshots: make(map[string]Snapshot),
+		uploads:   make(map[string][]byte),
+		failNext:  make(map[string]bool),
+		hold:      make(map[string]bool),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// point the global config and client at a fake cluster and a temporary
+// LocalPath. Everything is put back when the test finishes.
+func setupFakeScale(t *testing.T) *fakeScale {
+	savedConfig := Config
+	savedScale := Scale
+	savedPollInterval := defaultPollInterval
+	savedClusterPollInterval := clusterPollInterval
+	t.Cleanup(func() {
+		Config = savedConfig
+		Scale = savedScale
+		defaultPollInterval = savedPollInterval
+		clusterPollInterval = savedClusterPollInterval
+		delayedHooks = nil
+		restoreOverrides = RestoreOverrides{}
+		dryRun = false
+		forceCleanup = false
+		interruption.leftRunning = false
+		interruption.log = nil
+	})
+
+	Config.SMB.Username = "backup"
+	Config.SMB.Password = "secret"
+	Config.SMB.Host = "nas.test"
+	Config.SMB.ShareName = "Backups"
+	Config.SMB.LocalPath = t.TempDir()
+	Config.Scale.Username = "admin"
+	Config.Scale.Password = "admin"
+	Config.Scale.Host = "scale.test"
+	defaultPollInterval = 10 * time.Millisecond
+	clusterPollInterval = 10 * time.Millisecond
+
+	f := newFakeScale(t)
+	serverURL, err := url.Parse(f.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Scale = &ScaleClient{
+		BaseURL:      url.URL{Scheme: serverURL.Scheme, Host: serverURL.Host},
+		Username:     Config.Scale.Username,
+		Password:     Config.Scale.Password,
+		HTTP:         f.server.Client(),
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	}
+	return f
+}
+
+func (f *fakeScale) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%04d", prefix, f.nextID)
+}
+
+// add a running VM with one disk and one NIC and return it
+func (f *fakeScale) AddVM(name string, tags ...string) *VM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vm := &VM{
+		UUID:    f.id("vm"),
+		Name:    name,
+		Tags:    strings.Join(tags, ","),
+		State:   "RUNNING",
+		NumVCPU: 2,
+		Mem:     4 << 30,
+	}
+	vm.BlockDevs = []BlockDev{{
+		UUID:          f.id("disk"),
+		VirDomainUUID: vm.UUID,
+		Type:          "VIRTIO_DISK",
+		Capacity:      10 << 30,
+		Allocation:    1 << 30,
+	}}
+	vm.NetDevs = []NetDev{f.newNetDev(vm.UUID)}
+	f.vms = append(f.vms, vm)
+	return vm
+}
+
+// a NIC connected to the default VLAN. Must be called with f.mu held.
+func (f *fakeScale) newNetDev(vmUUID string) NetDev {
+	nicUUID := f.id("nic")
+	return NetDev{
+		UUID:          nicUUID,
+		VirDomainUUID: vmUUID,
+		Type:          "VIRTIO",
+		MacAddress:    fmt.Sprintf("7C:4C:58:00:00:%02X", f.nextID%256),
+		Connected:     true,
+	}
+}
+
+// rename a VM, as someone using the cluster's UI would
+func (f *fakeScale) Rename(vm *VM, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm.Name = name
+}
+
+// set the state VMs are left in when an import completes
+func (f *fakeScale) SetImportedState(state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.importedState = state
+}
+
+// set what exports write for each disk
+func (f *fakeScale) SetDiskImage(diskImage func(disk BlockDev) []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.diskImage = diskImage
+}
+
+func (f *fakeScale) VM(name string) *VM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, vm := range f.vms {
+		if vm.Name == name {
+			return vm
+		}
+	}
+	return nil
+}
+
+// add a snapshot that was taken age ago and is kept for retain after
+// that (or forever if retain is 0)
+func (f *fakeScale) AddSnapshot(vm *VM, label, snapType string, age, retain time.Duration) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	taken := clock.Now().Add(-age)
+	snap := Snapshot{
+		UUID:       f.id("snap"),
+		DomainUUID: vm.UUID,
+		Label:      label,
+		Type:       snapType,
+		Timestamp:  taken.Unix(),
+	}
+	if retain != 0 {
+		snap.LocalRetainUntilTimestamp = taken.Add(retain).Unix()
+	}
+	f.snapshots[snap.UUID] = snap
+	return snap.UUID
+}
+
+// return true if a snapshot exists
+func (f *fakeScale) HasSnapshot(snapUUID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.snapshots[snapUUID]
+	return exists
+}
+
+func (f *fakeScale) FailNext(kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNext[kind] = true
+}
+
+// keep tasks of this kind from finishing until Release is called
+func (f *fakeScale) Hold(kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hold[kind] = true
+}
+
+func (f *fakeScale) Release(kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.hold, kind)
+}
+
+// return a task's current state without advancing it
+func (f *fakeScale) TaskState(taskTag string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task, exists := f.tasks[taskTag]
+	if !exists {
+		return ""
+	}
+	return task.State
+}
+
+// return the tags of tasks in the RUNNING state
+func (f *fakeScale) RunningTasks() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tags []string
+	for tag, task := range f.tasks {
+		if task.State == "RUNNING" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (f *fakeScale) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeScale) vmByUUID(uuid string) *VM {
+	for _, vm := range f.vms {
+		if vm.UUID == uuid {
+			return vm
+		}
+	}
+	return nil
+}
+
+// descriptions like the ones Scale gives each kind of task
+var fakeTaskDescriptions = map[string]string{
+	"export":          "Export VM %@",
+	"import":          "Import VM %@",
+	"snapshot":        "Create snapshot of VM %@",
+	"delete-snapshot": "Delete snapshot %@",
+	"clone":           "Clone block device %@",
+	"update-nic":      "Update network device %@",
+	"vm-action":       "Change power state of VM %@",
+}
+
+// add a task of this kind that someone else started. It stays RUNNING
+// until FinishTask is called.
+func (f *fakeScale) StartForeignTask(kind string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task := f.startTask(kind, "", nil)
+	task.State = "RUNNING"
+	task.states = nil
+	return task.TaskTag
+}
+
+func (f *fakeScale) FinishTask(taskTag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tasks[taskTag].State = "COMPLETE"
+}
+
+// register a new task and return its tag. Must be called with f.mu held.
+func (f *fakeScale) startTask(kind, createdUUID string, onComplete func()) *fakeTask {
+	final := "COMPLETE"
+	if f.failNext[kind] {
+		delete(f.failNext, kind)
+		final = "ERROR"
+	}
+	task := &fakeTask{
+		Task: Task{
+			TaskTag:              f.id("task"),
+			State:                "UNINITIALIZED",
+			FormattedDescription: fakeTaskDescriptions[kind],
+			CreatedUUID:          createdUUID,
+		},
+		kind:       kind,
+		states:     []string{"QUEUED", "RUNNING", final},
+		onComplete: onComplete,
+	}
+	f.tasks[task.TaskTag] = task
+	return task
+}
+
+// move a task to its next state. Must be called with f.mu held.
+func (f *fakeScale) advance(task *fakeTask) {
+	if len(task.states) == 0 {
+		return
+	}
+	if task.State == "RUNNING" && f.hold[task.kind] {
+		return
+	}
+	task.State = task.states[0]
+	task.states = task.states[1:]
+	switch task.State {
+	case "RUNNING":
+		task.ProgressPercent = 50
+	case "COMPLETE":
+		task.ProgressPercent = 100
+		if task.onComplete != nil {
+			task.onComplete()
+		}
+	case "ERROR":
+		task.FormattedMessage = "fake " + task.kind + " failure"
+	}
+}
+
+// convert a pathURI from an export or import into a LocalPath folder
+func (f *fakeScale) localFolder(pathURI string) (string, error) {
+	u, err := url.Parse(pathURI)
+	if err != nil {
+		return "", err
+	}
+	prefix := "/" + Config.SMB.ShareName + "/"
+	if u.Scheme != "smb" || u.Host != Config.SMB.Host || !strings.HasPrefix(u.Path, prefix) {
+		return "", fmt.Errorf("pathURI %s is not on our share", pathURI)
+	}
+	return filepath.Join(Config.SMB.LocalPath, strings.TrimPrefix(u.Path, prefix)), nil
+}
+
+func (f *fakeScale) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != Config.Scale.Username || pass != Config.Scale.Password {
+		writeJSON(w, http.StatusUnauthorized, ScaleErrorPayload{Error: "Invalid credentials"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rest/v1/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "VirDomain":
+		vms := make([]VM, 0, len(f.vms))
+		for _, vm := range f.vms {
+			vms = append(vms, *vm)
+		}
+		writeJSON(w, http.StatusOK, vms)
+	case r.Method == "POST" && len(parts) == 2 && parts[0] == "VirDomain" && parts[1] == "import":
+		f.serveImport(w, r)
+	case r.Method == "POST" && len(parts) == 2 && parts[0] == "VirDomain" && parts[1] == "action":
+		f.serveAction(w, r)
+	case r.Method == "PATCH" && len(parts) == 2 && parts[0] == "VirDomainNetDevice":
+		f.serveNetDevUpdate(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "VirDomain":
+		vm := f.vmByUUID(parts[1])
+		if vm == nil {
+			writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomain not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, []VM{*vm})
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "VirDomain" && parts[2] == "export":
+		f.serveExport(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "TaskTag":
+		tasks := make([]Task, 0, len(f.tasks))
+		for _, task := range f.tasks {
+			tasks = append(tasks, task.Task)
+		}
+		writeJSON(w, http.StatusOK, tasks)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "TaskTag":
+		task, exists := f.tasks[parts[1]]
+		if !exists {
+			writeJSON(w, http.StatusOK, []Task{})
+			return
+		}
+		f.advance(task)
+		writeJSON(w, http.StatusOK, []Task{task.Task})
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "VirDomainSnapshot":
+		snapshots := make([]Snapshot, 0, len(f.snapshots))
+		for _, snap := range f.snapshots {
+			snapshots = append(snapshots, snap)
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "VirDomainSnapshot":
+		if _, exists := f.snapshots[parts[1]]; !exists {
+			writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "snapshot not found"})
+			return
+		}
+		snapUUID := parts[1]
+		task := f.startTask("delete-snapshot", "", func() {
+			delete(f.snapshots, snapUUID)
+		})
+		writeJSON(w, http.StatusOK, task.Task)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "VirDomainSnapshot":
+		f.serveSnapshot(w, r)
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "VirDomainBlockDevice" && parts[2] == "clone":
+		f.serveClone(w, r, parts[1])
+	case r.Method == "PUT" && len(parts) == 2 && parts[0] == "VirtualDisk" && parts[1] == "upload":
+		f.serveUpload(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "no route for " + r.URL.Path})
+	}
+}
+
+func (f *fakeScale) serveExport(w http.ResponseWriter, r *http.Request, vmUUID string) {
+	vm := f.vmByUUID(vmUUID)
+	if vm == nil {
+		writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomain not found"})
+		return
+	}
+	var opts ExportOptions
+	err := json.NewDecoder(r.Body).Decode(&opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	f.lastExport = opts
+	folder, err := f.localFolder(opts.Target.PathURI)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+
+	// like the real thing, the folder shows up as soon as the export starts
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		f.t.Errorf("fake export: %s", err)
+	}
+	exported := *vm
+	diskImage := f.diskImage
+	task := f.startTask("export", "", func() {
+		xml := fmt.Sprintf("<domain><name>%s</name></domain>\n", exported.Name)
+		err := os.WriteFile(filepath.Join(folder, exported.Name+".xml"), []byte(xml), 0644)
+		if err != nil {
+			f.t.Errorf("fake export: %s", err)
+		}
+		for _, disk := range exported.BlockDevs {
+			contents := []byte("QFI\xfb fake disk " + disk.UUID)
+			if diskImage != nil {
+				contents = diskImage(disk)
+			}
+			image := filepath.Join(folder, disk.UUID+"."+opts.Target.Format)
+			err := os.WriteFile(image, contents, 0644)
+			if err != nil {
+				f.t.Errorf("fake export: %s", err)
+			}
+		}
+	})
+	writeJSON(w, http.StatusOK, task.Task)
+}
+
+func (f *fakeScale) serveImport(w http.ResponseWriter, r *http.Request) {
+	var opts ImportOptions
+	err := json.NewDecoder(r.Body).Decode(&opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	f.lastImport = opts
+	folder, err := f.localFolder(opts.Source.PathURI)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	f.importedFiles = make(map[string][]byte)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(folder, entry.Name()))
+		if err != nil {
+			f.t.Errorf("fake import: %s", err)
+		}
+		f.importedFiles[entry.Name()] = data
+	}
+
+	vmUUID := f.id("vm")
+	task := f.startTask("import", vmUUID, func() {
+		vm := &VM{
+			UUID:    vmUUID,
+			Name:    opts.Template.Name,
+			State:   "SHUTOFF",
+			NumVCPU: 2,
+			Mem:     4 << 30,
+		}
+		if f.importedState != "" {
+			vm.State = f.importedState
+		}
+		if opts.Template.NumVCPU != 0 {
+			vm.NumVCPU = opts.Template.NumVCPU
+		}
+		if opts.Template.Mem != 0 {
+			vm.Mem = opts.Template.Mem
+		}
+		if opts.Template.Tags != nil {
+			vm.Tags = *opts.Template.Tags
+		}
+		vm.NetDevs = []NetDev{f.newNetDev(vmUUID), f.newNetDev(vmUUID)}
+		f.vms = append(f.vms, vm)
+	})
+	writeJSON(w, http.StatusOK, task.Task)
+}
+
+func (f *fakeScale) serveAction(w http.ResponseWriter, r *http.Request) {
+	var actions []VMAction
+	err := json.NewDecoder(r.Body).Decode(&actions)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	states := map[string]string{
+		"START":    "RUNNING",
+		"SHUTDOWN": "SHUTOFF",
+		"STOP":     "SHUTOFF",
+		"REBOOT":   "RUNNING",
+		"RESET":    "RUNNING",
+	}
+	var vms []*VM
+	for _, action := range actions {
+		vm := f.vmByUUID(action.VirDomainUUID)
+		if vm == nil {
+			writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomain not found"})
+			return
+		}
+		if _, valid := states[action.ActionType]; !valid {
+			writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: "bad actionType " + action.ActionType})
+			return
+		}
+		vms = append(vms, vm)
+	}
+
+	task := f.startTask("vm-action", "", func() {
+		for i, vm := range vms {
+			vm.State = states[actions[i].ActionType]
+		}
+	})
+	writeJSON(w, http.StatusOK, task.Task)
+}
+
+func (f *fakeScale) serveNetDevUpdate(w http.ResponseWriter, r *http.Request, nicUUID string) {
+	var update NetDevUpdate
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	for _, vm := range f.vms {
+		for i := range vm.NetDevs {
+			nic := &vm.NetDevs[i]
+			if nic.UUID != nicUUID {
+				continue
+			}
+			task := f.startTask("update-nic", "", func() {
+				if update.VLAN != nil {
+					nic.VLAN = *update.VLAN
+				}
+				if update.Connected != nil {
+					nic.Connected = *update.Connected
+				}
+			})
+			writeJSON(w, http.StatusOK, task.Task)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomainNetDevice not found"})
+}
+
+func (f *fakeScale) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	var snap Snapshot
+	err := json.NewDecoder(r.Body).Decode(&snap)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	if f.vmByUUID(snap.DomainUUID) == nil {
+		writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomain not found"})
+		return
+	}
+
+	snapUUID := f.id("snap")
+	task := f.startTask("snapshot", snapUUID, func() {
+		snap.UUID = snapUUID
+		snap.Timestamp = time.Now().Unix()
+		f.snapshots[snapUUID] = snap
+	})
+	writeJSON(w, http.StatusOK, task.Task)
+}
+
+func (f *fakeScale) serveClone(w http.ResponseWriter, r *http.Request, diskUUID string) {
+	var opts DiskFromSnapshotOpts
+	err := json.NewDecoder(r.Body).Decode(&opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	if _, exists := f.snapshots[opts.SnapUUID]; !exists {
+		writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "snapshot not found"})
+		return
+	}
+	target := f.vmByUUID(opts.Template.VirDomainUUID)
+	if target == nil {
+		writeJSON(w, http.StatusNotFound, ScaleErrorPayload{Error: "VirDomain not found"})
+		return
+	}
+
+	newDisk := BlockDev{
+		UUID:          f.id("disk"),
+		VirDomainUUID: target.UUID,
+		Type:          opts.Template.Type,
+		Capacity:      opts.Template.Capacity,
+	}
+	task := f.startTask("clone", newDisk.UUID, func() {
+		target.BlockDevs = append(target.BlockDevs, newDisk)
+	})
+	writeJSON(w, http.StatusOK, task.Task)
+}
+
+func (f *fakeScale) serveUpload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: err.Error()})
+		return
+	}
+	if size := r.URL.Query().Get("filesize"); size != fmt.Sprint(len(data)) {
+		writeJSON(w, http.StatusBadRequest, ScaleErrorPayload{Error: "wrong filesize " + size})
+		return
+	}
+
+	diskUUID := f.id("media")
+	f.uploads[r.URL.Query().Get("filename")] = data
+	writeJSON(w, http.StatusOK, Task{TaskTag: f.id("task"), CreatedUUID: diskUUID})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
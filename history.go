@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hyperjumptech/jiffy"
+)
+
+// how long each VM's recent exports took is kept in this file under
+// LocalPath
+const historyFileName = ".scale-backup-history.json"
+
+// how many exports to remember per VM
+const historyLength = 5
+
+// predictions are based on the longest of this many recent exports
+const predictionSamples = 3
+
+type BackupRecord struct {
+	BackupName string
+	Finished   time.Time
+	Duration   time.Duration
+	// set if this was a scheduled backup that failed
+	Error string `json:",omitempty"`
+}
+
+var historyMutex sync.Mutex
+
+func historyFile() string {
+	return filepath.Join(Config.SMB.LocalPath, historyFileName)
+}
+
+// return recent exports for each VM, oldest first. Records are keyed by VM
+// UUID, or by name if they were made before we tracked VMs by UUID (see
+// vmHistory).
+func loadHistory() (map[string][]BackupRecord, error) {
+	history := make(map[string][]BackupRecord)
+	historyJSON, err := os.ReadFile(historyFile())
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(historyJSON, &history)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", historyFile(), err)
+	}
+	return history, nil
+}
+
+// remember how long a successful export took, or that a scheduled one
+// failed
+func recordBackup(vmUUID, vmName string, record BackupRecord) error {
+	debugReturn := DebugCall(vmUUID, vmName, record)
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	lock, err := lockStateFile(historyFile())
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	history, err := loadHistory()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	// carry over anything recorded under the VM's name
+	records := append(vmHistory(history, vmUUID, vmName), record)
+	if len(records) > historyLength {
+		records = records[len(records)-historyLength:]
+	}
+	if vmUUID != "" {
+		delete(history, vmName)
+		history[vmUUID] = records
+	} else {
+		history[vmName] = records
+	}
+
+	historyJSON, err := json.MarshalIndent(history, "", "\t")
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	err = writeFileAtomic(historyFile(), historyJSON)
+
+	debugReturn(err)
+	return err
+}
+
+// remember that a scheduled backup failed, so the VM can jump ahead in the
+// queue next time
+func recordFailure(vmUUID, vmName, backupName string, backupErr error) {
+	err := recordBackup(vmUUID, vmName, BackupRecord{
+		BackupName: backupName,
+		Finished:   clock.Now(),
+		Error:      backupErr.Error(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record failed backup: %s\n", err)
+	}
+}
+
+// return a VM's records, oldest first. Until it has some under its UUID, we
+// use the ones recorded under its name.
+func vmHistory(history map[string][]BackupRecord, vmUUID, vmName string) []BackupRecord {
+	if records, exists := history[vmUUID]; exists && vmUUID != "" {
+		return records
+	}
+	return history[vmName]
+}
+
+// guess how long the next export of a VM will take. Exports vary with how
+// much has changed, so we go with the longest of the last few. ok is false
+// if the VM has never been exported successfully.
+func predictDuration(history map[string][]BackupRecord, vmUUID, vmName string) (d time.Duration, ok bool) {
+	var records []BackupRecord
+	for _, record := range vmHistory(history, vmUUID, vmName) {
+		if record.Error == "" {
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return 0, false
+	}
+	if len(records) > predictionSamples {
+		records = records[len(records)-predictionSamples:]
+	}
+	for _, record := range records {
+		if record.Duration > d {
+			d = record.Duration
+		}
+	}
+	return d, true
+}
+
+// return true if a VM's export is expected to take longer than the time
+// left. VMs we have no history for get the benefit of the doubt.
+func wontFit(history map[string][]BackupRecord, vmUUID, vmName string, remaining time.Duration) (predicted time.Duration, tooLong bool) {
+	predicted, known := predictDuration(history, vmUUID, vmName)
+	return predicted, known && predicted > remaining
+}
+
+// return true if the most recent backup attempt we know of for a VM was a
+// scheduled one that failed
+func lastAttemptFailed(history map[string][]BackupRecord, vmUUID, vmName string) bool {
+	records := vmHistory(history, vmUUID, vmName)
+	return len(records) != 0 && records[len(records)-1].Error != ""
+}
+
+// format a duration to the nearest minute, for messages
+func describeDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "<1m"
+	}
+	return jiffy.DescribeDuration(d, &jiffy.Want{
+		Day:       true,
+		Hour:      true,
+		Minute:    true,
+		Separator: " ",
+	})
+}
+
+// format how old something is, for show-queue and messages
+func describeAge(d time.Duration) string {
+	return jiffy.DescribeDuration(d, &jiffy.Want{
+		Year:      true,
+		Month:     true,
+		Day:       true,
+		Hour:      true,
+		Minute:    true,
+		Second:    false,
+		Verbose:   false,
+		Separator: " ",
+	})
+}
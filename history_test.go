@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPredictDuration(t *testing.T) {
+	history := map[string][]BackupRecord{
+		"one":      {{Duration: time.Hour}},
+		"many":     {{Duration: 9 * time.Hour}, {Duration: time.Hour}, {Duration: 3 * time.Hour}, {Duration: 2 * time.Hour}},
+		"uuid-one": {{Duration: 2 * time.Hour}},
+	}
+	tests := []struct {
+		vmUUID    string
+		vmName    string
+		want      time.Duration
+		wantKnown bool
+	}{
+		{"", "never", 0, false},
+		{"", "one", time.Hour, true},
+		// the 9 hour export is too old to count
+		{"", "many", 3 * time.Hour, true},
+		// records under the UUID win over ones under the name
+		{"uuid-one", "one", 2 * time.Hour, true},
+		{"uuid-new", "one", time.Hour, true},
+	}
+	for _, test := range tests {
+		got, known := predictDuration(history, test.vmUUID, test.vmName)
+		if got != test.want || known != test.wantKnown {
+			t.Errorf("predictDuration(%q, %q) = %s, %v, want %s, %v", test.vmUUID, test.vmName, got, known, test.want, test.wantKnown)
+		}
+	}
+}
+
+func TestBackupRecordsDuration(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+
+	// recorded before history was keyed by UUID
+	for i := 0; i < historyLength+2; i++ {
+		err := recordBackup("", "web01", BackupRecord{Duration: time.Duration(i) * time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	Backup(context.Background(), "web01", "manual web01", false)
+
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := history["web01"]; exists {
+		t.Error("records under the VM's name should have moved to its UUID")
+	}
+	records := history[vm.UUID]
+	if len(records) != historyLength {
+		t.Fatalf("expected %d records, got %d", historyLength, len(records))
+	}
+	last := records[len(records)-1]
+	if last.BackupName != "manual web01" || last.Duration <= 0 || last.Duration > time.Minute {
+		t.Errorf("unexpected record for the backup: %+v", last)
+	}
+}
+
+func TestScheduleSkipsLongBackups(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.Concurrency = 2
+	fake.AddVM("big")
+	fake.AddVM("small")
+	fake.AddVM("new")
+	makeBackups(t, map[string][]time.Duration{
+		// big is the most overdue, so it would normally go first
+		"big":   {10 * 24 * time.Hour},
+		"small": {2 * 24 * time.Hour},
+	})
+	recordBackup("", "big", BackupRecord{Duration: 6 * time.Hour})
+	recordBackup("", "small", BackupRecord{Duration: time.Hour})
+
+	Schedule(context.Background())
+
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["big"]) != 1 {
+		t.Error("big should have been skipped since it won't finish in the window")
+	}
+	if len(backups["small"]) != 2 {
+		t.Error("small fits in the window and should have been backed up")
+	}
+	if len(backups["new"]) != 1 {
+		t.Error("VMs without history should be backed up")
+	}
+}
+
+func TestScheduleRecordsFailures(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.Concurrency = 1
+	vm := fake.AddVM("web01")
+	fake.FailNext("export")
+
+	Schedule(context.Background())
+
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastAttemptFailed(history, vm.UUID, "web01") {
+		t.Errorf("expected a failed attempt to be recorded, got %+v", history[vm.UUID])
+	}
+	if _, known := predictDuration(history, vm.UUID, "web01"); known {
+		t.Error("failed backups should not be used to predict durations")
+	}
+}
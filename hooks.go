@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 )
 
 func ParseHookStr(hookStr string, variables map[string]string) (string, []string) {
@@ -67,12 +68,15 @@ func PreBackupHook(vmName, backupName string) error {
 // if Config.Hooks.DelayPostBackupWhenScheduled is true, then we delay the
 // post-backup hook until after all scheduled backups are done
 var delayedHooks [][2]string
+var delayedHooksMutex sync.Mutex
 
 func PostBackupHook(vmName, backupName string, scheduled bool) error {
 	debugReturn := DebugCall(vmName, backupName, scheduled)
 
 	if Config.Hooks.DelayPostBackupWhenScheduled && scheduled {
+		delayedHooksMutex.Lock()
 		delayedHooks = append(delayedHooks, [2]string{vmName, backupName})
+		delayedHooksMutex.Unlock()
 		return nil
 	}
 	err := postBackupHook(vmName, backupName)
@@ -216,18 +220,32 @@ func PreScheduleHook() error {
 	return nil
 }
 
-func PostScheduleHook() error {
+// run post-backup hooks that were delayed by DelayPostBackupWhenScheduled
+func RunDelayedHooks() error {
 	debugReturn := DebugCall()
 
-	// run delayed hooks
+	delayedHooksMutex.Lock()
+	hooks := delayedHooks
+	delayedHooks = nil
+	delayedHooksMutex.Unlock()
+
 	var firstErr error
-	for _, hook := range delayedHooks {
+	for _, hook := range hooks {
 		err := postBackupHook(hook[0], hook[1])
 		if err != nil && firstErr == nil {
 			firstErr = err
 		}
 	}
-	delayedHooks = nil
+
+	debugReturn(firstErr)
+	return firstErr
+}
+
+func PostScheduleHook() error {
+	debugReturn := DebugCall()
+
+	// run delayed hooks
+	firstErr := RunDelayedHooks()
 
 	if Config.Hooks.PostSchedule == "" {
 		debugReturn(firstErr)
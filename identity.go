@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// all of one VM's backups, whatever it was called when they were made
+type VMBackups struct {
+	// empty for backups that can't be tied to a VM (see groupBackups), which
+	// are grouped by name instead
+	UUID string
+	// the VM's name on the cluster, or the newest name it was backed up
+	// under if it isn't there anymore
+	Name string
+	// every name its backups were made under, newest first
+	Names []string
+	// nil if the VM isn't on the cluster
+	VM *VM
+	// newest first
+	Folders []BackupFolder
+}
+
+// return the times of the backups that count (see BackupFolder.Usable),
+// newest first
+func (b *VMBackups) Usable() []time.Time {
+	var times []time.Time
+	for _, folder := range b.Folders {
+		if folder.Usable() {
+			times = append(times, folder.Time)
+		}
+	}
+	return times
+}
+
+// return the names the VM was backed up under other than its current one
+func (b *VMBackups) OldNames() []string {
+	var names []string
+	for _, name := range b.Names {
+		if name != b.Name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// group backup folders (newest first) by the VM they are of. Backups with
+// a manifest name their VM's UUID. Older ones (and failed ones, which have
+// no manifest) are tied to the VM whose oldest manifest has the same name,
+// since that is who had the name before manifests were written, or else to
+// the one VM on the cluster with that name. Anything left is grouped by
+// name. The result is sorted by name.
+func groupBackups(folders []BackupFolder, vms []VM) []*VMBackups {
+	byName := make(map[string]string)
+	for i := len(folders) - 1; i >= 0; i-- {
+		folder := folders[i]
+		if _, exists := byName[folder.VMName]; !exists && folder.VMUUID != "" {
+			byName[folder.VMName] = folder.VMUUID
+		}
+	}
+	onCluster := make(map[string]*VM)
+	for name, count := range vmNameCounts(vms) {
+		if _, exists := byName[name]; !exists && count == 1 {
+			byName[name] = findVM(vms, name).UUID
+		}
+	}
+	for i, vm := range vms {
+		if !vm.IsTransient {
+			onCluster[vm.UUID] = &vms[i]
+		}
+	}
+
+	type key struct{ uuid, name string }
+	groups := make(map[key]*VMBackups)
+	var list []*VMBackups
+	for _, folder := range folders {
+		uuid := folder.VMUUID
+		if uuid == "" {
+			uuid = byName[folder.VMName]
+		}
+		k := key{uuid: uuid}
+		if uuid == "" {
+			k.name = folder.VMName
+		}
+		group, exists := groups[k]
+		if !exists {
+			group = &VMBackups{
+				UUID: uuid,
+				Name: folder.VMName,
+				VM:   onCluster[uuid],
+			}
+			if group.VM != nil {
+				group.Name = group.VM.Name
+			}
+			groups[k] = group
+			list = append(list, group)
+		}
+		if !containsString(group.Names, folder.VMName) {
+			group.Names = append(group.Names, folder.VMName)
+		}
+		group.Folders = append(group.Folders, folder)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].UUID < list[j].UUID
+	})
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// count how many non-transient VMs have each name
+func vmNameCounts(vms []VM) map[string]int {
+	counts := make(map[string]int)
+	for _, vm := range vms {
+		if !vm.IsTransient {
+			counts[vm.Name]++
+		}
+	}
+	return counts
+}
+
+// return the UUIDs of the non-transient VMs with a name
+func vmUUIDsNamed(vms []VM, name string) []string {
+	var uuids []string
+	for _, vm := range vms {
+		if vm.Name == name && !vm.IsTransient {
+			uuids = append(uuids, vm.UUID)
+		}
+	}
+	return uuids
+}
+
+// describe each name shared by more than one non-transient VM, ex:
+// "web01 (UUIDs 1234, 5678)", sorted by name
+func duplicateVMNames(vms []VM) []string {
+	var duplicates []string
+	for name, count := range vmNameCounts(vms) {
+		if count > 1 {
+			duplicates = append(duplicates, fmt.Sprintf(
+				"%s (UUIDs %s)",
+				name,
+				strings.Join(vmUUIDsNamed(vms, name), ", "),
+			))
+		}
+	}
+	sort.Strings(duplicates)
+	return duplicates
+}
+
+// find a (non-transient) VM by UUID, or by name if no other VM has that name
+func lookupVM(vms []VM, nameOrUUID string) (*VM, error) {
+	for i, vm := range vms {
+		if vm.UUID == nameOrUUID && !vm.IsTransient {
+			return &vms[i], nil
+		}
+	}
+	uuids := vmUUIDsNamed(vms, nameOrUUID)
+	if len(uuids) == 0 {
+		return nil, errors.New("VM not found")
+	}
+	if len(uuids) > 1 {
+		return nil, fmt.Errorf(
+			"%d VMs are named %s, use one of their UUIDs instead: %s",
+			len(uuids),
+			nameOrUUID,
+			strings.Join(uuids, ", "),
+		)
+	}
+	return findVM(vms, nameOrUUID), nil
+}
+
+// warn (and email) about VMs that share a name. Their backups are tracked by
+// UUID, but the folders only have the name, so people restoring by hand
+// can't tell them apart.
+func reportDuplicateVMNames(vms []VM) {
+	duplicates := duplicateVMNames(vms)
+	if len(duplicates) == 0 {
+		return
+	}
+	var msg bytes.Buffer
+	msg.WriteString("More than one VM has the same name. They are still backed up, but\n")
+	msg.WriteString("their backup folders can only be told apart by the manifest in each,\n")
+	msg.WriteString("so consider renaming them:\n\n")
+	for _, duplicate := range duplicates {
+		fmt.Fprintf(&msg, "%s\n", duplicate)
+	}
+	fmt.Fprint(os.Stderr, msg.String())
+	Email("Duplicate VM names", msg.String())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// make an empty backup folder with a manifest, as if vm had been exported
+// when it was called vmName
+func makeManifestBackup(t *testing.T, vm *VM, vmName string, age time.Duration) {
+	name := DateTimePrefix(clock.Now().Add(-age), vmName)
+	err := os.Mkdir(filepath.Join(Config.SMB.LocalPath, name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(Manifest{VMName: vmName, VMUUID: vm.UUID, BackupName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenamedVM(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.BackupInterval = "3 days"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	vm := fake.AddVM("web01")
+	// from before manifests
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {10 * day, 20 * day},
+	})
+	makeManifestBackup(t, vm, "web01", 5*day)
+	fake.Rename(vm, "web02")
+	makeManifestBackup(t, vm, "web02", 1*day)
+	// someone else has the old name now
+	fake.AddVM("web01")
+
+	folders, err := BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, err := Scale.VMList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := groupBackups(folders, vms)
+	if len(groups) != 1 {
+		t.Fatalf("expected all backups to belong to one VM, got %d groups", len(groups))
+	}
+	group := groups[0]
+	if group.UUID != vm.UUID || group.Name != "web02" || len(group.Folders) != 4 {
+		t.Errorf("unexpected group: %+v", group)
+	}
+	if !reflect.DeepEqual(group.OldNames(), []string{"web01"}) {
+		t.Errorf("expected old name web01, got %v", group.OldNames())
+	}
+
+	// web02 was backed up a day ago, the new web01 never has been
+	queue, err := BackupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(queue, []string{"web01"}) {
+		t.Errorf("BackupQueue() = %v, want [web01]", queue)
+	}
+
+	// MaxBackups applies to the renamed VM's backups as a whole
+	err = Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages := backupAges(t)
+	if !reflect.DeepEqual(ages["web02"], []time.Duration{day}) || !reflect.DeepEqual(ages["web01"], []time.Duration{5 * day}) {
+		t.Errorf("expected the 2 newest backups to be kept, got %v", ages)
+	}
+}
+
+func TestDuplicateVMNames(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.Concurrency = 2
+	first := fake.AddVM("dup")
+	second := fake.AddVM("dup")
+
+	err := Backup(context.Background(), "dup", "manual dup", false)
+	if err == nil || !strings.Contains(err.Error(), "2 VMs are named dup") {
+		t.Errorf("expected backup by a shared name to be refused, got %v", err)
+	}
+	err = Backup(context.Background(), second.UUID, "manual dup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest("manual dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.VMUUID != second.UUID {
+		t.Errorf("backed up the wrong VM: %+v", manifest)
+	}
+
+	err = Schedule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders, err := BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, err := Scale.VMList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := groupBackups(folders, vms)
+	if len(groups) != 2 || len(groups[0].Usable()) != 1 || len(groups[1].Usable()) != 1 {
+		t.Fatalf("expected one backup of each VM, got %+v", groups)
+	}
+	uuids := map[string]bool{groups[0].UUID: true, groups[1].UUID: true}
+	if !uuids[first.UUID] || !uuids[second.UUID] {
+		t.Errorf("expected backups of %s and %s, got %v", first.UUID, second.UUID, uuids)
+	}
+}
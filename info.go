@@ -3,7 +3,6 @@ package main
 import (
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // return backup size including only the disk images so other scripts to put
@@ -17,12 +16,9 @@ func BackupSize(backupName string) (uint64, error) {
 			if err != nil {
 				return err
 			}
-			// identify disk images by extension
-			isDiskImage := strings.EqualFold(
-				filepath.Ext(path),
-				".qcow2",
-			)
-			if isDiskImage && !info.IsDir() {
+			// identify disk images (encrypted or not) by extension.
+			// Converted copies don't count, they are the same disk again.
+			if isDiskImage(path) && !isConvertedImage(path) && !info.IsDir() {
 				size += uint64(info.Size())
 			}
 			return err
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var interruption struct {
+	sync.Mutex
+	// true if any tasks were left running on the cluster
+	leftRunning bool
+	log         []string
+}
+
+// add a line to the interruption summary
+func recordInterruption(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintln(os.Stderr, msg)
+
+	interruption.Lock()
+	defer interruption.Unlock()
+	interruption.log = append(interruption.log, msg)
+}
+
+// deal with a task we stopped watching because we were interrupted.
+// HyperCore has no API to cancel a running export or import, so the task is
+// always left running.
+func handleInterruptedTask(description, taskTag string) {
+	DebugCall(description, taskTag)
+
+	recordInterruption(
+		"%s (task %s) was left running on the cluster, which can't cancel it",
+		description,
+		taskTag,
+	)
+
+	interruption.Lock()
+	defer interruption.Unlock()
+	interruption.leftRunning = true
+}
+
+// if we were interrupted, print and email a summary of what happened
+func reportInterruption(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	interruption.Lock()
+	defer interruption.Unlock()
+
+	var msg bytes.Buffer
+	msg.WriteString("scale-backup was interrupted.\n")
+	if len(interruption.log) == 0 {
+		msg.WriteString("No tasks were running at the time.\n")
+	} else {
+		msg.WriteString("\n")
+		for _, line := range interruption.log {
+			fmt.Fprintf(&msg, "%s\n", line)
+		}
+	}
+	if interruption.leftRunning {
+		msg.WriteString("\nRun `scale-backup resume` to pick up backups that were left running.\n")
+	}
+	Email("scale-backup interrupted", msg.String())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// start a backup, then interrupt it once the export is running
+func interruptedBackup(t *testing.T, fake *fakeScale) string {
+	fake.AddVM("web01")
+	fake.Hold("export")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Backup(ctx, "web01", "manual web01", false)
+		close(done)
+	}()
+	for len(fake.RunningTasks()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	taskTag := fake.RunningTasks()[0]
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Backup did not stop after being interrupted")
+	}
+	return taskTag
+}
+
+func TestInterruptLeavesTasksRunning(t *testing.T) {
+	fake := setupFakeScale(t)
+
+	taskTag := interruptedBackup(t, fake)
+
+	if fake.TaskState(taskTag) != "RUNNING" {
+		t.Errorf("export should have been left running, state is %s", fake.TaskState(taskTag))
+	}
+	jobs, err := loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := jobs["manual web01"]; !exists {
+		t.Error("job should be left for resume")
+	}
+	if backupFailed("manual web01") {
+		t.Error("backup that is still running should not be marked as failed")
+	}
+	if len(interruption.log) != 1 || !interruption.leftRunning {
+		t.Errorf("expected the running task to be recorded, got %v", interruption.log)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// exports that are running (or were running when we crashed) are recorded
+// in this file under LocalPath so we can pick them back up later
+const jobsFileName = ".scale-backup-jobs.json"
+
+// backups that did not finish get this file written into their folder
+const failedMarkerName = ".scale-backup-failed"
+
+type Job struct {
+	VMName     string
+	VMUUID     string
+	BackupName string
+	TaskTag    string
+	Scheduled  bool
+	Started    time.Time
+	// the process watching the task
+	PID int
+	// what to convert the disk images to once the export finishes (see
+	// TransferOptions Convert)
+	Convert string `json:",omitempty"`
+}
+
+// goroutines wait here, other processes wait on the jobs file's lock (see
+// lockStateFile)
+var jobsMutex sync.Mutex
+
+func jobsFile() string {
+	return filepath.Join(Config.SMB.LocalPath, jobsFileName)
+}
+
+// return all recorded jobs, keyed by backup name
+func loadJobs() (map[string]Job, error) {
+	jobs := make(map[string]Job)
+	jobsJSON, err := os.ReadFile(jobsFile())
+	if os.IsNotExist(err) {
+		return jobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jobsJSON, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", jobsFile(), err)
+	}
+	return jobs, nil
+}
+
+// write the jobs file, replacing it atomically so a crash can't leave it
+// half written
+func writeJobs(jobs map[string]Job) error {
+	jobsJSON, err := json.MarshalIndent(jobs, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(jobsFile(), jobsJSON)
+}
+
+// write to a temporary file and rename it into place, so readers never see
+// a half written file. Each writer gets its own temporary file, so two
+// writers can't mix theirs up.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// CreateTemp makes the file readable only by us
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// add or replace a job in the jobs file
+func saveJob(job Job) error {
+	debugReturn := DebugCall(job)
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	lock, err := lockStateFile(jobsFile())
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	jobs, err := loadJobs()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	jobs[job.BackupName] = job
+	err = writeJobs(jobs)
+
+	debugReturn(err)
+	return err
+}
+
+func removeJob(backupName string) error {
+	debugReturn := DebugCall(backupName)
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	lock, err := lockStateFile(jobsFile())
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	jobs, err := loadJobs()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	if _, exists := jobs[backupName]; !exists {
+		debugReturn(nil)
+		return nil
+	}
+	delete(jobs, backupName)
+	err = writeJobs(jobs)
+
+	debugReturn(err)
+	return err
+}
+
+// return true if a process with this PID is running
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// on windows FindProcess fails if the process doesn't exist
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// list jobs whose process is no longer around to watch them, oldest first
+func OrphanedJobs() ([]Job, error) {
+	debugReturn := DebugCall()
+
+	jobsMutex.Lock()
+	jobs, err := loadJobs()
+	jobsMutex.Unlock()
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+
+	var orphans []Job
+	for _, job := range jobs {
+		if job.PID == os.Getpid() || processAlive(job.PID) {
+			continue
+		}
+		orphans = append(orphans, job)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Started.Before(orphans[j].Started)
+	})
+
+	debugReturn(orphans, nil)
+	return orphans, nil
+}
+
+// record why a backup didn't finish, so it isn't mistaken for a good one
+func markBackupFailed(backupName, reason string) error {
+	debugReturn := DebugCall(backupName, reason)
+
+	backupFolder := filepath.Join(Config.SMB.LocalPath, backupName)
+	_, err := os.Stat(backupFolder)
+	if os.IsNotExist(err) {
+		// nothing was written, so there is nothing to mark
+		debugReturn(nil)
+		return nil
+	}
+	err = os.WriteFile(
+		filepath.Join(backupFolder, failedMarkerName),
+		[]byte(reason+"\n"),
+		0644,
+	)
+
+	debugReturn(err)
+	return err
+}
+
+// return true if a backup folder was marked as failed
+func backupFailed(backupName string) bool {
+	marker := filepath.Join(Config.SMB.LocalPath, backupName, failedMarkerName)
+	_, err := os.Stat(marker)
+	return err == nil
+}
+
+// take over an orphaned job: wait for its task, then run the post-backup
+// hook if it finished, or mark it failed if it didn't
+func ResumeJob(ctx context.Context, job Job) error {
+	debugReturn := DebugCall(job)
+
+	lock, err := LockVM(job.VMName, job.VMUUID, "resume "+job.BackupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	job.PID = os.Getpid()
+	err = saveJob(job)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	fmt.Printf("Reattaching to backup of %s (task %s)\n", job.VMName, job.TaskTag)
+	_, err = Scale.WaitForTask(ctx, job.TaskTag, WaitOptions{
+		Progress: printTaskProgress(job.VMName),
+	})
+	if errors.Is(err, context.Canceled) {
+		// leave the job for next time
+		handleInterruptedTask(fmt.Sprintf("Resumed backup of %s", job.VMName), job.TaskTag)
+		debugReturn(err)
+		return err
+	}
+	if err != nil {
+		markErr := markBackupFailed(job.BackupName, err.Error())
+		if markErr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark %s as failed: %s\n", job.BackupName, markErr)
+		}
+		removeJob(job.BackupName)
+		if job.Scheduled {
+			recordFailure(job.VMUUID, job.VMName, job.BackupName, err)
+		}
+		wrapped := fmt.Errorf("backup of %s failed: %w", job.VMName, err)
+		debugReturn(wrapped)
+		return wrapped
+	}
+
+	fmt.Printf("Backup of %s completed\n", job.VMName)
+
+	err = convertAfterBackup(ctx, job.VMName, job.BackupName, job.Convert)
+	if err != nil {
+		// leave the job for next time
+		debugReturn(err)
+		return err
+	}
+
+	var encryptedFor string
+	if EncryptionConfigured() {
+		err = encryptBackup(job.BackupName)
+		if err != nil {
+			markErr := markBackupFailed(job.BackupName, "encryption failed: "+err.Error())
+			if markErr != nil {
+				fmt.Fprintf(os.Stderr, "Failed to mark %s as failed: %s\n", job.BackupName, markErr)
+			}
+			removeJob(job.BackupName)
+			if job.Scheduled {
+				recordFailure(job.VMUUID, job.VMName, job.BackupName, err)
+			}
+			wrapped := fmt.Errorf("backup of %s could not be encrypted: %w", job.VMName, err)
+			debugReturn(wrapped)
+			return wrapped
+		}
+		encryptedFor = Config.Encryption.PublicKey
+	}
+
+	err = recordBackup(job.VMUUID, job.VMName, BackupRecord{
+		BackupName: job.BackupName,
+		Finished:   clock.Now(),
+		Duration:   since(job.Started),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record backup duration: %s\n", err)
+	}
+
+	// the VM's disks may have changed since the export started, but this
+	// is the best we can do
+	manifest := Manifest{
+		VMName:       job.VMName,
+		VMUUID:       job.VMUUID,
+		BackupName:   job.BackupName,
+		TaskTag:      job.TaskTag,
+		Started:      job.Started,
+		Finished:     clock.Now(),
+		EncryptedFor: encryptedFor,
+	}
+	if vm, err := Scale.GetVM(ctx, job.VMUUID); err == nil {
+		manifest.Disks = vm.BlockDevs
+	}
+	err = writeManifest(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write manifest for %s: %s\n", job.BackupName, err)
+	}
+
+	err = PostBackupHook(job.VMName, job.BackupName, job.Scheduled)
+	removeJob(job.BackupName)
+
+	debugReturn(err)
+	return err
+}
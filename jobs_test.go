@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// return the PID of a process that has already exited
+func deadPID(t *testing.T) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// start an export on the fake cluster the way a process that then died
+// would have, and return its job
+func startOrphan(t *testing.T, vm *VM, pid int) Job {
+	backupName := DateTimePrefix(time.Now().Add(-time.Hour), vm.Name)
+	taskTag, err := Scale.Export(
+		context.Background(),
+		vm.UUID,
+		backupName,
+		TransferSettingsFor(vm.Name, vm.Tags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := Job{
+		VMName:     vm.Name,
+		VMUUID:     vm.UUID,
+		BackupName: backupName,
+		TaskTag:    taskTag,
+		Scheduled:  true,
+		Started:    time.Now().Add(-time.Hour),
+		PID:        pid,
+	}
+	err = saveJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestRunningJobsAreNotBackups(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	Config.Schedule.Tag = ""
+	Config.Schedule.BackupInterval = "1 hour"
+
+	// a job owned by a live process (us) is in progress
+	startOrphan(t, vm, os.Getpid())
+
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["web01"]) != 0 {
+		t.Error("an export that is still running should not count as a backup")
+	}
+	queue, err := BackupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("a VM with a running export should not be queued, got %v", queue)
+	}
+	orphans, err := OrphanedJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("jobs owned by a live process are not orphans, got %v", orphans)
+	}
+}
+
+func TestResume(t *testing.T) {
+	fake := setupFakeScale(t)
+	good := fake.AddVM("web01")
+	bad := fake.AddVM("web02")
+	pid := deadPID(t)
+	startOrphan(t, good, pid)
+	fake.FailNext("export")
+	failed := startOrphan(t, bad, pid)
+
+	Resume(context.Background())
+
+	jobs, err := loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("resumed jobs should be removed, got %v", jobs)
+	}
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["web01"]) != 1 {
+		t.Error("resumed backup should count once it completes")
+	}
+	if len(backups["web02"]) != 0 {
+		t.Error("failed backup should not count")
+	}
+	if !backupFailed(failed.BackupName) {
+		t.Error("failed backup should be marked")
+	}
+}
+
+func TestSaveJobWaitsForOtherProcesses(t *testing.T) {
+	setupFakeScale(t)
+	err := saveJob(Job{VMName: "dc01", BackupName: "first", PID: os.Getpid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another process (a live one, so it isn't taken over) is in the middle
+	// of updating the jobs file
+	other, err := acquireLock(jobsFile()+".lock", "jobs", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- saveJob(Job{VMName: "web01", BackupName: "second", PID: os.Getpid()})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("saveJob didn't wait for the lock: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	other.Release()
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("expected both jobs, got %+v", jobs)
+	}
+	// no temporary files or locks are left behind
+	entries, err := os.ReadDir(Config.SMB.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != jobsFileName {
+			t.Errorf("unexpected file %s", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// held by a schedule run (under LocalPath)
+const scheduleLockName = ".scale-backup-schedule.lock"
+
+// per-VM locks live in this folder under LocalPath
+const vmLocksFolderName = ".scale-backup-locks"
+
+// how long to wait for someone else to finish updating a state file
+const stateLockTimeout = time.Minute
+
+// ErrLocked is returned (wrapped in a *LockError) when someone else holds a
+// lock
+var ErrLocked = errors.New("locked")
+
+// what is written into a lock file, so others can tell who holds it
+type LockInfo struct {
+	PID     int
+	Host    string
+	Command string
+	Started time.Time
+	// random, so two locks taken by one process at the same time differ
+	Nonce string `json:",omitempty"`
+}
+
+// return true if a and b describe the same lock
+func (a LockInfo) same(b LockInfo) bool {
+	return a.PID == b.PID &&
+		a.Host == b.Host &&
+		a.Command == b.Command &&
+		a.Started.Equal(b.Started) &&
+		a.Nonce == b.Nonce
+}
+
+type LockError struct {
+	// what was locked, ex: "schedule" or "VM dc01"
+	What   string
+	Holder LockInfo
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf(
+		"%s is locked by %s (PID %d on %s, since %s)",
+		e.What,
+		e.Holder.Command,
+		e.Holder.PID,
+		e.Holder.Host,
+		e.Holder.Started.Format("2006-01-02 03:04 PM"),
+	)
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// an advisory lock held by this process
+type Lock struct {
+	file string
+	info LockInfo
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// take the lock in file for command. If the lock is held by a process on
+// this machine that is no longer running, it is reported and taken over.
+// Locks held from other machines (LocalPath may be shared) can't be
+// checked, so they have to be removed by hand.
+func acquireLock(file, what, command string) (*Lock, error) {
+	debugReturn := DebugCall(file, what, command)
+
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+	info := LockInfo{
+		PID:     os.Getpid(),
+		Host:    hostname(),
+		Command: command,
+		Started: clock.Now(),
+		Nonce:   hex.EncodeToString(nonce),
+	}
+	infoJSON, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+
+	// a few tries, in case the lock is released or taken over while we
+	// are looking at it
+	for attempt := 0; attempt < 3; attempt++ {
+		err := createLock(file, infoJSON)
+		if err == nil {
+			debugReturn(file, nil)
+			return &Lock{file, info}, nil
+		}
+		if !os.IsExist(err) {
+			debugReturn(nil, err)
+			return nil, err
+		}
+
+		holder, err := readLock(file)
+		if os.IsNotExist(err) {
+			// released while we were looking
+			continue
+		}
+		if err != nil {
+			debugReturn(nil, err)
+			return nil, err
+		}
+		if holder.Host != info.Host || processAlive(holder.PID) {
+			err := &LockError{what, *holder}
+			debugReturn(nil, err)
+			return nil, err
+		}
+
+		removed, err := removeStaleLock(file, *holder, info.Nonce)
+		if err != nil {
+			debugReturn(nil, err)
+			return nil, err
+		}
+		if removed {
+			msg := fmt.Sprintf(
+				"Removed stale lock on %s left by %s (PID %d, since %s), which is no longer running",
+				what,
+				holder.Command,
+				holder.PID,
+				holder.Started.Format("2006-01-02 03:04 PM"),
+			)
+			fmt.Fprintln(os.Stderr, msg)
+			Email("Stale lock removed", msg)
+		}
+	}
+
+	err = fmt.Errorf("could not lock %s, the lock kept changing hands", what)
+	debugReturn(nil, err)
+	return nil, err
+}
+
+// create file holding data, failing with an os.ErrExist error if it already
+// exists. The data is written to a temporary file first and linked into
+// place, so nobody ever sees a half written lock.
+func createLock(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), file)
+}
+
+// remove file if it still holds the stale lock. Others may be taking it
+// over at the same time, so it is moved somewhere only we know about
+// first, and only deleted if it turns out to be the stale lock. If someone
+// else got there first and it is now their lock, it is put back. Returns
+// true if we removed the stale lock.
+func removeStaleLock(file string, stale LockInfo, nonce string) (bool, error) {
+	moved := fmt.Sprintf("%s.%s.stale", file, nonce)
+	err := os.Rename(file, moved)
+	if os.IsNotExist(err) {
+		// someone else removed it
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(moved)
+
+	got, err := readLock(moved)
+	if err == nil && got.same(stale) {
+		return true, nil
+	}
+	// if the lock was taken again since we moved it, we can't put this one
+	// back. Its holder won't remove the new one when it releases (see
+	// Lock.Release).
+	err = os.Link(moved, file)
+	if err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+func readLock(file string) (*LockInfo, error) {
+	infoJSON, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var info LockInfo
+	err = json.Unmarshal(infoJSON, &info)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	return &info, nil
+}
+
+// release the lock. It is safe to call this on a nil Lock.
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	holder, err := readLock(l.file)
+	if err == nil && !holder.same(l.info) {
+		fmt.Fprintf(os.Stderr, "Lock %s was taken over by %s (PID %d), leaving it\n", l.file, holder.Command, holder.PID)
+		return
+	}
+	err = os.Remove(l.file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to release lock %s: %s\n", l.file, err)
+	}
+}
+
+// make sure only one schedule run happens at a time
+func LockSchedule() (*Lock, error) {
+	file := filepath.Join(Config.SMB.LocalPath, scheduleLockName)
+	return acquireLock(file, "schedule", "schedule")
+}
+
+// escapes path separators (and %, so escaped names can't collide) in VM
+// names used as lock file names
+var lockNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F", `\`, "%5C")
+
+// make sure only one backup or restore of a VM happens at a time. Backups
+// lock the VM's UUID, so renames and other VMs with the same name don't
+// matter. Restores lock the name of the VM being created (vmUUID is empty).
+func LockVM(vmName, vmUUID, command string) (*Lock, error) {
+	folder := filepath.Join(Config.SMB.LocalPath, vmLocksFolderName)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// names come from the command line, so keep them from reaching
+	// outside the folder
+	file := filepath.Join(folder, lockNameEscaper.Replace(vmName)+".lock")
+	if vmUUID != "" {
+		file = filepath.Join(folder, vmUUID+".lock")
+	}
+	return acquireLock(file, "VM "+vmName, command)
+}
+
+// lock a state file (ex: the jobs file) while we read, change, and write it
+// back, so other processes don't lose our changes or we theirs. These locks
+// are only held briefly, so we wait for them.
+func lockStateFile(file string) (*Lock, error) {
+	deadline := time.Now().Add(stateLockTimeout)
+	for {
+		lock, err := acquireLock(file+".lock", filepath.Base(file), "update "+filepath.Base(file))
+		if !errors.Is(err, ErrLocked) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a lock file the way another process would have
+func writeLock(t *testing.T, file string, info LockInfo) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, infoJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func vmLockFile(vmName string) string {
+	return filepath.Join(Config.SMB.LocalPath, vmLocksFolderName, vmName+".lock")
+}
+
+func TestLockVM(t *testing.T) {
+	setupFakeScale(t)
+
+	lock, err := LockVM("web01", "", "backup one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockVM("web01", "", "backup two")
+	var lockErr *LockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a LockError, got %v", err)
+	}
+	if lockErr.Holder.Command != "backup one" || lockErr.Holder.PID != os.Getpid() {
+		t.Errorf("unexpected lock holder: %+v", lockErr.Holder)
+	}
+
+	// other VMs aren't affected
+	other, err := LockVM("web02", "", "backup three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Release()
+
+	lock.Release()
+	lock, err = LockVM("web01", "", "backup two")
+	if err != nil {
+		t.Fatalf("lock should be free after release: %s", err)
+	}
+	lock.Release()
+}
+
+func TestStaleLock(t *testing.T) {
+	setupFakeScale(t)
+	writeLock(t, vmLockFile("web01"), LockInfo{
+		PID:     deadPID(t),
+		Host:    hostname(),
+		Command: "backup crashed",
+		Started: time.Now().Add(-time.Hour),
+	})
+	writeLock(t, vmLockFile("web02"), LockInfo{
+		PID:     deadPID(t),
+		Host:    "some-other-machine",
+		Command: "backup elsewhere",
+		Started: time.Now().Add(-time.Hour),
+	})
+
+	lock, err := LockVM("web01", "", "backup new")
+	if err != nil {
+		t.Fatalf("stale lock should have been taken over: %s", err)
+	}
+	holder, err := readLock(vmLockFile("web01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder.PID != os.Getpid() {
+		t.Errorf("expected lock to be ours, got %+v", holder)
+	}
+	lock.Release()
+
+	// we can't tell if a process on another machine is still running
+	_, err = LockVM("web02", "", "backup new")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("lock from another machine should be honored, got %v", err)
+	}
+}
+
+func TestRemoveStaleLockKeepsNewLock(t *testing.T) {
+	setupFakeScale(t)
+	file := vmLockFile("web01")
+	stale := LockInfo{PID: deadPID(t), Host: hostname(), Command: "backup crashed"}
+
+	// someone else already took it over
+	lock, err := LockVM("web01", "", "backup new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	removed, err := removeStaleLock(file, stale, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed {
+		t.Error("a lock that was taken over should not be removed")
+	}
+	holder, err := readLock(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder.Command != "backup new" {
+		t.Errorf("the new lock should be put back, got %+v", holder)
+	}
+}
+
+func TestLockVMName(t *testing.T) {
+	setupFakeScale(t)
+	lock, err := LockVM("../../escape", "", "restore something")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	folder := filepath.Join(Config.SMB.LocalPath, vmLocksFolderName)
+	if filepath.Dir(lock.file) != folder {
+		t.Errorf("lock file %s is outside of %s", lock.file, folder)
+	}
+}
+
+func TestBackupHonorsVMLock(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	lock, err := LockVM("web01", vm.UUID, "backup something")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	err = Backup(context.Background(), "web01", "manual web01", false)
+	if err == nil {
+		t.Error("expected backup to be refused")
+	}
+	for _, req := range fake.Requests() {
+		if req == "POST /rest/v1/VirDomain/"+vm.UUID+"/export" {
+			t.Error("no export should have been started")
+		}
+	}
+}
+
+func TestScheduleLock(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := time.Now()
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.MaxBackups = 2
+	Config.Schedule.Concurrency = 2
+	fake.AddVM("dc01")
+	fs01 := fake.AddVM("fs01")
+
+	lock, err := LockSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Schedule(context.Background())
+	if err == nil {
+		t.Error("a second schedule run should have been refused")
+	}
+	lock.Release()
+
+	// a manual backup is running, so the schedule skips that VM
+	vmLock, err := LockVM("fs01", fs01.UUID, "backup manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vmLock.Release()
+	err = Schedule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["dc01"]) != 1 || len(backups["fs01"]) != 0 {
+		t.Errorf("expected only dc01 to be backed up, got %v", backups)
+	}
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastAttemptFailed(history, fs01.UUID, "fs01") {
+		t.Error("a locked VM should not count as a failed backup")
+	}
+}
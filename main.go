@@ -3,14 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -21,40 +24,97 @@ import (
 )
 
 func emailTerminalError(subject, bodyFormatString string, args ...interface{}) {
-	bodyFormatString += "\n"
-	fmt.Fprintln(os.Stderr, subject)
-	fmt.Fprintf(os.Stderr, bodyFormatString, args...)
-	Email(
-		subject,
-		fmt.Sprintf(bodyFormatString, args...),
-	)
+	emailError(subject, bodyFormatString, args...)
 	os.Exit(1)
 }
 
-func ShowVMs() {
-	vms, err := VMs("")
+// like emailTerminalError, but return the error instead of exiting
+func emailError(subject, bodyFormatString string, args ...interface{}) error {
+	err := fmt.Errorf(bodyFormatString, args...)
+	fmt.Fprintln(os.Stderr, subject)
+	fmt.Fprintln(os.Stderr, err)
+	Email(subject, err.Error())
+	return err
+}
+
+func ShowVMs(ctx context.Context) {
+	vms, err := Scale.VMList(ctx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
 	// sort the list of VM names alphabetically
-	vmNames := make([]string, 0, len(vms))
-	for vmName := range vms {
-		vmNames = append(vmNames, vmName)
+	var vmNames []string
+	for _, vm := range vms {
+		if !vm.IsTransient {
+			vmNames = append(vmNames, vm.Name)
+		}
 	}
 	sort.Strings(vmNames)
 
 	for _, name := range vmNames {
 		fmt.Println(name)
 	}
+
+	// keep stdout to one name per VM for scripts
+	for _, duplicate := range duplicateVMNames(vms) {
+		fmt.Fprintf(os.Stderr, "Warning: more than one VM is named %s\n", duplicate)
+	}
 }
 
-func Backup(vmName, backupName string, scheduled bool) {
+// back up a VM, given its name or (if several VMs share that name) its
+// UUID. Failures are emailed before they are returned.
+func Backup(ctx context.Context, vmName, backupName string, scheduled bool) error {
 	DebugCall(vmName, backupName, scheduled)
 
+	// get a list of VMs and their UUIDs
+	vms, err := Scale.VMList(ctx)
+	if ctx.Err() != nil {
+		recordInterruption("Backup of %s was not started", vmName)
+		return ctx.Err()
+	}
+	if err != nil {
+		return emailError(
+			"Backup failed",
+			"Backup of %s failed to start because the list of VMs could not be retrieved: %s",
+			vmName,
+			err,
+		)
+	}
+
+	// find the VM we're backing up
+	vm, err := lookupVM(vms, vmName)
+	if err != nil {
+		return emailError(
+			"Backup failed",
+			"Backup of %s failed to start: %s",
+			vmName,
+			err,
+		)
+	}
+	vmName = vm.Name
+	vmUUID := vm.UUID
+
+	// make sure nobody else is backing up this VM
+	lock, err := LockVM(vmName, vmUUID, "backup "+backupName)
+	if errors.Is(err, ErrLocked) && scheduled {
+		// the schedule will get it next time
+		fmt.Printf("Skipping %s: %s\n", vmName, err)
+		return err
+	}
+	if err != nil {
+		return emailError(
+			"Backup failed",
+			"Backup of %s not started: %s",
+			vmName,
+			err,
+		)
+	}
+	defer lock.Release()
+
 	// run pre-backup hook
-	err := PreBackupHook(vmName, backupName)
+	err = PreBackupHook(vmName, backupName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Pre-backup hook failed: %s\n", err)
 		Email(
@@ -67,31 +127,26 @@ func Backup(vmName, backupName string, scheduled bool) {
 		)
 	}
 
-	// get a list of VMs and their UUIDs
-	vms, err := VMs("")
+	// from here on a folder without a manifest means the export didn't
+	// finish, see BackupFolders
+	backupTime, _, err := parseDateTime(backupName)
 	if err != nil {
-		emailTerminalError(
-			"Backup failed",
-			"Backup of %s failed to start because the list of VMs could not be retrieved: %s",
-			vmName,
-			err,
-		)
+		backupTime = clock.Now()
 	}
-
-	// get the UUID of the VM we're backing up
-	vmUUID, exists := vms[vmName]
-	if !exists {
-		emailTerminalError(
-			"Backup failed",
-			"Backup of %s failed to start: VM not found",
-			vmName,
-		)
+	err = startManifestEra(backupTime)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record when manifests started: %s\n", err)
 	}
 
 	// start the backup and get the task tag to track it's progress
-	taskTag, err := Export(vmUUID, backupName)
+	transfer := TransferSettingsFor(vmName, vm.Tags)
+	taskTag, err := Scale.Export(ctx, vmUUID, backupName, transfer)
+	if ctx.Err() != nil {
+		recordInterruption("Backup of %s was not started", vmName)
+		return ctx.Err()
+	}
 	if err != nil {
-		emailTerminalError(
+		return emailError(
 			"Backup failed",
 			"Backup of %s failed to start: %s",
 			vmName,
@@ -100,7 +155,7 @@ func Backup(vmName, backupName string, scheduled bool) {
 	}
 
 	if taskTag == "" {
-		emailTerminalError(
+		return emailError(
 			"Backup failed",
 			"Backup of %s failed to start: no task tag returned",
 			vmName,
@@ -109,103 +164,166 @@ func Backup(vmName, backupName string, scheduled bool) {
 
 	fmt.Printf("Backup of %s started as task %s\n", vmName, taskTag)
 
-	errCount := 0
-	percent := -2
-	for {
-		// get task status
-		// if we fail to do this 5 times in a row, exit with error
-		task, err := GetTask(taskTag)
-		if err == nil {
-			errCount = 0
-		} else {
-			errCount++
-			if errCount > 5 {
-				emailTerminalError(
-					"Backup status unknown",
-					"Cannot retrieve status of backup for %s: %s",
-					vmName,
-					err,
-				)
-			}
-			time.Sleep(5 * time.Second)
-			continue
+	// record the job so it can be picked back up if we die before it
+	// finishes
+	err = saveJob(Job{
+		VMName:     vmName,
+		VMUUID:     vmUUID,
+		BackupName: backupName,
+		TaskTag:    taskTag,
+		Scheduled:  scheduled,
+		Started:    clock.Now(),
+		PID:        os.Getpid(),
+		Convert:    transfer.Convert,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record backup job: %s\n", err)
+	}
+
+	result, err := Scale.WaitForTask(ctx, taskTag, WaitOptions{
+		Progress: printTaskProgress(vmName),
+	})
+	if errors.Is(err, context.Canceled) {
+		// the export carries on without us, so leave the job for `resume`
+		handleInterruptedTask(fmt.Sprintf("Backup of %s", vmName), taskTag)
+		return err
+	}
+	if err != nil {
+		markErr := markBackupFailed(backupName, err.Error())
+		if markErr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark %s as failed: %s\n", backupName, markErr)
 		}
-		// for errors
-		taskJSON, _ := json.MarshalIndent(task, "", "\t")
+		removeJob(backupName)
+		return emailError(
+			"Backup failed",
+			"Backup of %s failed: %s",
+			vmName,
+			err,
+		)
+	}
 
-		switch task.State {
-		case "UNINITIALIZED":
-			errCount++
-			if errCount > 5 {
-				emailTerminalError(
-					"Backup failed to start",
-					"Backup of %s failed to start\n%s",
-					vmName,
-					string(taskJSON),
-				)
+	fmt.Printf("Backup of %s completed in %s\n", vmName, describeDuration(result.Duration()))
+
+	// converting reads the qcow2 images, so it has to happen before they
+	// are encrypted. If it's interrupted, the job is left for `resume`.
+	err = convertAfterBackup(ctx, vmName, backupName, transfer.Convert)
+	if err != nil {
+		return err
+	}
+
+	// encrypt the disk images before anything else (the manifest, copies,
+	// hooks) gets to them
+	var encryptedFor string
+	if EncryptionConfigured() {
+		err = encryptBackup(backupName)
+		if err != nil {
+			markErr := markBackupFailed(backupName, "encryption failed: "+err.Error())
+			if markErr != nil {
+				fmt.Fprintf(os.Stderr, "Failed to mark %s as failed: %s\n", backupName, markErr)
 			}
-		case "ERROR":
-			emailTerminalError(
+			removeJob(backupName)
+			return emailError(
 				"Backup failed",
-				"Backup of %s failed\n%s",
+				"Backup of %s completed, but it could not be encrypted, so it was marked failed (its unencrypted disk images were kept): %s",
 				vmName,
-				string(taskJSON),
+				err,
 			)
-		case "QUEUED":
-			errCount = 0
-			if percent != -1 {
-				percent = -1
-				fmt.Println("Waiting for other tasks on the cluster to complete...")
-			}
-		case "RUNNING":
-			errCount = 0
-			if task.ProgressPercent != percent {
-				percent = task.ProgressPercent
-				fmt.Printf("%s: %d%% complete\n", vmName, percent)
-			}
-		case "COMPLETE":
-			fmt.Printf("Backup of %s completed\n", vmName)
-			// run post-backup hook
-			err := PostBackupHook(vmName, backupName, scheduled)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Post-backup hook failed: %s\n", err)
-				Email(
-					"Post-backup hook failed",
-					fmt.Sprintf(
-						"Post-backup hook failed for %s: %s",
-						vmName,
-						err,
-					),
-				)
-			}
-			return
-		default:
-			errCount++
-			if errCount > 5 {
-				emailTerminalError(
-					"Backup failed to start",
-					"Unknown state for backup of %s\n%s",
+		}
+		encryptedFor = Config.Encryption.PublicKey
+	}
+
+	err = recordBackup(vmUUID, vmName, BackupRecord{
+		BackupName: backupName,
+		Finished:   result.Finished,
+		Duration:   result.Duration(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record backup duration: %s\n", err)
+	}
+
+	// mark the backup as complete
+	err = writeManifest(Manifest{
+		VMName:       vmName,
+		VMUUID:       vmUUID,
+		BackupName:   backupName,
+		TaskTag:      taskTag,
+		Started:      result.Started,
+		Finished:     result.Finished,
+		Disks:        vm.BlockDevs,
+		EncryptedFor: encryptedFor,
+	})
+	if err != nil {
+		emailError(
+			"Failed to write manifest",
+			"Backup of %s completed, but its manifest could not be written: %s",
+			vmName,
+			err,
+		)
+	} else {
+		replicateAfterBackup(ctx, vmName, backupName)
+		if OffsiteConfigured() && Config.Offsite.AfterEachBackup {
+			// the backup itself worked, so this isn't a backup failure.
+			// The next sync will try again.
+			err = uploadBackup(ctx, backupName)
+			if err != nil && ctx.Err() == nil {
+				emailError(
+					"Offsite upload failed",
+					"Backup of %s completed, but it could not be uploaded offsite: %s",
 					vmName,
-					string(taskJSON),
+					err,
 				)
 			}
 		}
-		time.Sleep(5 * time.Second)
 	}
+
+	// run post-backup hook
+	err = PostBackupHook(vmName, backupName, scheduled)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Post-backup hook failed: %s\n", err)
+		Email(
+			"Post-backup hook failed",
+			fmt.Sprintf(
+				"Post-backup hook failed for %s: %s",
+				vmName,
+				err,
+			),
+		)
+	}
+	removeJob(backupName)
+	return nil
 }
 
-func Restore(backupName, newVMName string) {
+func Restore(ctx context.Context, backupName, newVMName string) {
 	DebugCall(backupName, newVMName)
 
+	// make sure nobody else is restoring to this name. Backups lock VM
+	// UUIDs, so they don't conflict with this.
+	lock, err := LockVM(newVMName, "", "restore "+backupName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore not started: %s\n", err)
+		return
+	}
+	defer lock.Release()
+
+	// pull the backup back down if we only have it offsite
+	backupFolder := filepath.Join(Config.SMB.LocalPath, backupName)
+	_, err = os.Stat(backupFolder)
+	if os.IsNotExist(err) && OffsiteConfigured() {
+		err = FetchOffsite(ctx, backupName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Backup %s could not be downloaded from offsite: %s\n", backupName, err)
+			return
+		}
+	}
+
 	// run pre-restore hook
-	err := PreRestoreHook(newVMName, backupName)
+	err = PreRestoreHook(newVMName, backupName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Pre-restore hook failed: %s\n", err)
 		return
 	}
 
 	// check if the backup exists
-	backupFolder := filepath.Join(Config.SMB.LocalPath, backupName)
 	fileInfo, err := os.Stat(backupFolder)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Backup %s does not exist: %s\n", backupName, err)
@@ -216,8 +334,60 @@ func Restore(backupName, newVMName string) {
 		return
 	}
 
+	// use the transfer settings of the VM the backup came from, if we
+	// can tell what that is
+	var vmName, tags string
+	_, vmName, err = parseDateTime(backupName)
+	if err == nil {
+		vms, err := Scale.VMList(ctx)
+		if err == nil && findVM(vms, vmName) != nil {
+			tags = findVM(vms, vmName).Tags
+		}
+	}
+	transfer := TransferSettingsFor(vmName, tags)
+
+	// the format has to match the disk images, which may not be what we
+	// would export in today
+	format, err := backupFormat(backupName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", backupName, err)
+		return
+	}
+	if format != "" {
+		transfer.Format = format
+	}
+
+	// encrypted backups are imported from a decrypted copy, which is
+	// deleted afterwards unless the import is left running
+	importFolder := backupName
+	encrypted, err := backupEncrypted(backupName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", backupName, err)
+		return
+	}
+	keepStaging := false
+	if encrypted {
+		importFolder, err = stageBackup(ctx, backupName)
+		defer func() {
+			staged := filepath.Join(Config.SMB.LocalPath, importFolder)
+			if keepStaging {
+				fmt.Fprintf(os.Stderr, "The decrypted copy in %s is still being imported. Delete it once the import is done.\n", staged)
+				return
+			}
+			err := removeStaging(importFolder)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to delete the decrypted copy in %s: %s\n", staged, err)
+			}
+		}()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Backup %s could not be decrypted: %s\n", backupName, err)
+			return
+		}
+	}
+
 	// start the backup and get the task tag to track it's progress
-	taskTag, err := Import(newVMName, backupName)
+	template := restoreOverrides.template(newVMName)
+	taskTag, err := Scale.Import(ctx, template, importFolder, transfer)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to start: %s\n", err)
 		return
@@ -230,68 +400,48 @@ func Restore(backupName, newVMName string) {
 
 	fmt.Printf("Restore started as task %s\n", taskTag)
 
-	errCount := 0
-	percent := -2
-	for {
-		// get task status
-		// if we fail to do this 5 times in a row, exit with error
-		task, err := GetTask(taskTag)
-		if err == nil {
-			errCount = 0
-		} else {
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Cannot retrieve status of restore: %s\n", err)
-				return
-			}
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		// for errors
-		taskJSON, _ := json.MarshalIndent(task, "", "\t")
+	result, err := Scale.WaitForTask(ctx, taskTag, WaitOptions{
+		Progress: printTaskProgress(newVMName),
+	})
+	if errors.Is(err, context.Canceled) {
+		// the import is still reading the decrypted copy
+		keepStaging = true
+		handleInterruptedTask(fmt.Sprintf("Restore of %s as %s", backupName, newVMName), taskTag)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %s\n", err)
+		return
+	}
 
-		switch task.State {
-		case "UNINITIALIZED":
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Restore failed to start\n%s\n", string(taskJSON))
-				return
-			}
-		case "ERROR":
-			fmt.Fprintf(os.Stderr, "Restore failed\n%s\n", string(taskJSON))
-			return
-		case "QUEUED":
-			errCount = 0
-			if percent != -1 {
-				percent = -1
-				fmt.Println("Waiting for other tasks on the cluster to complete...")
-			}
-		case "RUNNING":
-			errCount = 0
-			if task.ProgressPercent != percent {
-				percent = task.ProgressPercent
-				fmt.Printf("%d%% complete\n", percent)
-			}
-		case "COMPLETE":
-			fmt.Printf("Restore of %s completed\n", newVMName)
-			// run post-restore hook
-			err := PostRestoreHook(newVMName, backupName)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Post-restore hook failed: %s\n", err)
-			}
-			return
-		default:
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Unknown task state\n%s\n", string(taskJSON))
-				return
-			}
+	fmt.Printf("Restore of %s completed\n", newVMName)
+
+	// apply the overrides that the import template can't
+	newVMUUID := result.Task.CreatedUUID
+	if newVMUUID == "" {
+		vms, err := Scale.VMList(ctx)
+		if err == nil && findVM(vms, newVMName) != nil {
+			newVMUUID = findVM(vms, newVMName).UUID
 		}
-		time.Sleep(5 * time.Second)
+	}
+	if newVMUUID == "" {
+		fmt.Fprintf(os.Stderr, "Failed to find restored VM %s\n", newVMName)
+		return
+	}
+	err = restoreOverrides.apply(ctx, newVMUUID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to apply overrides to %s: %s\n", newVMName, err)
+		return
+	}
+
+	// run post-restore hook
+	err = PostRestoreHook(newVMName, backupName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Post-restore hook failed: %s\n", err)
 	}
 }
 
-func InteractiveRestore() {
+func InteractiveRestore(ctx context.Context) {
 	DebugCall()
 
 	// get the list of backups
@@ -327,7 +477,7 @@ func InteractiveRestore() {
 	}
 
 	// get a list of VMs on the cluster to check for name conflicts
-	existingVMs, err := VMs("")
+	existingVMs, err := Scale.VMs(ctx, "")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get list of VMs: %s\n", err)
 		return
@@ -361,13 +511,17 @@ func InteractiveRestore() {
 
 	// prompt the user to confirm
 	backupTimeStr := backups[vmName][backupIdx].Format("2006-01-02 03:04 PM (MST)")
+	label := fmt.Sprintf(
+		"Restore %s from %s as %s",
+		vmName,
+		backupTimeStr,
+		newVMName,
+	)
+	if overrides := restoreOverrides.String(); overrides != "" {
+		label += " (" + overrides + ")"
+	}
 	confirmed, err := (&promptui.Prompt{
-		Label: fmt.Sprintf(
-			"Restore %s from %s as %s",
-			vmName,
-			backupTimeStr,
-			newVMName,
-		),
+		Label:     label,
 		IsConfirm: true,
 	}).Run()
 	if err != nil {
@@ -381,32 +535,50 @@ func InteractiveRestore() {
 
 	// run the restore
 	backupName := DateTimePrefix(backups[vmName][backupIdx], vmName)
-	Restore(backupName, newVMName)
+	Restore(ctx, backupName, newVMName)
 }
 
-func Schedule() {
+// run one pass of scheduled backups. Errors that stop the whole run are
+// emailed before they are returned. Failed backups are emailed and the run
+// moves on to the next VM.
+func Schedule(ctx context.Context) error {
 	DebugCall()
 
 	// check that schedule is configured
 	if !ScheduleConfigured() {
-		emailTerminalError(
+		return emailError(
 			"Backup not started",
 			"No backups started because the schedule is not configured",
 		)
 	}
 
+	// show what we would do instead of doing it
+	if dryRun {
+		return planSchedule(ctx)
+	}
+
 	// check that we are in the backup window
 	if !ScheduleIsActive() {
-		emailTerminalError(
+		return emailError(
+			"Backup not started",
+			"No backups started because we are not in a backup window (%s)",
+			describeNextWindow(),
+		)
+	}
+
+	// make sure we are the only schedule run (ex: cron fired twice)
+	lock, err := LockSchedule()
+	if err != nil {
+		return emailError(
 			"Backup not started",
-			"No backups started because the backup window (%s-%s) is not active",
-			Config.Schedule.StartTime,
-			Config.Schedule.EndTime,
+			"No backups started because %s",
+			err,
 		)
 	}
+	defer lock.Release()
 
 	// run the pre-schedule hook
-	err := PreScheduleHook()
+	err = PreScheduleHook()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Pre-schedule hook failed: %s\n", err)
 		Email(
@@ -418,16 +590,43 @@ func Schedule() {
 		)
 	}
 
-	// already validated from when we validated the config
-	backupInterval, err := jiffy.DurationOf(Config.Schedule.BackupInterval)
-	if err != nil {
-		panic(err)
+	// VMs that share a name are still backed up (by UUID), but their
+	// backup folders can't be told apart by name
+	if vms, err := Scale.VMList(ctx); err == nil {
+		reportDuplicateVMNames(vms)
 	}
 
 	// limit the number of concurrent backup jobs
 	limiter := semaphore.NewWeighted(int64(Config.Schedule.Concurrency))
-	for {
-		limiter.Acquire(context.Background(), 1)
+
+	// pick up exports left running by a previous run that died. These
+	// count against Concurrency since they are still using export slots.
+	orphans, err := OrphanedJobs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check for unfinished backups: %s\n", err)
+	}
+	for _, job := range orphans {
+		if limiter.Acquire(ctx, 1) != nil {
+			break
+		}
+		go func(job Job) {
+			resumeAndReport(ctx, job)
+			limiter.Release(1)
+		}(job)
+	}
+
+	// VMs (by UUID) we have already tried this run. A backup that failed
+	// leaves the VM in the queue, and we don't want to retry it over and
+	// over.
+	attempted := make(map[string]bool)
+	// VMs we skipped because their last exports took longer than the time
+	// left in the window, and how long we expected them to take
+	tooLong := make(map[string]time.Duration)
+	var runErr error
+	for ctx.Err() == nil {
+		if limiter.Acquire(ctx, 1) != nil {
+			break
+		}
 
 		// check that we are still in the backup window
 		if !ScheduleIsActive() {
@@ -436,35 +635,95 @@ func Schedule() {
 			break
 		}
 
+		// exports and imports we didn't start use the same slots on the
+		// cluster, so make sure there is room for another one
+		if !waitForClusterSlot(ctx) {
+			limiter.Release(1)
+			break
+		}
+
 		// re-check the queue every time we are ready to start a new job
-		queue, err := BackupQueue(backupInterval)
+		queue, err := backupQueue(ctx, false)
 		if err != nil {
-			emailTerminalError(
+			runErr = emailError(
 				"Backup not started",
 				"Some (maybe all) backups skipped because the backup queue could not be retrieved: %s",
 				err,
 			)
+			limiter.Release(1)
+			break
+		}
+
+		// start a backup job for the first VM in the queue we haven't
+		// already tried and that should finish before the window closes
+		history, err := loadHistory()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load backup history: %s\n", err)
+		}
+		window, _ := NextWindow()
+		remaining := window.End.Sub(clock.Now())
+		var next *QueuedVM
+		for i, vm := range queue {
+			if attempted[vm.UUID] {
+				continue
+			}
+			predicted, tooLongForWindow := wontFit(history, vm.UUID, vm.Name, remaining)
+			if tooLongForWindow {
+				if _, skipped := tooLong[vm.UUID]; !skipped {
+					fmt.Printf(
+						"Skipping %s: it usually takes %s and the window closes in %s\n",
+						vm.Name,
+						describeDuration(predicted),
+						describeDuration(remaining),
+					)
+				}
+				tooLong[vm.UUID] = predicted
+				continue
+			}
+			next = &queue[i]
+			break
 		}
 
 		// quit if the queue is empty
-		if len(queue) == 0 {
+		if next == nil && len(tooLong) != 0 {
+			fmt.Println("No more backups in queue that will fit in this window")
+			limiter.Release(1)
+			break
+		}
+		if next == nil {
 			fmt.Println("No more backups in queue")
 			limiter.Release(1)
 			break
 		}
 
-		// start a backup job for the first VM in the queue
-		vmName := queue[0]
-		backupName := DateTimePrefix(time.Now(), vmName)
-		go func(vmName, backupName string) {
-			Backup(vmName, backupName, true)
+		// back up by UUID, in case another VM has the same name
+		vmName := next.Name
+		attempted[next.UUID] = true
+		// VMs that share a name would get the same folder if they started
+		// in the same second
+		started := clock.Now()
+		for {
+			_, err := os.Stat(filepath.Join(Config.SMB.LocalPath, DateTimePrefix(started, vmName)))
+			if err != nil {
+				break
+			}
+			started = started.Add(time.Second)
+		}
+		backupName := DateTimePrefix(started, vmName)
+		done := make(chan struct{})
+		go func(vmUUID, vmName, backupName string) {
+			err := Backup(ctx, vmUUID, backupName, true)
+			if err != nil && ctx.Err() == nil && !errors.Is(err, ErrLocked) {
+				recordFailure(vmUUID, vmName, backupName, err)
+			}
 			limiter.Release(1)
-		}(vmName, backupName)
+			close(done)
+		}(next.UUID, vmName, backupName)
 
 		// wait until we see the folder locally
 		// this avoids starting 2 backups for the same VM
 		expectedFolder := filepath.Join(Config.SMB.LocalPath, backupName)
-		for i := 0; true; i++ {
+		for i := 0; ctx.Err() == nil; i++ {
 			// wait forever, but warn/email after 2/10 minutes
 			if i%120 == 119 {
 				fmt.Println(
@@ -487,44 +746,65 @@ func Schedule() {
 			if err == nil {
 				break
 			}
-			if os.IsNotExist(err) {
-				time.Sleep(time.Second)
+			if !os.IsNotExist(err) {
+				emailError(
+					"Backup failed",
+					"Error while waiting for local file during backup of %s: %s",
+					vmName,
+					err,
+				)
+				break
+			}
+
+			// the backup failed before it wrote anything
+			select {
+			case <-done:
+			case <-time.After(time.Second):
 				continue
 			}
-			emailTerminalError(
-				"Backup failed",
-				"Error while waiting for local file during backup of %s: %s",
-				vmName,
-				err,
-			)
+			break
 		}
 	}
 
-	// wait for all jobs to finish
+	// wait for all jobs to finish. If we were interrupted they will stop
+	// (or cancel their tasks) on their own.
 	limiter.Acquire(context.Background(), int64(Config.Schedule.Concurrency))
 
-	// already validated from when we validated the config
-	tolerance, err := jiffy.DurationOf(Config.Schedule.Tolerance)
-	if err != nil {
-		panic(err)
+	// if we were interrupted, skip straight to the delayed hooks for the
+	// backups that did finish. main will send the summary email.
+	if ctx.Err() != nil {
+		err := RunDelayedHooks()
+		if err != nil {
+			recordInterruption("Delayed post-backup hook failed: %s", err)
+		}
+		return ctx.Err()
 	}
-	tolerantInterval := backupInterval + tolerance
 
-	// send email if there are still VMs in the queue
-	queue, err := BackupQueue(tolerantInterval)
+	// send email if there are still VMs more than Tolerance behind
+	queue, err := backupQueue(ctx, true)
 	if err != nil {
 		// it would be odd to get an error here.
 		// it only affects our ability to check if the queue is empty, so
 		// don't send an email if we get an error.
 		fmt.Fprintf(os.Stderr, "Error checking backup queue: %s\n", err)
-		return
+		return runErr
 	}
 	if len(queue) > 0 {
 		var msg bytes.Buffer
 		msg.WriteString("Backups are behind schedule.\n")
 		msg.WriteString("The following VMs are still in the queue:\n\n")
-		for _, vmName := range queue {
-			fmt.Fprintf(&msg, "%s\n", vmName)
+		for _, vm := range queue {
+			predicted, skipped := tooLong[vm.UUID]
+			if skipped {
+				fmt.Fprintf(
+					&msg,
+					"%s (skipped, it usually takes %s which wouldn't fit in the window)\n",
+					vm.Name,
+					describeDuration(predicted),
+				)
+			} else {
+				fmt.Fprintf(&msg, "%s\n", vm.Name)
+			}
 		}
 		fmt.Fprintln(os.Stderr, msg.String())
 		Email(
@@ -533,10 +813,33 @@ func Schedule() {
 		)
 	}
 
+	// copy backups to replicas and offsite before cleanup deletes any of
+	// them
+	if len(Config.Replicas) != 0 {
+		err = SyncReplicas(ctx)
+		if err != nil && ctx.Err() == nil {
+			emailError(
+				"Replica copy failed",
+				"Error while copying backups to replicas: %s",
+				err,
+			)
+		}
+	}
+	if OffsiteConfigured() {
+		err = SyncOffsite(ctx)
+		if err != nil && ctx.Err() == nil {
+			emailError(
+				"Offsite copy failed",
+				"Error while copying backups offsite: %s",
+				err,
+			)
+		}
+	}
+
 	// cleanup old backups
-	err = Cleanup()
+	err = Cleanup(ctx)
 	if err != nil {
-		emailTerminalError(
+		return emailError(
 			"Failed to cleanup old backups",
 			"Error while trying to cleanup old backups: %s",
 			err,
@@ -555,39 +858,142 @@ func Schedule() {
 			),
 		)
 	}
+	return runErr
+}
+
+// resume an orphaned job, sending an email if it didn't work out
+func resumeAndReport(ctx context.Context, job Job) {
+	err := ResumeJob(ctx, job)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Resumed backup failed: %s\n", err)
+		Email(
+			"Resumed backup failed",
+			fmt.Sprintf(
+				"Resumed backup %s of %s failed: %s",
+				job.BackupName,
+				job.VMName,
+				err,
+			),
+		)
+	}
 }
 
-func ShowBackups() {
+// reattach to exports left running by scale-backup processes that died
+func Resume(ctx context.Context) {
 	DebugCall()
 
-	backups, err := Backups()
+	orphans, err := OrphanedJobs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of unfinished backups: %s\n", err)
+		return
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No unfinished backups")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range orphans {
+		wg.Add(1)
+		go func(job Job) {
+			resumeAndReport(ctx, job)
+			wg.Done()
+		}(job)
+	}
+	wg.Wait()
+
+	// we aren't part of a schedule run, so don't hold on to hooks
+	err = RunDelayedHooks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Post-backup hook failed: %s\n", err)
+	}
+}
+
+func ShowBackups(ctx context.Context) {
+	DebugCall()
+
+	folders, err := BackupFolders()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 
-	// sort the list of VM names alphabetically
-	vmNames := make([]string, 0, len(backups))
-	for vmName := range backups {
-		vmNames = append(vmNames, vmName)
+	// UUIDs are needed to follow renames, and tags to pick each VM's
+	// policy, and so which rule keeps each backup
+	vms, err := Scale.VMList(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of VMs, backups are grouped by name only: %s\n", err)
 	}
-	sort.Strings(vmNames)
+	groups := groupBackups(folders, vms)
+	copies := replicaLocations()
+
+	// VMs that share a name are told apart by UUID
+	nameCounts := make(map[string]int)
+	for _, group := range groups {
+		nameCounts[group.Name]++
+	}
+
+	for _, group := range groups {
+		header := group.Name
+		if nameCounts[group.Name] > 1 && group.UUID != "" {
+			header += " (UUID " + group.UUID + ")"
+		}
+		if oldNames := group.OldNames(); len(oldNames) != 0 {
+			header += " (was " + strings.Join(oldNames, ", ") + ")"
+		}
+		fmt.Println(header)
 
-	for _, vmName := range vmNames {
-		backupTimes := backups[vmName]
-		fmt.Println(vmName)
-		for _, backupTime := range backupTimes {
-			name := DateTimePrefix(backupTime, vmName)
-			size, err := BackupSize(name)
+		var retained []retention
+		if ScheduleConfigured() {
+			var tags string
+			if group.VM != nil {
+				tags = group.VM.Tags
+			}
+			retained = applyRetention(PolicyFor(group.Name, tags), group.Usable())
+		}
+
+		// retained only covers usable backups
+		usable := 0
+		for _, folder := range group.Folders {
+			size, err := BackupSize(folder.Name)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error getting size of %s: %s\n", name, err)
+				fmt.Fprintf(os.Stderr, "Error getting size of %s: %s\n", folder.Name, err)
+			}
+			backupTimeStr := folder.Time.Format("2006-01-02 03:04 PM")
+
+			var mark string
+			switch {
+			case folder.Status == BackupFailed:
+				mark = " failed: " + folder.FailReason
+			case folder.Status == BackupInProgress:
+				mark = " in progress"
+			case retained == nil:
+			case retained[usable].Newest:
+				mark = " kept as the newest backup"
+			case retained[usable].TooOld:
+				mark = " past MaxAge, will be deleted"
+			case retained[usable].Kept():
+				mark = " kept by " + strings.Join(retained[usable].KeptBy, ", ")
+			default:
+				mark = " not kept by any rule, will be deleted"
+			}
+			if folder.Usable() {
+				usable++
+			}
+			if folder.Status == BackupUnverified {
+				mark += " (no manifest)"
 			}
-			backupTimeStr := backupTime.Format("2006-01-02 03:04 PM")
-			fmt.Printf("\t%s (%s)\n", backupTimeStr, humanize.Bytes(size))
+			if folder.VMName != group.Name {
+				mark += " (as " + folder.VMName + ")"
+			}
+			if locations := copies[folder.Name]; len(locations) != 0 {
+				mark += " (copied to " + strings.Join(locations, ", ") + ")"
+			}
+			fmt.Printf("\t%s (%s)%s\n", backupTimeStr, humanize.Bytes(size), mark)
 		}
 	}
 }
 
-func ShowQueue() {
+func ShowQueue(ctx context.Context) {
 	DebugCall()
 
 	// a queue requires a schedule to be configured
@@ -596,48 +1002,40 @@ func ShowQueue() {
 		return
 	}
 
-	// already validated from when we validated the config
-	backupInterval, err := jiffy.DurationOf(Config.Schedule.BackupInterval)
-	if err != nil {
-		panic(err)
-	}
+	fmt.Printf("Schedule: %s\n", describeNextWindow())
 
-	queue, err := BackupQueue(backupInterval)
+	queue, err := backupQueue(ctx, false)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	backups, err := Backups()
+	history, err := loadHistory()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		return
 	}
-	for _, vmName := range queue {
-		backups, backupExists := backups[vmName]
-		if backupExists {
-			lastBackup := backups[0]
-			age := time.Since(lastBackup)
+	for i, vm := range queue {
+		expected := "unknown"
+		if predicted, known := predictDuration(history, vm.UUID, vm.Name); known {
+			expected = describeDuration(predicted)
+		}
+
+		if vm.LastBackup.IsZero() {
+			fmt.Printf("%d. %s (no backups, %s policy, takes %s)\n", i+1, vm.Name, vm.Policy.Name, expected)
+		} else {
 			fmt.Printf(
-				"%s (%s old)\n",
-				vmName,
-				jiffy.DescribeDuration(age, &jiffy.Want{
-					Year:      true,
-					Month:     true,
-					Day:       true,
-					Hour:      true,
-					Minute:    true,
-					Second:    false,
-					Verbose:   false,
-					Separator: " ",
-				}),
+				"%d. %s (%s old, %s policy, takes %s)\n",
+				i+1,
+				vm.Name,
+				describeAge(since(vm.LastBackup)),
+				vm.Policy.Name,
+				expected,
 			)
-		} else {
-			fmt.Printf("%s (no backups)\n", vmName)
 		}
+		fmt.Printf("   %s\n", vm.Why())
 	}
 }
 
-func UploadDiskMedia(filename string) {
+func UploadDiskMedia(ctx context.Context, filename string) {
 	DebugCall()
 
 	// open file
@@ -662,7 +1060,7 @@ func UploadDiskMedia(filename string) {
 
 	// upload file
 	basename := filepath.Base(filename)
-	uuid, err := Upload(basename, fileSize, &reader)
+	uuid, err := Scale.Upload(ctx, basename, fileSize, &reader)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to upload %s: %s\n", filename, err)
 		return
@@ -671,11 +1069,11 @@ func UploadDiskMedia(filename string) {
 	fmt.Printf("Uploaded %s as %s\n", basename, uuid)
 }
 
-func ShowDisks(vmName string) {
+func ShowDisks(ctx context.Context, vmName string) {
 	DebugCall(vmName)
 
 	// get vm uuid
-	vms, err := VMs("")
+	vms, err := Scale.VMs(ctx, "")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get list of VMs: %s\n", err)
 		return
@@ -688,7 +1086,7 @@ func ShowDisks(vmName string) {
 	}
 
 	// get disks
-	disks, err := VMDisks(vmUUID)
+	disks, err := Scale.VMDisks(ctx, vmUUID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get list of disks for %s: %s\n", vmName, err)
 		return
@@ -716,11 +1114,11 @@ func ShowDisks(vmName string) {
 	}
 }
 
-func CloneDisk(diskUUID, targetVM string) {
+func CloneDisk(ctx context.Context, diskUUID, targetVM string) {
 	DebugCall(diskUUID, targetVM)
 
 	// get source disk
-	allDisks, err := Disks()
+	allDisks, err := Scale.Disks(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get list of disks: %s\n", err)
 		return
@@ -742,7 +1140,7 @@ func CloneDisk(diskUUID, targetVM string) {
 	}
 
 	// get target VM UUID
-	vms, err := VMs("")
+	vms, err := Scale.VMs(ctx, "")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get list of VMs: %s\n", err)
 		return
@@ -755,10 +1153,12 @@ func CloneDisk(diskUUID, targetVM string) {
 
 	// snapshot the VM
 	fmt.Println("Creating temporary snapshot...")
-	snapshotName := fmt.Sprintf("clone-%s", diskUUID)
-	snapshotTask, err := CreateSnapshot(
+	snapshotName := cloneSnapshotPrefix + diskUUID
+	snapshotTask, err := Scale.CreateSnapshot(
+		ctx,
 		src.VirDomainUUID,
 		snapshotName,
+		"AUTOMATED",
 		time.Minute,
 	)
 	if err != nil {
@@ -767,185 +1167,318 @@ func CloneDisk(diskUUID, targetVM string) {
 	}
 
 	// wait for snapshot to complete
-	errCount := 0
-	percent := -2
-	for percent != 101 {
-		// get task status
-		// if we fail to do this 5 times in a row, exit with error
-		task, err := GetTask(snapshotTask.TaskTag)
-		if err == nil {
-			errCount = 0
-		} else {
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Cannot retrieve status of snapshot: %s\n", err)
-			}
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		// for errors
-		taskJSON, _ := json.MarshalIndent(task, "", "\t")
-
-		switch task.State {
-		case "UNINITIALIZED":
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Snapshot failed to start\n%s\n", string(taskJSON))
-			}
-		case "ERROR":
-			fmt.Fprintf(os.Stderr, "Snapshot failed\n%s\n", string(taskJSON))
-		case "QUEUED":
-			errCount = 0
-			if percent != -1 {
-				percent = -1
-				fmt.Println("Waiting for other tasks on the cluster to complete...")
-			}
-		case "RUNNING":
-			errCount = 0
-			if task.ProgressPercent != percent {
-				percent = task.ProgressPercent
-				fmt.Printf("Snapshot %d%% complete\n", percent)
-			}
-		case "COMPLETE":
-			fmt.Printf("Snapshot completed\n")
-			percent = 101
-		default:
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Unknown task state\n%s\n", string(taskJSON))
-			}
-		}
-		time.Sleep(5 * time.Second)
+	_, err = Scale.WaitForTask(ctx, snapshotTask.TaskTag, WaitOptions{
+		Timeout:  time.Hour,
+		Progress: printTaskProgress("Snapshot"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Snapshot failed: %s\n", err)
+		return
 	}
+	fmt.Println("Snapshot completed")
 
 	// clone the disk
 	fmt.Println("Cloning disk from snapshot...")
-	cloneTask, err := DiskFromSnapshot(src, snapshotTask.CreatedUUID, targetUUID)
+	cloneTask, err := Scale.DiskFromSnapshot(ctx, src, snapshotTask.CreatedUUID, targetUUID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to clone disk: %s\n", err)
 		return
 	}
 
 	// wait for clone to complete
-	errCount = 0
-	percent = -2
-	for percent != 101 {
-		// get task status
-		// if we fail to do this 5 times in a row, exit with error
-		task, err := GetTask(cloneTask)
-		if err == nil {
-			errCount = 0
-		} else {
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Cannot retrieve status of Create-Disk: %s\n", err)
-			}
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		// for errors
-		taskJSON, _ := json.MarshalIndent(task, "", "\t")
+	_, err = Scale.WaitForTask(ctx, cloneTask, WaitOptions{
+		Timeout:  time.Hour,
+		Progress: printTaskProgress("Create-Disk"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Create-Disk failed: %s\n", err)
+		return
+	}
+	fmt.Println("Create-Disk completed")
+}
 
-		switch task.State {
-		case "UNINITIALIZED":
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Create-Disk failed to start\n%s\n", string(taskJSON))
-			}
-		case "ERROR":
-			fmt.Fprintf(os.Stderr, "Create-Disk failed\n%s\n", string(taskJSON))
-		case "QUEUED":
-			errCount = 0
-			if percent != -1 {
-				percent = -1
-				fmt.Println("Waiting for other tasks on the cluster to complete...")
-			}
-		case "RUNNING":
-			errCount = 0
-			if task.ProgressPercent != percent {
-				percent = task.ProgressPercent
-				fmt.Printf("Create-Disk %d%% complete\n", percent)
-			}
-		case "COMPLETE":
-			fmt.Printf("Create-Disk completed\n")
-			percent = 101
-		default:
-			errCount++
-			if errCount > 5 {
-				fmt.Fprintf(os.Stderr, "Unknown task state\n%s\n", string(taskJSON))
-			}
+// parse flags for a command, allowing them to appear before, after, or
+// between positional arguments. Returns the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		// flags are set up with ExitOnError
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
 		}
-		time.Sleep(5 * time.Second)
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 }
 
 func main() {
+	LoadConfig()
+
 	var anyArgs []any
 	for _, arg := range os.Args {
 		anyArgs = append(anyArgs, arg)
 	}
 	DebugCall(anyArgs...)
 
+	// the first ctrl-c (or SIGTERM) cancels ctx so running commands can
+	// clean up. After that, signals go back to killing us immediately.
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	if len(os.Args) < 2 {
 		basename := filepath.Base(os.Args[0])
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [args]\n", basename)
 		fmt.Fprintln(os.Stderr, "Commands:")
 		fmt.Fprintln(os.Stderr, "\tshow-vms")
-		fmt.Fprintln(os.Stderr, "\tbackup <vm name> <backup name>")
-		fmt.Fprintln(os.Stderr, "\trestore <backup name> <new vm name>")
-		fmt.Fprintln(os.Stderr, "\tinteractive-restore")
-		fmt.Fprintln(os.Stderr, "\tschedule")
+		fmt.Fprintln(os.Stderr, "\tbackup [transfer options] <vm name> <backup name>")
+		fmt.Fprintln(os.Stderr, "\trestore [transfer options] [restore options] <backup name> <new vm name>")
+		fmt.Fprintln(os.Stderr, "\tinteractive-restore [transfer options] [restore options]")
+		fmt.Fprintln(os.Stderr, "\tschedule [--dry-run]")
+		fmt.Fprintln(os.Stderr, "\tcleanup [--dry-run] [--force]")
+		fmt.Fprintln(os.Stderr, "\treplica-sync [--dry-run]")
+		fmt.Fprintln(os.Stderr, "\toffsite-sync [--dry-run]")
+		fmt.Fprintln(os.Stderr, "\tshow-offsite")
+		fmt.Fprintln(os.Stderr, "\toffsite-fetch <backup name>")
+		fmt.Fprintln(os.Stderr, "\tencryption-keygen <private key file>")
+		fmt.Fprintln(os.Stderr, "\tdaemon")
+		fmt.Fprintln(os.Stderr, "\tdaemon-status")
 		fmt.Fprintln(os.Stderr, "\tshow-backups")
 		fmt.Fprintln(os.Stderr, "\tshow-queue")
 		fmt.Fprintln(os.Stderr, "\tupload-disk-media <filename>")
 		fmt.Fprintln(os.Stderr, "\tshow-disks <vm name>")
 		fmt.Fprintln(os.Stderr, "\tclone-disk <disk uuid> <target vm name>")
+		fmt.Fprintln(os.Stderr, "\tresume")
+		fmt.Fprintln(os.Stderr, "\tshow-snapshots <vm name>")
+		fmt.Fprintln(os.Stderr, "\tcreate-snapshot [--retain <duration>] <vm name> <label>")
+		fmt.Fprintln(os.Stderr, "\tdelete-snapshot <snapshot uuid>")
+		fmt.Fprintln(os.Stderr, "\tprune-snapshots [--older-than <duration>]")
 		os.Exit(1)
 	}
 
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+
 	switch os.Args[1] {
 	case "show-vms":
-		ShowVMs()
+		ShowVMs(ctx)
 	case "backup":
-		if len(os.Args) != 4 {
-			fmt.Fprintf(os.Stderr, "Usage: %s backup <vm name> <backup name>\n", os.Args[0])
+		addTransferFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s backup [transfer options] <vm name> <backup name>\n", os.Args[0])
+			flags.PrintDefaults()
+			os.Exit(1)
+		}
+		err := Backup(ctx, args[0], args[1], false)
+		if err != nil && ctx.Err() == nil {
 			os.Exit(1)
 		}
-		Backup(os.Args[2], os.Args[3], false)
 	case "restore":
-		if len(os.Args) != 4 {
-			fmt.Fprintf(os.Stderr, "Usage: %s restore <backup name> <new vm name>\n", os.Args[0])
+		addTransferFlags(flags)
+		addRestoreFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s restore [transfer options] [restore options] <backup name> <new vm name>\n", os.Args[0])
+			flags.PrintDefaults()
 			os.Exit(1)
 		}
-		Restore(os.Args[2], os.Args[3])
+		Restore(ctx, args[0], args[1])
 	case "interactive-restore":
-		InteractiveRestore()
+		addTransferFlags(flags)
+		addRestoreFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s interactive-restore [transfer options] [restore options]\n", os.Args[0])
+			flags.PrintDefaults()
+			os.Exit(1)
+		}
+		InteractiveRestore(ctx)
 	case "schedule":
-		Schedule()
+		addDryRunFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s schedule [--dry-run]\n", os.Args[0])
+			os.Exit(1)
+		}
+		err := Schedule(ctx)
+		if err != nil && ctx.Err() == nil {
+			if dryRun {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+	case "cleanup":
+		addDryRunFlag(flags)
+		addForceFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s cleanup [--dry-run] [--force]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if !ScheduleConfigured() {
+			fmt.Fprintln(os.Stderr, "No schedule configured")
+			os.Exit(1)
+		}
+		err := Cleanup(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cleanup failed: %s\n", err)
+			os.Exit(1)
+		}
+	case "replica-sync":
+		addDryRunFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s replica-sync [--dry-run]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if len(Config.Replicas) == 0 {
+			fmt.Fprintln(os.Stderr, "No replicas are configured")
+			os.Exit(1)
+		}
+		err := SyncReplicas(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Replica sync failed: %s\n", err)
+			os.Exit(1)
+		}
+	case "offsite-sync":
+		addDryRunFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s offsite-sync [--dry-run]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if !OffsiteConfigured() {
+			fmt.Fprintln(os.Stderr, "Offsite copies are not configured")
+			os.Exit(1)
+		}
+		err := SyncOffsite(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Offsite sync failed: %s\n", err)
+			os.Exit(1)
+		}
+	case "show-offsite":
+		ShowOffsite(ctx)
+	case "offsite-fetch":
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s offsite-fetch <backup name>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if !OffsiteConfigured() {
+			fmt.Fprintln(os.Stderr, "Offsite copies are not configured")
+			os.Exit(1)
+		}
+		err := FetchOffsite(ctx, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "encryption-keygen":
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s encryption-keygen <private key file>\n", os.Args[0])
+			os.Exit(1)
+		}
+		publicKey, err := GenerateKey(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create key: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Private key written to %s\n", args[0])
+		fmt.Println("Add this to scale-backup.toml to encrypt backups:")
+		fmt.Println()
+		fmt.Println("[Encryption]")
+		fmt.Printf("PublicKey = '%s'\n", publicKey)
+	case "daemon":
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s daemon\n", os.Args[0])
+			os.Exit(1)
+		}
+		err := Daemon(ctx)
+		if err != nil && ctx.Err() == nil {
+			os.Exit(1)
+		}
+	case "daemon-status":
+		ShowDaemonStatus()
 	case "show-backups":
-		ShowBackups()
+		ShowBackups(ctx)
 	case "show-queue":
-		ShowQueue()
+		ShowQueue(ctx)
 	case "upload-disk-media":
 		if len(os.Args) != 3 {
 			fmt.Fprintf(os.Stderr, "Usage: %s upload-disk-media <filename>\n", os.Args[0])
 			os.Exit(1)
 		}
-		UploadDiskMedia(os.Args[2])
+		UploadDiskMedia(ctx, os.Args[2])
 	case "show-disks":
 		if len(os.Args) != 3 {
 			fmt.Fprintf(os.Stderr, "Usage: %s show-disks <vm name>\n", os.Args[0])
 			os.Exit(1)
 		}
-		ShowDisks(os.Args[2])
+		ShowDisks(ctx, os.Args[2])
 	case "clone-disk":
 		if len(os.Args) != 4 {
 			fmt.Fprintf(os.Stderr, "Usage: %s clone-disk <disk uuid> <target vm name>\n", os.Args[0])
 			os.Exit(1)
 		}
-		CloneDisk(os.Args[2], os.Args[3])
+		CloneDisk(ctx, os.Args[2], os.Args[3])
+	case "resume":
+		Resume(ctx)
+	case "show-snapshots":
+		if len(os.Args) != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %s show-snapshots <vm name>\n", os.Args[0])
+			os.Exit(1)
+		}
+		ShowSnapshots(ctx, os.Args[2])
+	case "create-snapshot":
+		retain := flags.String("retain", "", "how long to keep the snapshot (default forever)")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s create-snapshot [--retain <duration>] <vm name> <label>\n", os.Args[0])
+			os.Exit(1)
+		}
+		var retainDuration time.Duration
+		if *retain != "" {
+			var err error
+			retainDuration, err = jiffy.DurationOf(*retain)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid duration %s: %s\n", *retain, err)
+				os.Exit(1)
+			}
+		}
+		CreateSnapshot(ctx, args[0], args[1], retainDuration)
+	case "delete-snapshot":
+		if len(os.Args) != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %s delete-snapshot <snapshot uuid>\n", os.Args[0])
+			os.Exit(1)
+		}
+		DeleteSnapshot(ctx, os.Args[2])
+	case "prune-snapshots":
+		olderThan := flags.String("older-than", "1 hour", "only delete snapshots older than this")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			fmt.Fprintf(os.Stderr, "Usage: %s prune-snapshots [--older-than <duration>]\n", os.Args[0])
+			os.Exit(1)
+		}
+		olderThanDuration, err := jiffy.DurationOf(*olderThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid duration %s: %s\n", *olderThan, err)
+			os.Exit(1)
+		}
+		PruneSnapshots(ctx, olderThanDuration)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
 		os.Exit(1)
 	}
+
+	reportInterruption(ctx)
 }
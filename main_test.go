@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+
+	Backup(context.Background(), "web01", "manual web01", false)
+
+	folder := filepath.Join(Config.SMB.LocalPath, "manual web01")
+	for _, name := range []string{"web01.xml", vm.BlockDevs[0].UUID + ".qcow2"} {
+		if _, err := os.Stat(filepath.Join(folder, name)); err != nil {
+			t.Errorf("expected %s in export: %s", name, err)
+		}
+	}
+	size, err := BackupSize("manual web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size == 0 {
+		t.Error("expected BackupSize to count the qcow2 image")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("web01")
+	Backup(context.Background(), "web01", "manual web01", false)
+
+	Restore(context.Background(), "manual web01", "web01-restored")
+
+	if fake.VM("web01-restored") == nil {
+		t.Error("restored VM was not created")
+	}
+}
+
+func TestRestoreMissingBackup(t *testing.T) {
+	fake := setupFakeScale(t)
+
+	Restore(context.Background(), "does not exist", "web01-restored")
+
+	if fake.VM("web01-restored") != nil {
+		t.Error("restore should not start without a backup folder")
+	}
+	for _, req := range fake.Requests() {
+		if req == "POST /rest/v1/VirDomain/import" {
+			t.Error("import should not have been called")
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)).Now()
+	Config.Schedule.Tag = "BackMeUp"
+	Config.Schedule.Concurrency = 2
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	fake.AddVM("dc01", "BackMeUp")
+	fake.AddVM("fs01", "Other,BackMeUp")
+	fake.AddVM("scratch")
+
+	// an old backup that should be cleaned up (fs01 will have 3)
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour} {
+		name := DateTimePrefix(now.Add(-age), "fs01")
+		err := os.Mkdir(filepath.Join(Config.SMB.LocalPath, name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Schedule(context.Background())
+
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["dc01"]) != 1 {
+		t.Errorf("expected 1 backup of dc01, got %d", len(backups["dc01"]))
+	}
+	if len(backups["fs01"]) != 2 {
+		t.Errorf("expected fs01 to be cleaned up to 2 backups, got %d", len(backups["fs01"]))
+	}
+	if _, exists := backups["scratch"]; exists {
+		t.Error("untagged VM should not have been backed up")
+	}
+	if since(backups["fs01"][0]) > time.Hour {
+		t.Error("newest fs01 backup should be from this run")
+	}
+}
+
+func TestCloneDisk(t *testing.T) {
+	fake := setupFakeScale(t)
+	src := fake.AddVM("sql01")
+	fake.AddVM("sql01-test")
+
+	CloneDisk(context.Background(), src.BlockDevs[0].UUID, "sql01-test")
+
+	target := fake.VM("sql01-test")
+	if len(target.BlockDevs) != 2 {
+		t.Fatalf("expected cloned disk on target, got %d disks", len(target.BlockDevs))
+	}
+	if target.BlockDevs[1].Capacity != src.BlockDevs[0].Capacity {
+		t.Error("cloned disk should have the same capacity as the source")
+	}
+}
+
+func TestCloneDiskSnapshotFails(t *testing.T) {
+	fake := setupFakeScale(t)
+	src := fake.AddVM("sql01")
+	fake.AddVM("sql01-test")
+	fake.FailNext("snapshot")
+
+	// this used to poll forever after the snapshot failed
+	done := make(chan struct{})
+	go func() {
+		CloneDisk(context.Background(), src.BlockDevs[0].UUID, "sql01-test")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloneDisk did not give up after the snapshot failed")
+	}
+
+	if len(fake.VM("sql01-test").BlockDevs) != 1 {
+		t.Error("no disk should be cloned when the snapshot fails")
+	}
+}
+
+func TestScheduleWaitsForClusterTasks(t *testing.T) {
+	fake := setupFakeScale(t)
+	now := setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)).Now()
+	Config.Schedule.Concurrency = 2
+	Config.Schedule.StartTime = now.Add(-time.Hour).Format("3:04 PM")
+	Config.Schedule.EndTime = now.Add(2 * time.Hour).Format("3:04 PM")
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Tolerance = "0s"
+	Config.Schedule.MaxBackups = 2
+	vm := fake.AddVM("dc01")
+
+	// someone else already has both export slots
+	first := fake.StartForeignTask("export")
+	second := fake.StartForeignTask("import")
+	// and a snapshot, which doesn't count
+	fake.StartForeignTask("snapshot")
+
+	done := make(chan struct{})
+	go func() {
+		Schedule(context.Background())
+		close(done)
+	}()
+
+	exportPath := "POST /rest/v1/VirDomain/" + vm.UUID + "/export"
+	count := func(path string) int {
+		n := 0
+		for _, req := range fake.Requests() {
+			if req == path {
+				n++
+			}
+		}
+		return n
+	}
+	exported := func() bool {
+		return count(exportPath) != 0
+	}
+
+	// once the schedule has found the cluster busy and come back to check
+	// again, it has had its chance to start the export and didn't
+	deadline := time.Now().Add(10 * time.Second)
+	for count("GET /rest/v1/TaskTag") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("schedule never checked the cluster's tasks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if exported() {
+		t.Fatal("backup started while the cluster was busy")
+	}
+
+	fake.FinishTask(first)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("schedule did not finish after a slot opened up")
+	}
+	if !exported() {
+		t.Error("backup should have started once a slot opened up")
+	}
+	if fake.TaskState(second) != "RUNNING" {
+		t.Error("the other task should have been left alone")
+	}
+}
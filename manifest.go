@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// written into a backup's folder once its export completes. A folder
+// without one is a failed, unfinished, or (from before manifests) unverified
+// backup.
+const manifestFileName = "manifest.json"
+
+// records (under LocalPath) when the first export that would write a
+// manifest was started. Folders from before then are unverified, later ones
+// without a manifest didn't finish.
+const manifestEraFileName = ".scale-backup-manifests-since"
+
+// set at build time with -ldflags "-X main.Version=v1.2.3". If it isn't, we
+// use the module version Go recorded (ex: from go install).
+var Version string
+
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Version
+}
+
+type ManifestFile struct {
+	Name string
+	Size int64
+}
+
+type Manifest struct {
+	VMName     string
+	VMUUID     string
+	BackupName string
+	TaskTag    string
+	Started    time.Time
+	Finished   time.Time
+	// the VM's disks when the export started
+	Disks []BlockDev
+	// everything in the folder (other than this manifest) when the export
+	// finished
+	Files []ManifestFile
+	// size of the disk images, see BackupSize
+	Size uint64
+	// the public key the disk images were encrypted for, if they were
+	EncryptedFor string
+	ToolVersion  string
+}
+
+// record that an export completed, listing what it wrote
+func writeManifest(manifest Manifest) error {
+	debugReturn := DebugCall(manifest)
+
+	backupFolder := filepath.Join(Config.SMB.LocalPath, manifest.BackupName)
+	err := filepath.WalkDir(
+		backupFolder,
+		func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			name, err := filepath.Rel(backupFolder, path)
+			if err != nil {
+				return err
+			}
+			if name == manifestFileName || name == failedMarkerName {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, ManifestFile{
+				Name: filepath.ToSlash(name),
+				Size: info.Size(),
+			})
+			return nil
+		},
+	)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	manifest.Size, err = BackupSize(manifest.BackupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	manifest.ToolVersion = toolVersion()
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(backupFolder, manifestFileName), manifestJSON)
+
+	debugReturn(err)
+	return err
+}
+
+// note that exports from backupTime on write manifests, unless an earlier
+// export already did
+func startManifestEra(backupTime time.Time) error {
+	debugReturn := DebugCall(backupTime)
+
+	file := filepath.Join(Config.SMB.LocalPath, manifestEraFileName)
+	_, err := os.Stat(file)
+	if err == nil || !os.IsNotExist(err) {
+		debugReturn(err)
+		return err
+	}
+	err = writeFileAtomic(file, []byte(backupTime.Format(time.RFC3339)+"\n"))
+
+	debugReturn(err)
+	return err
+}
+
+// return when exports started writing manifests, or the zero time if none
+// has yet
+func manifestEraStart() (time.Time, error) {
+	file := filepath.Join(Config.SMB.LocalPath, manifestEraFileName)
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	return t, nil
+}
+
+func readManifest(backupName string) (*Manifest, error) {
+	return readManifestFile(filepath.Join(Config.SMB.LocalPath, backupName, manifestFileName))
+}
+
+func readManifestFile(file string) (*Manifest, error) {
+	manifestJSON, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	err = json.Unmarshal(manifestJSON, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	return &manifest, nil
+}
+
+type BackupStatus string
+
+const (
+	BackupComplete   BackupStatus = "complete"
+	BackupFailed     BackupStatus = "failed"
+	BackupInProgress BackupStatus = "in progress"
+	// from before we wrote manifests. These are counted as complete, since
+	// failed and interrupted exports were already marked. Only folders older
+	// than the first manifest (see manifestEraFileName) can be unverified.
+	BackupUnverified BackupStatus = "unverified"
+)
+
+// a folder that looks like a backup
+type BackupFolder struct {
+	Name string
+	// the VM's name when the backup was made
+	VMName string
+	// from the manifest (or job, if it is still running). Empty for failed
+	// backups and ones from before manifests.
+	VMUUID string
+	Time   time.Time
+	Status BackupStatus
+	// why it failed, if it did
+	FailReason string
+}
+
+// return true if this backup can be restored from and counts towards the
+// schedule
+func (b BackupFolder) Usable() bool {
+	return b.Status == BackupComplete || b.Status == BackupUnverified
+}
+
+// list every folder under LocalPath named like a backup, newest first
+func BackupFolders() ([]BackupFolder, error) {
+	debugReturn := DebugCall()
+
+	entries, err := os.ReadDir(Config.SMB.LocalPath)
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+
+	jobs, err := loadJobs()
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+
+	eraStart, err := manifestEraStart()
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+
+	var folders []BackupFolder
+	var missingManifests []int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t, name, err := parseDateTime(entry.Name())
+		if err != nil {
+			continue
+		}
+		folder := BackupFolder{
+			Name:   entry.Name(),
+			VMName: name,
+			Time:   t,
+		}
+
+		folderPath := filepath.Join(Config.SMB.LocalPath, entry.Name())
+		_, manifestErr := os.Stat(filepath.Join(folderPath, manifestFileName))
+		reason, failedErr := os.ReadFile(filepath.Join(folderPath, failedMarkerName))
+		job, running := jobs[entry.Name()]
+		switch {
+		case running:
+			folder.Status = BackupInProgress
+			folder.VMUUID = job.VMUUID
+		case failedErr == nil:
+			folder.Status = BackupFailed
+			folder.FailReason = strings.TrimSpace(string(reason))
+		case manifestErr == nil:
+			folder.Status = BackupComplete
+			// a damaged manifest still means the export finished, we just
+			// can't tell which VM it was of
+			manifest, err := readManifest(entry.Name())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read manifest: %s\n", err)
+			} else {
+				folder.VMUUID = manifest.VMUUID
+			}
+		case errors.Is(manifestErr, os.ErrNotExist):
+			// decided below, once we know when manifests started
+			missingManifests = append(missingManifests, len(folders))
+		default:
+			debugReturn(nil, manifestErr)
+			return nil, manifestErr
+		}
+		if folder.Status == BackupComplete && (eraStart.IsZero() || t.Before(eraStart)) {
+			eraStart = t
+		}
+		folders = append(folders, folder)
+	}
+
+	// anything without a manifest from after the first one was written is
+	// an export that died before it could be marked (or before its job was
+	// recorded)
+	for _, i := range missingManifests {
+		if eraStart.IsZero() || folders[i].Time.Before(eraStart) {
+			folders[i].Status = BackupUnverified
+		} else {
+			folders[i].Status = BackupFailed
+			folders[i].FailReason = "no manifest, the export did not finish"
+		}
+	}
+
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Time.After(folders[j].Time)
+	})
+
+	debugReturn(folders, nil)
+	return folders, nil
+}
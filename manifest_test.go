@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupWritesManifest(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+
+	err := Backup(context.Background(), "web01", "manual web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest("manual web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.VMUUID != vm.UUID || manifest.TaskTag == "" {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+	if manifest.Finished.Before(manifest.Started) || manifest.Started.IsZero() {
+		t.Errorf("bad start/finish times: %s, %s", manifest.Started, manifest.Finished)
+	}
+	if len(manifest.Disks) != 1 || manifest.Disks[0].UUID != vm.BlockDevs[0].UUID {
+		t.Errorf("expected the VM's disk in the manifest, got %+v", manifest.Disks)
+	}
+	files := make(map[string]int64)
+	for _, file := range manifest.Files {
+		files[file.Name] = file.Size
+	}
+	image := vm.BlockDevs[0].UUID + ".qcow2"
+	if len(files) != 2 || files["web01.xml"] == 0 || files[image] == 0 {
+		t.Errorf("expected the XML file and disk image, got %v", files)
+	}
+	if manifest.Size != uint64(files[image]) {
+		t.Errorf("expected size %d, got %d", files[image], manifest.Size)
+	}
+	if manifest.ToolVersion == "" {
+		t.Error("tool version not set")
+	}
+}
+
+func TestBackupFolders(t *testing.T) {
+	const day = 24 * time.Hour
+	setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {1 * day, 2 * day, 3 * day, 4 * day, 5 * day},
+	})
+	name := func(age time.Duration) string {
+		return DateTimePrefix(clock.Now().Add(-age), "web01")
+	}
+	err := os.WriteFile(filepath.Join(Config.SMB.LocalPath, name(4*day), manifestFileName), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = markBackupFailed(name(2*day), "disk full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveJob(Job{VMName: "web01", BackupName: name(1 * day), PID: os.Getpid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folders, err := BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 3 day old backup has no manifest, but came after one that did
+	want := []BackupStatus{BackupInProgress, BackupFailed, BackupFailed, BackupComplete, BackupUnverified}
+	if len(folders) != len(want) {
+		t.Fatalf("expected %d folders, got %+v", len(want), folders)
+	}
+	for i, folder := range folders {
+		if folder.Status != want[i] {
+			t.Errorf("%s is %s, want %s", folder.Name, folder.Status, want[i])
+		}
+	}
+	if folders[1].FailReason != "disk full" {
+		t.Errorf("expected fail reason, got %q", folders[1].FailReason)
+	}
+
+	// only complete and unverified backups count
+	ages := backupAges(t)
+	if len(ages["web01"]) != 2 || ages["web01"][0] != 4*day {
+		t.Errorf("expected the 4 and 5 day old backups, got %v", ages["web01"])
+	}
+}
+
+func TestManifestEra(t *testing.T) {
+	const day = 24 * time.Hour
+	setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {1 * day, 2 * day},
+	})
+
+	// no export has written a manifest yet, so these are from before
+	folders, err := BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range folders {
+		if folder.Status != BackupUnverified {
+			t.Errorf("%s is %s, want unverified", folder.Name, folder.Status)
+		}
+	}
+
+	// an export started a day and a half ago, and died without a trace
+	err = startManifestEra(clock.Now().Add(-36 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// later exports don't move the start
+	err = startManifestEra(clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders, err = BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 2 || folders[0].Status != BackupFailed || folders[1].Status != BackupUnverified {
+		t.Errorf("expected the newer backup to be failed, got %+v", folders)
+	}
+}
+
+func TestCleanupFailedBackups(t *testing.T) {
+	const day = 24 * time.Hour
+	setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.MaxBackups = 5
+	makeBackups(t, map[string][]time.Duration{
+		"web01": {1 * day, 2 * day, 3 * day},
+	})
+	name := func(age time.Duration) string {
+		return DateTimePrefix(clock.Now().Add(-age), "web01")
+	}
+	// one failure before the last good backup, and one after
+	for _, age := range []time.Duration{1 * day, 3 * day} {
+		err := markBackupFailed(name(age), "export failed")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders, err := BackupFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 2 || folders[0].Name != name(1*day) || folders[1].Name != name(2*day) {
+		t.Errorf("expected only the older failed backup to be deleted, got %+v", folders)
+	}
+}
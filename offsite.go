@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Backups are copied to the [Offsite] bucket under
+// Prefix/<VM UUID>/<backup name>/<file>. The manifest is uploaded last, so
+// a copy without one is partial.
+
+// the client for the [Offsite] bucket, or nil if it isn't configured. It is
+// set up after the config has been loaded and validated.
+var Offsite *S3Client
+
+const defaultPartSize = "64MB"
+
+// S3 limits for multipart uploads
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// multipart uploads we have started are kept in this file under LocalPath,
+// so they can be resumed
+const offsiteStateFileName = ".scale-backup-offsite.json"
+
+// check Config.Offsite, filling in defaults
+func validateOffsite() error {
+	if Config.Offsite.Endpoint == "" {
+		return errors.New("Endpoint not set")
+	}
+	endpoint, err := url.Parse(Config.Offsite.Endpoint)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return errors.New("Endpoint must be a http:// or https:// URL")
+	}
+	if Config.Offsite.Bucket == "" {
+		return errors.New("Bucket not set")
+	}
+	if Config.Offsite.AccessKey == "" {
+		return errors.New("AccessKey not set")
+	}
+	if Config.Offsite.SecretKey == "" {
+		return errors.New("SecretKey not set")
+	}
+	if Config.Offsite.Region == "" {
+		Config.Offsite.Region = "us-east-1"
+	}
+
+	// keys are always Prefix + VM UUID, so make sure there is a slash
+	// between them
+	prefix := strings.TrimPrefix(Config.Offsite.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	Config.Offsite.Prefix = prefix
+
+	if Config.Offsite.PartSize == "" {
+		Config.Offsite.PartSize = defaultPartSize
+	}
+	partSize, err := humanize.ParseBytes(Config.Offsite.PartSize)
+	if err != nil {
+		return errors.New("PartSize is not a valid size")
+	}
+	if partSize < minPartSize {
+		return errors.New("PartSize must be at least 5MiB")
+	}
+
+	return Config.Offsite.validate("Offsite")
+}
+
+// build a client from the global config
+func NewOffsiteClient() (*S3Client, error) {
+	endpoint, err := url.Parse(Config.Offsite.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Client{
+		Endpoint:     *endpoint,
+		Region:       Config.Offsite.Region,
+		Bucket:       Config.Offsite.Bucket,
+		AccessKey:    Config.Offsite.AccessKey,
+		SecretKey:    Config.Offsite.SecretKey,
+		HTTP:         &http.Client{},
+		MaxRetries:   4,
+		RetryBackoff: 2 * time.Second,
+	}, nil
+}
+
+// return the part size to upload a file of this size with. It has to grow
+// for very large files, since S3 only allows 10,000 parts.
+func offsitePartSize(fileSize int64) int64 {
+	partSize, err := humanize.ParseBytes(Config.Offsite.PartSize)
+	if err != nil || partSize == 0 {
+		partSize, _ = humanize.ParseBytes(defaultPartSize)
+	}
+	size := int64(partSize)
+	if fileSize > size*maxParts {
+		size = (fileSize + maxParts - 1) / maxParts
+	}
+	return size
+}
+
+func offsiteKey(vmUUID, backupName, file string) string {
+	return Config.Offsite.Prefix + vmUUID + "/" + backupName + "/" + file
+}
+
+// a multipart upload we started, so it can be picked back up
+type offsiteUpload struct {
+	UploadID string
+	PartSize int64
+	// of the whole file, so we can tell if it changed
+	SHA256 string
+}
+
+var offsiteMutex sync.Mutex
+
+func offsiteStateFile() string {
+	return filepath.Join(Config.SMB.LocalPath, offsiteStateFileName)
+}
+
+// return unfinished multipart uploads, keyed by object key
+func loadOffsiteUploads() (map[string]offsiteUpload, error) {
+	uploads := make(map[string]offsiteUpload)
+	stateJSON, err := os.ReadFile(offsiteStateFile())
+	if os.IsNotExist(err) {
+		return uploads, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stateJSON, &uploads)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", offsiteStateFile(), err)
+	}
+	return uploads, nil
+}
+
+// remember (or with a nil upload, forget) a multipart upload
+func saveOffsiteUpload(key string, upload *offsiteUpload) error {
+	offsiteMutex.Lock()
+	defer offsiteMutex.Unlock()
+	lock, err := lockStateFile(offsiteStateFile())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	uploads, err := loadOffsiteUploads()
+	if err != nil {
+		return err
+	}
+	if upload == nil {
+		delete(uploads, key)
+	} else {
+		uploads[key] = *upload
+	}
+	stateJSON, err := json.MarshalIndent(uploads, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(offsiteStateFile(), stateJSON)
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upload a file unless the bucket already has an identical copy. Large
+// files are uploaded in parts, picking up where a previous attempt left
+// off. The SHA-256 of the file is stored with it so downloads can be
+// checked.
+func uploadFile(ctx context.Context, file, key string) error {
+	debugReturn := DebugCall(file, key)
+
+	info, err := os.Stat(file)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	hash, err := fileSHA256(file)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	existing, err := Offsite.HeadObject(ctx, key)
+	if err == nil && existing.Size == info.Size() && existing.Meta["sha256"] == hash {
+		debugReturn(nil)
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrS3NotFound) {
+		debugReturn(err)
+		return err
+	}
+
+	meta := map[string]string{"sha256": hash}
+	partSize := offsitePartSize(info.Size())
+	if info.Size() <= partSize {
+		var data []byte
+		data, err = os.ReadFile(file)
+		if err == nil {
+			err = Offsite.PutObject(ctx, key, data, meta)
+		}
+	} else {
+		err = uploadMultipart(ctx, file, key, info.Size(), partSize, meta)
+	}
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	// make sure the bucket ended up with the whole file
+	uploaded, err := Offsite.HeadObject(ctx, key)
+	if err == nil && (uploaded.Size != info.Size() || uploaded.Meta["sha256"] != hash) {
+		err = fmt.Errorf("%s does not match %s after upload", key, file)
+	}
+
+	debugReturn(err)
+	return err
+}
+
+func uploadMultipart(ctx context.Context, file, key string, size, partSize int64, meta map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	uploads, err := loadOffsiteUploads()
+	if err != nil {
+		return err
+	}
+
+	// parts the server already has from an earlier attempt
+	done := make(map[int]S3Part)
+	upload, resuming := uploads[key]
+	if resuming && (upload.SHA256 != meta["sha256"] || upload.PartSize != partSize) {
+		// the file changed since, so start over
+		Offsite.AbortMultipartUpload(ctx, key, upload.UploadID)
+		resuming = false
+	}
+	if resuming {
+		parts, err := Offsite.ListParts(ctx, key, upload.UploadID)
+		if errors.Is(err, ErrS3NotFound) {
+			// the server aborted it (ex: a lifecycle rule)
+			resuming = false
+		} else if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			done[part.PartNumber] = part
+		}
+	}
+	if !resuming {
+		uploadID, err := Offsite.CreateMultipartUpload(ctx, key, meta)
+		if err != nil {
+			return err
+		}
+		upload = offsiteUpload{
+			UploadID: uploadID,
+			PartSize: partSize,
+			SHA256:   meta["sha256"],
+		}
+		err = saveOffsiteUpload(key, &upload)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, partSize)
+	var parts []S3Part
+	var sums [][]byte
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+partSize {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		data := buf[:length]
+		_, err := f.ReadAt(data, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && offset+length == size) {
+			return err
+		}
+		sum := md5.Sum(data)
+		etag := hex.EncodeToString(sum[:])
+		if part, exists := done[number]; !exists || part.ETag != etag || part.Size != length {
+			etag, err = Offsite.UploadPart(ctx, key, upload.UploadID, number, data)
+			if err != nil {
+				return err
+			}
+		}
+		parts = append(parts, S3Part{PartNumber: number, ETag: etag, Size: length})
+		sums = append(sums, sum[:])
+	}
+
+	etag, err := Offsite.CompleteMultipartUpload(ctx, key, upload.UploadID, parts)
+	if err != nil {
+		return err
+	}
+	if etag != multipartETag(sums) {
+		return fmt.Errorf("S3 upload of %s: checksum mismatch (ETag %s)", key, etag)
+	}
+	return saveOffsiteUpload(key, nil)
+}
+
+// make sure only one process uploads, downloads, or deletes an offsite
+// copy of a backup at a time
+func LockOffsite(backupName, command string) (*Lock, error) {
+	folder := filepath.Join(Config.SMB.LocalPath, vmLocksFolderName)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(folder, "offsite "+backupName+".lock")
+	return acquireLock(file, "offsite copy of "+backupName, command)
+}
+
+// copy a complete backup to the offsite bucket. Files already there are
+// skipped, so an interrupted upload can be picked back up.
+func uploadBackup(ctx context.Context, backupName string) error {
+	debugReturn := DebugCall(backupName)
+
+	manifest, err := readManifest(backupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	if manifest.VMUUID == "" {
+		err := fmt.Errorf("the manifest for %s has no VM UUID", backupName)
+		debugReturn(err)
+		return err
+	}
+
+	lock, err := LockOffsite(backupName, "upload "+backupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	fmt.Printf("Uploading %s offsite\n", backupName)
+	folder := filepath.Join(Config.SMB.LocalPath, backupName)
+	for _, file := range manifest.Files {
+		err = uploadFile(
+			ctx,
+			filepath.Join(folder, filepath.FromSlash(file.Name)),
+			offsiteKey(manifest.VMUUID, backupName, file.Name),
+		)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+	}
+	// the manifest goes last, so the copy only looks complete once it is
+	err = uploadFile(
+		ctx,
+		filepath.Join(folder, manifestFileName),
+		offsiteKey(manifest.VMUUID, backupName, manifestFileName),
+	)
+
+	debugReturn(err)
+	return err
+}
+
+// a backup in the offsite bucket
+type OffsiteBackup struct {
+	Name   string
+	VMName string
+	VMUUID string
+	Time   time.Time
+	// false until the manifest (which goes last) is uploaded
+	Complete bool
+	Size     int64
+	Objects  []S3Object
+}
+
+// list the backups in the offsite bucket, newest first
+func OffsiteBackups(ctx context.Context) ([]OffsiteBackup, error) {
+	debugReturn := DebugCall()
+
+	objects, err := Offsite.ListObjects(ctx, Config.Offsite.Prefix)
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+
+	byKey := make(map[string]*OffsiteBackup)
+	var backups []*OffsiteBackup
+	for _, object := range objects {
+		rel := strings.TrimPrefix(object.Key, Config.Offsite.Prefix)
+		parts := strings.SplitN(rel, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		t, vmName, err := parseDateTime(parts[1])
+		if err != nil {
+			continue
+		}
+		prefix := parts[0] + "/" + parts[1]
+		backup, exists := byKey[prefix]
+		if !exists {
+			backup = &OffsiteBackup{
+				Name:   parts[1],
+				VMName: vmName,
+				VMUUID: parts[0],
+				Time:   t,
+			}
+			byKey[prefix] = backup
+			backups = append(backups, backup)
+		}
+		if parts[2] == manifestFileName {
+			backup.Complete = true
+		}
+		backup.Size += object.Size
+		backup.Objects = append(backup.Objects, object)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	var list []OffsiteBackup
+	for _, backup := range backups {
+		list = append(list, *backup)
+	}
+
+	debugReturn(len(list), nil)
+	return list, nil
+}
+
+// return true if key is a backup's manifest
+func isManifestKey(key string) bool {
+	return strings.HasSuffix(key, "/"+manifestFileName)
+}
+
+// return a copy of a backup's objects with the manifest moved to the front,
+// or with manifestLast, to the back. Everything else keeps its order.
+func orderObjects(objects []S3Object, manifestLast bool) []S3Object {
+	ordered := append([]S3Object(nil), objects...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if manifestLast {
+			return !isManifestKey(ordered[i].Key) && isManifestKey(ordered[j].Key)
+		}
+		return isManifestKey(ordered[i].Key) && !isManifestKey(ordered[j].Key)
+	})
+	return ordered
+}
+
+// delete an offsite copy, manifest first so it never looks complete when
+// it isn't
+func deleteOffsite(ctx context.Context, backup OffsiteBackup) error {
+	debugReturn := DebugCall(backup.Name)
+
+	lock, err := LockOffsite(backup.Name, "delete offsite "+backup.Name)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	objects := orderObjects(backup.Objects, false)
+	for _, object := range objects {
+		err := Offsite.DeleteObject(ctx, object.Key)
+		if err != nil && !errors.Is(err, ErrS3NotFound) {
+			debugReturn(err)
+			return err
+		}
+	}
+
+	// along with any upload of it we didn't finish
+	uploads, err := loadOffsiteUploads()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	for key, upload := range uploads {
+		if !strings.HasPrefix(key, offsiteKey(backup.VMUUID, backup.Name, "")) {
+			continue
+		}
+		Offsite.AbortMultipartUpload(ctx, key, upload.UploadID)
+		err = saveOffsiteUpload(key, nil)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+	}
+
+	debugReturn(nil)
+	return nil
+}
+
+type offsiteDeletion struct {
+	Backup OffsiteBackup
+	Reason string
+}
+
+type offsitePlan struct {
+	Uploads   []BackupFolder
+	Deletions []offsiteDeletion
+}
+
+// work out what to upload and what to delete so the bucket has what the
+// Offsite retention rules keep (see planCopies)
+func planOffsite(ctx context.Context) (*offsitePlan, error) {
+	folders, err := BackupFolders()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := OffsiteBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []backupCopy
+	for _, backup := range remote {
+		copies = append(copies, backupCopy{
+			Name:     backup.Name,
+			VMUUID:   backup.VMUUID,
+			Time:     backup.Time,
+			Complete: backup.Complete,
+		})
+	}
+	uploads, deletions := planCopies(Config.Offsite.policy("Offsite"), folders, copies)
+
+	plan := &offsitePlan{Uploads: uploads}
+	for _, deletion := range deletions {
+		plan.Deletions = append(plan.Deletions, offsiteDeletion{
+			Backup: remote[deletion.Index],
+			Reason: deletion.Reason,
+		})
+	}
+	return plan, nil
+}
+
+// upload backups the Offsite retention rules keep and delete offsite copies
+// they don't. With --dry-run it only says what it would do. If a VM's
+// upload fails, its offsite copies aren't deleted this time. Failures are
+// returned together once everything else has been tried.
+func SyncOffsite(ctx context.Context) error {
+	debugReturn := DebugCall()
+
+	plan, err := planOffsite(ctx)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	if dryRun {
+		for _, folder := range plan.Uploads {
+			fmt.Printf("Would upload %s offsite\n", folder.Name)
+		}
+		for _, deletion := range plan.Deletions {
+			fmt.Printf("Would delete offsite copy of %s: %s\n", deletion.Backup.Name, deletion.Reason)
+		}
+		if len(plan.Uploads) == 0 && len(plan.Deletions) == 0 {
+			fmt.Println("Offsite copies are up to date")
+		}
+		debugReturn(nil)
+		return nil
+	}
+
+	var failures []string
+	failedVMs := make(map[string]bool)
+	for _, folder := range plan.Uploads {
+		err := uploadBackup(ctx, folder.Name)
+		if ctx.Err() != nil {
+			debugReturn(ctx.Err())
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to upload %s offsite: %s\n", folder.Name, err)
+			failures = append(failures, fmt.Sprintf("upload of %s: %s", folder.Name, err))
+			failedVMs[folder.VMUUID] = true
+		}
+	}
+	for _, deletion := range plan.Deletions {
+		backup := deletion.Backup
+		if failedVMs[backup.VMUUID] {
+			fmt.Printf("Keeping offsite copy of %s until %s uploads\n", backup.Name, backup.VMName)
+			continue
+		}
+		fmt.Printf("Deleting offsite copy of %s: %s\n", backup.Name, deletion.Reason)
+		err := deleteOffsite(ctx, backup)
+		if ctx.Err() != nil {
+			debugReturn(ctx.Err())
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete offsite copy of %s: %s\n", backup.Name, err)
+			failures = append(failures, fmt.Sprintf("deletion of %s: %s", backup.Name, err))
+		}
+	}
+
+	if len(failures) != 0 {
+		err = fmt.Errorf("%d offsite operations failed:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	debugReturn(err)
+	return err
+}
+
+// download a file, checking it against the SHA-256 stored with it. A local
+// file that already matches is left alone, so an interrupted download can
+// be picked back up.
+func downloadFile(ctx context.Context, key, file string) error {
+	debugReturn := DebugCall(key, file)
+
+	object, err := Offsite.HeadObject(ctx, key)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	want := object.Meta["sha256"]
+	if info, err := os.Stat(file); err == nil && info.Size() == object.Size {
+		if hash, err := fileSHA256(file); err == nil && hash == want {
+			debugReturn(nil)
+			return nil
+		}
+	}
+
+	body, object, err := Offsite.GetObject(ctx, key)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer body.Close()
+	tmpFile := file + ".part"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if err == nil && (size != object.Size || (want != "" && hash != want)) {
+		err = fmt.Errorf("download of %s is corrupt (SHA-256 %s, expected %s)", key, hash, want)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		debugReturn(err)
+		return err
+	}
+	err = os.Rename(tmpFile, file)
+
+	debugReturn(err)
+	return err
+}
+
+// copy a backup from the offsite bucket back into LocalPath, so it can be
+// restored. The manifest is downloaded last, so an interrupted download
+// doesn't look like a complete backup.
+func FetchOffsite(ctx context.Context, backupName string) error {
+	debugReturn := DebugCall(backupName)
+
+	backups, err := OffsiteBackups(ctx)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	var backup *OffsiteBackup
+	for i := range backups {
+		if backups[i].Name == backupName && backups[i].Complete {
+			backup = &backups[i]
+			break
+		}
+	}
+	if backup == nil {
+		err := fmt.Errorf("%s has no complete offsite copy", backupName)
+		debugReturn(err)
+		return err
+	}
+
+	lock, err := LockOffsite(backupName, "fetch "+backupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	fmt.Printf("Downloading %s (%s) from offsite\n", backupName, humanize.Bytes(uint64(backup.Size)))
+	folder := filepath.Join(Config.SMB.LocalPath, backupName)
+	prefix := offsiteKey(backup.VMUUID, backupName, "")
+	objects := orderObjects(backup.Objects, true)
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, prefix)
+		file := filepath.Join(folder, filepath.FromSlash(name))
+		// keep keys like "../x" from escaping the backup folder
+		if !strings.HasPrefix(file, folder+string(filepath.Separator)) {
+			err := fmt.Errorf("refusing to download %s outside of %s", object.Key, folder)
+			debugReturn(err)
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+		err = downloadFile(ctx, object.Key, file)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+	}
+
+	debugReturn(nil)
+	return nil
+}
+
+// list offsite backups grouped by VM
+func ShowOffsite(ctx context.Context) {
+	DebugCall()
+
+	if !OffsiteConfigured() {
+		fmt.Fprintln(os.Stderr, "Offsite copies are not configured")
+		return
+	}
+	backups, err := OffsiteBackups(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	folders, err := BackupFolders()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	local := make(map[string]bool)
+	for _, folder := range folders {
+		if folder.Usable() {
+			local[folder.Name] = true
+		}
+	}
+
+	// group by VM, listing each VM under the name of its newest backup
+	type vmBackups struct {
+		Name    string
+		UUID    string
+		Backups []OffsiteBackup
+	}
+	byUUID := make(map[string]*vmBackups)
+	var vms []*vmBackups
+	for _, backup := range backups {
+		vm, exists := byUUID[backup.VMUUID]
+		if !exists {
+			vm = &vmBackups{Name: backup.VMName, UUID: backup.VMUUID}
+			byUUID[backup.VMUUID] = vm
+			vms = append(vms, vm)
+		}
+		vm.Backups = append(vm.Backups, backup)
+	}
+	sort.SliceStable(vms, func(i, j int) bool {
+		return vms[i].Name < vms[j].Name
+	})
+
+	for _, vm := range vms {
+		fmt.Printf("%s (UUID %s)\n", vm.Name, vm.UUID)
+		for _, backup := range vm.Backups {
+			var mark string
+			switch {
+			case !backup.Complete:
+				mark = " partial upload"
+			case !local[backup.Name]:
+				mark = " offsite only"
+			}
+			if backup.VMName != vm.Name {
+				mark += " (as " + backup.VMName + ")"
+			}
+			fmt.Printf(
+				"\t%s (%s)%s\n",
+				backup.Time.Format("2006-01-02 03:04 PM"),
+				humanize.Bytes(uint64(backup.Size)),
+				mark,
+			)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the names of the complete offsite backups, newest first
+func offsiteNames(t *testing.T) []string {
+	backups, err := OffsiteBackups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, backup := range backups {
+		if backup.Complete {
+			names = append(names, backup.Name)
+		}
+	}
+	return names
+}
+
+func countRequests(requests []string, prefix string) int {
+	count := 0
+	for _, request := range requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestOffsiteSync(t *testing.T) {
+	const day = 24 * time.Hour
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	s3 := setupFakeS3(t)
+	Config.Offsite.MaxBackups = 2
+	vm := fake.AddVM("web01")
+
+	var names []string
+	for _, age := range []time.Duration{3 * day, 2 * day, 1 * day} {
+		name := DateTimePrefix(clock.Now().Add(-age), "web01")
+		names = append(names, name)
+		err := Backup(ctx, "web01", name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := SyncOffsite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the oldest would be deleted right away, so it isn't uploaded
+	got := offsiteNames(t)
+	if len(got) != 2 || got[0] != names[2] || got[1] != names[1] {
+		t.Fatalf("expected %v offsite, got %v", []string{names[2], names[1]}, got)
+	}
+	manifest, err := readManifest(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range manifest.Files {
+		local, err := os.ReadFile(filepath.Join(Config.SMB.LocalPath, names[2], file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s3.Object(offsiteKey(vm.UUID, names[2], file.Name)), local) {
+			t.Errorf("offsite copy of %s does not match", file.Name)
+		}
+	}
+
+	name := DateTimePrefix(clock.Now(), "web01")
+	names = append(names, name)
+	err = Backup(ctx, "web01", name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run changes nothing
+	before := len(s3.Requests())
+	dryRun = true
+	err = SyncOffsite(ctx)
+	dryRun = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range s3.Requests()[before:] {
+		if !strings.HasPrefix(request, "ListObjectsV2") {
+			t.Errorf("dry run sent %s", request)
+		}
+	}
+
+	before = len(s3.Requests())
+	err = SyncOffsite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = offsiteNames(t)
+	if len(got) != 2 || got[0] != names[3] || got[1] != names[2] {
+		t.Fatalf("expected %v offsite, got %v", []string{names[3], names[2]}, got)
+	}
+	for _, key := range s3.Keys() {
+		if strings.Contains(key, names[1]) {
+			t.Errorf("%s should have been deleted", key)
+		}
+	}
+	// only the new backup is uploaded
+	for _, request := range s3.Requests()[before:] {
+		if strings.HasPrefix(request, "PUT") && !strings.Contains(request, names[3]) {
+			t.Errorf("unexpected upload: %s", request)
+		}
+	}
+}
+
+func TestOffsiteMultipartResume(t *testing.T) {
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	s3 := setupFakeS3(t)
+	// smaller than S3 allows, so the test doesn't need megabytes
+	Config.Offsite.PartSize = "4KB"
+	vm := fake.AddVM("web01")
+
+	name := DateTimePrefix(clock.Now(), "web01")
+	err := os.Mkdir(filepath.Join(Config.SMB.LocalPath, name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := make([]byte, 10000)
+	for i := range disk {
+		disk[i] = byte(i % 251)
+	}
+	err = os.WriteFile(filepath.Join(Config.SMB.LocalPath, name, "disk.qcow2"), disk, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(Manifest{VMName: "web01", VMUUID: vm.UUID, BackupName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := offsiteKey(vm.UUID, name, "disk.qcow2")
+
+	s3.FailPartsAfter(1)
+	err = uploadBackup(ctx, name)
+	if err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	uploads, err := loadOffsiteUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := uploads[key]; !exists {
+		t.Fatal("the unfinished upload was not saved")
+	}
+	if len(offsiteNames(t)) != 0 {
+		t.Fatal("a partial upload should not look complete")
+	}
+
+	s3.FailPartsAfter(-1)
+	before := len(s3.Requests())
+	err = uploadBackup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// part 1 made it the first time
+	parts := countRequests(s3.Requests()[before:], "UploadPart")
+	if parts != 2 {
+		t.Errorf("expected 2 parts to be uploaded when resuming, got %d", parts)
+	}
+	if !bytes.Equal(s3.Object(key), disk) {
+		t.Error("offsite copy does not match")
+	}
+	uploads, err = loadOffsiteUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 0 {
+		t.Errorf("finished upload should be forgotten: %v", uploads)
+	}
+	if got := offsiteNames(t); len(got) != 1 || got[0] != name {
+		t.Errorf("expected %s offsite, got %v", name, got)
+	}
+}
+
+func TestOffsiteFetch(t *testing.T) {
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	s3 := setupFakeS3(t)
+	vm := fake.AddVM("web01")
+	name := DateTimePrefix(clock.Now(), "web01")
+	err := Backup(ctx, "web01", name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadBackup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder := filepath.Join(Config.SMB.LocalPath, name)
+	files := make(map[string][]byte)
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		files[entry.Name()], err = os.ReadFile(filepath.Join(folder, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.RemoveAll(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restoring a backup we only have offsite downloads it first
+	Restore(ctx, name, "web01-restored")
+	if fake.VM("web01-restored") == nil {
+		t.Fatal("restored VM was not created")
+	}
+	for file, data := range files {
+		local, err := os.ReadFile(filepath.Join(folder, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(local, data) {
+			t.Errorf("downloaded %s does not match", file)
+		}
+	}
+
+	// a corrupt copy is caught, and doesn't look like a complete backup
+	err = os.RemoveAll(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := files[manifestFileName]
+	for file := range files {
+		if strings.HasSuffix(file, ".qcow2") {
+			s3.Corrupt(offsiteKey(vm.UUID, name, file))
+		}
+	}
+	err = FetchOffsite(ctx, name)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("expected a corrupt download error, got %v", err)
+	}
+	if manifest == nil {
+		t.Fatal("the backup had no manifest")
+	}
+	_, err = os.Stat(filepath.Join(folder, manifestFileName))
+	if !os.IsNotExist(err) {
+		t.Error("the manifest should not be downloaded when a file is corrupt")
+	}
+}
+
+func TestOrderObjects(t *testing.T) {
+	// enough objects that sort doesn't fall back to insertion sort
+	var objects []S3Object
+	for i := 0; i < 30; i++ {
+		objects = append(objects, S3Object{Key: fmt.Sprintf("vm/backup/disk%02d.qcow2", i)})
+	}
+	objects[12].Key = "vm/backup/" + manifestFileName
+
+	last := orderObjects(objects, true)
+	first := orderObjects(objects, false)
+	if !isManifestKey(last[len(last)-1].Key) {
+		t.Errorf("expected the manifest last, got %s", last[len(last)-1].Key)
+	}
+	if !isManifestKey(first[0].Key) {
+		t.Errorf("expected the manifest first, got %s", first[0].Key)
+	}
+	// everything else stays in order
+	for i := 1; i < len(first); i++ {
+		if i < len(last)-1 && last[i].Key < last[i-1].Key {
+			t.Errorf("%s came after %s", last[i].Key, last[i-1].Key)
+		}
+		if i > 1 && first[i].Key < first[i-1].Key {
+			t.Errorf("%s came after %s", first[i].Key, first[i-1].Key)
+		}
+	}
+	if !isManifestKey(objects[12].Key) {
+		t.Error("the original list should not be changed")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperjumptech/jiffy"
+)
+
+// Policy sets how often VMs matching VMName (a path.Match pattern) and/or
+// Tag are backed up and how long their backups are kept. If both are set,
+// both have to match. The first matching policy wins, and anything it
+// leaves unset comes from the [Schedule] section.
+type Policy struct {
+	Name           string
+	VMName         string
+	Tag            string
+	BackupInterval string
+	Tolerance      string
+	MaxBackups     int
+	MaxAge         string
+	KeepDaily      int
+	KeepWeekly     int
+	KeepMonthly    int
+	KeepYearly     int
+	// VMs with a higher Priority are backed up first, however overdue
+	// everything else is
+	Priority int
+}
+
+// the result of resolving a VM's policy against the [Schedule] section
+type BackupPolicy struct {
+	// "default" if no policy matched
+	Name      string
+	Interval  time.Duration
+	Tolerance time.Duration
+	// math.MaxInt64 if there is no limit
+	MaxBackups int
+	MaxAge     time.Duration
+	// grandfather-father-son retention, see applyRetention
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	Priority    int
+}
+
+// name of the policy VMs get when no [[Schedule.Policies]] match them
+const defaultPolicyName = "default"
+
+// return true if vmName matches pattern (if set) and tags include tag (if
+// set). tags is a comma separated list, the way Scale gives them to us.
+func vmMatches(pattern, tag, vmName, tags string) bool {
+	if pattern != "" {
+		matched, _ := path.Match(pattern, vmName)
+		if !matched {
+			return false
+		}
+	}
+	if tag != "" && !hasTag(tags, tag) {
+		return false
+	}
+	return true
+}
+
+func (p Policy) matches(vmName, tags string) bool {
+	return vmMatches(p.VMName, p.Tag, vmName, tags)
+}
+
+// parse a duration that was already validated with the config, returning
+// def if it is empty
+func configDuration(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := jiffy.DurationOf(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// work out the backup policy for a VM with the given name and tags. Backups
+// of VMs that no longer exist only have their name to go on, so pass ""
+// for their tags.
+func PolicyFor(vmName, tags string) BackupPolicy {
+	debugReturn := DebugCall(vmName, tags)
+
+	policy := Policy{
+		Name:           defaultPolicyName,
+		BackupInterval: Config.Schedule.BackupInterval,
+		Tolerance:      Config.Schedule.Tolerance,
+		MaxBackups:     Config.Schedule.MaxBackups,
+		MaxAge:         Config.Schedule.MaxAge,
+		KeepDaily:      Config.Schedule.KeepDaily,
+		KeepWeekly:     Config.Schedule.KeepWeekly,
+		KeepMonthly:    Config.Schedule.KeepMonthly,
+		KeepYearly:     Config.Schedule.KeepYearly,
+	}
+	for _, p := range Config.Schedule.Policies {
+		if !p.matches(vmName, tags) {
+			continue
+		}
+		policy.Name = p.Name
+		if p.BackupInterval != "" {
+			policy.BackupInterval = p.BackupInterval
+		}
+		if p.Tolerance != "" {
+			policy.Tolerance = p.Tolerance
+		}
+		if p.MaxBackups != 0 {
+			policy.MaxBackups = p.MaxBackups
+		}
+		if p.MaxAge != "" {
+			policy.MaxAge = p.MaxAge
+		}
+		if p.KeepDaily != 0 {
+			policy.KeepDaily = p.KeepDaily
+		}
+		if p.KeepWeekly != 0 {
+			policy.KeepWeekly = p.KeepWeekly
+		}
+		if p.KeepMonthly != 0 {
+			policy.KeepMonthly = p.KeepMonthly
+		}
+		if p.KeepYearly != 0 {
+			policy.KeepYearly = p.KeepYearly
+		}
+		policy.Priority = p.Priority
+		break
+	}
+
+	resolved := BackupPolicy{
+		Name:        policy.Name,
+		Interval:    configDuration(policy.BackupInterval, 0),
+		Tolerance:   configDuration(policy.Tolerance, 0),
+		MaxBackups:  math.MaxInt64,
+		MaxAge:      configDuration(policy.MaxAge, time.Duration(math.MaxInt64)),
+		KeepDaily:   policy.KeepDaily,
+		KeepWeekly:  policy.KeepWeekly,
+		KeepMonthly: policy.KeepMonthly,
+		KeepYearly:  policy.KeepYearly,
+		Priority:    policy.Priority,
+	}
+	if policy.MaxBackups != 0 {
+		resolved.MaxBackups = policy.MaxBackups
+	}
+
+	debugReturn(resolved)
+	return resolved
+}
+
+// VMs can be given a priority with a tag like "BackupPriority:10". This
+// takes precedence over the priority from their policy.
+const priorityTagPrefix = "BackupPriority:"
+
+// return the priority set by a VM's tags, if any
+func tagPriority(vmName, tags string) (priority int, ok bool) {
+	for _, tag := range strings.Split(tags, ",") {
+		value, found := strings.CutPrefix(strings.TrimSpace(tag), priorityTagPrefix)
+		if !found {
+			continue
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring tag %q on %s: priority is not a number\n", tag, vmName)
+			continue
+		}
+		return priority, true
+	}
+	return 0, false
+}
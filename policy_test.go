@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyFor(t *testing.T) {
+	const day = 24 * time.Hour
+	savedConfig := Config
+	t.Cleanup(func() { Config = savedConfig })
+
+	Config.Schedule.BackupInterval = "7 days"
+	Config.Schedule.Tolerance = "1 day"
+	Config.Schedule.MaxBackups = 4
+	Config.Schedule.MaxAge = ""
+	Config.Schedule.Policies = []Policy{
+		{
+			Name:           "dc",
+			Tag:            "DC",
+			BackupInterval: "1 day",
+			MaxAge:         "14 days",
+		},
+		{
+			Name:           "files",
+			VMName:         "fs*",
+			BackupInterval: "7 days",
+			MaxBackups:     13,
+			MaxAge:         "90 days",
+		},
+		{
+			// never reached for dc VMs since "dc" comes first
+			Name:       "dc-shadowed",
+			Tag:        "DC",
+			MaxBackups: 1,
+		},
+	}
+
+	tests := []struct {
+		vmName string
+		tags   string
+		want   BackupPolicy
+	}{
+		{
+			vmName: "web01",
+			want: BackupPolicy{
+				Name:       "default",
+				Interval:   7 * day,
+				Tolerance:  day,
+				MaxBackups: 4,
+				MaxAge:     time.Duration(math.MaxInt64),
+			},
+		},
+		{
+			vmName: "dc01",
+			tags:   "BackMeUp,DC",
+			want: BackupPolicy{
+				Name:       "dc",
+				Interval:   day,
+				Tolerance:  day,
+				MaxBackups: 4,
+				MaxAge:     14 * day,
+			},
+		},
+		{
+			vmName: "fs01",
+			tags:   "BackMeUp",
+			want: BackupPolicy{
+				Name:       "files",
+				Interval:   7 * day,
+				Tolerance:  day,
+				MaxBackups: 13,
+				MaxAge:     90 * day,
+			},
+		},
+		{
+			// the first match wins
+			vmName: "fs02",
+			tags:   "DC",
+			want: BackupPolicy{
+				Name:       "dc",
+				Interval:   day,
+				Tolerance:  day,
+				MaxBackups: 4,
+				MaxAge:     14 * day,
+			},
+		},
+	}
+	for _, test := range tests {
+		got := PolicyFor(test.vmName, test.tags)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("PolicyFor(%q, %q) = %+v, want %+v", test.vmName, test.tags, got, test.want)
+		}
+	}
+}
+
+func TestBackupQueuePolicies(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.Tag = "BackMeUp"
+	Config.Schedule.BackupInterval = "7 days"
+	Config.Schedule.Policies = []Policy{{
+		Name:           "dc",
+		Tag:            "DC",
+		BackupInterval: "1 day",
+	}}
+	fake.AddVM("dc01", "BackMeUp", "DC")
+	fake.AddVM("dc02", "BackMeUp", "DC")
+	fake.AddVM("fs01", "BackMeUp")
+	fake.AddVM("fs02", "BackMeUp")
+	makeBackups(t, map[string][]time.Duration{
+		"dc01": {2 * day},
+		"dc02": {day / 2},
+		"fs01": {2 * day},
+		"fs02": {10 * day},
+	})
+
+	queue, err := BackupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fs02 is 3 days overdue, dc01 is 1 day overdue
+	want := []string{"fs02", "dc01"}
+	if !reflect.DeepEqual(queue, want) {
+		t.Errorf("BackupQueue() = %v, want %v", queue, want)
+	}
+}
+
+func TestBackupQueuePriority(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.FailureBoost = 5
+	Config.Schedule.Policies = []Policy{{
+		Name:     "sql",
+		VMName:   "sql*",
+		Priority: 10,
+	}}
+	fake.AddVM("test01")
+	fake.AddVM("test02")
+	fake.AddVM("sql01")
+	fake.AddVM("web01", "BackupPriority:12")
+	fake.AddVM("web02", "BackupPriority:oops")
+	flaky := fake.AddVM("flaky")
+	makeBackups(t, map[string][]time.Duration{
+		"sql01": {2 * day},
+		"web01": {2 * day},
+		"web02": {3 * day},
+		"flaky": {2 * day},
+	})
+	recordFailure(flaky.UUID, "flaky", "flaky backup", errors.New("export failed"))
+
+	queue, err := backupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// VMs that were never backed up only go first within their priority
+	var got []string
+	for _, vm := range queue {
+		got = append(got, vm.Name)
+	}
+	want := []string{"web01", "sql01", "flaky", "test01", "test02", "web02"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backupQueue() = %v, want %v", got, want)
+	}
+	if queue[0].PriorityFrom != "tag" || queue[1].PriorityFrom != "sql policy" {
+		t.Errorf("unexpected priority sources: %q, %q", queue[0].PriorityFrom, queue[1].PriorityFrom)
+	}
+	if !queue[2].LastFailed || queue[2].Priority != 5 {
+		t.Errorf("flaky should have been boosted for failing: %+v", queue[2])
+	}
+
+	// a successful backup clears the boost
+	err = recordBackup(flaky.UUID, "flaky", BackupRecord{BackupName: "flaky backup 2", Duration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err = backupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := queue[len(queue)-1]; last.Name != "flaky" || last.LastFailed {
+		t.Errorf("flaky should be at the back of the queue now, got %+v", last)
+	}
+}
+
+func TestBackupQueueSmallest(t *testing.T) {
+	fake := setupFakeScale(t)
+	Config.Schedule.BackupInterval = "1 day"
+	Config.Schedule.Order = "smallest"
+	fake.AddVM("big").BlockDevs[0].Allocation = 100 << 30
+	fake.AddVM("small").BlockDevs[0].Allocation = 1 << 30
+	fake.AddVM("medium").BlockDevs[0].Allocation = 10 << 30
+	fake.AddVM("important", "BackupPriority:1").BlockDevs[0].Allocation = 500 << 30
+
+	queue, err := BackupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"important", "small", "medium", "big"}
+	if !reflect.DeepEqual(queue, want) {
+		t.Errorf("BackupQueue() = %v, want %v", queue, want)
+	}
+}
+
+func TestCleanupPolicies(t *testing.T) {
+	const day = 24 * time.Hour
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.MaxBackups = 0
+	Config.Schedule.MaxAge = "90 days"
+	Config.Schedule.Policies = []Policy{{
+		Name:   "dc",
+		Tag:    "DC",
+		MaxAge: "14 days",
+	}}
+	fake.AddVM("dc01", "DC")
+	fake.AddVM("fs01")
+	makeBackups(t, map[string][]time.Duration{
+		"dc01": {1 * day, 2 * day, 3 * day, 20 * day},
+		"fs01": {1 * day, 20 * day, 60 * day},
+	})
+
+	err := Cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]time.Duration{
+		"dc01": {1 * day, 2 * day, 3 * day},
+		"fs01": {1 * day, 20 * day, 60 * day},
+	}
+	if got := backupAges(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("backups after Cleanup() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A reader for the qcow2 images Scale exports, so they can be converted
+// without qemu-img. It handles what Scale writes (versions 2 and 3, zero
+// and compressed clusters) but not backing files, encryption, external data
+// files, or extended L2 entries, which it refuses.
+//
+// See https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+
+const qcow2Magic = "QFI\xfb"
+
+const (
+	// bits 9-55 of L1 and L2 entries
+	qcow2OffsetMask = 0x00fffffffffffe00
+	// L2 entry flags
+	qcow2Compressed = 1 << 62
+	qcow2ZeroFlag   = 1
+	// incompatible feature bits we can ignore. Dirty only means the
+	// refcounts may be wrong, and we don't read them.
+	qcow2DirtyBit = 1
+)
+
+type qcow2Image struct {
+	file        *os.File
+	Size        int64
+	clusterBits uint
+	l1          []uint64
+	// the last L2 table read, and where it came from
+	l2       []uint64
+	l2Offset uint64
+}
+
+func openQcow2(path string) (*qcow2Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	image, err := readQcow2Header(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return image, nil
+}
+
+func readQcow2Header(file *os.File) (*qcow2Image, error) {
+	header := make([]byte, 104)
+	_, err := io.ReadFull(file, header[:72])
+	if err != nil {
+		return nil, errors.New("not a qcow2 image (too short)")
+	}
+	if string(header[:4]) != qcow2Magic {
+		return nil, errors.New("not a qcow2 image")
+	}
+	be := binary.BigEndian
+	version := be.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("qcow2 version %d is not supported", version)
+	}
+	if be.Uint64(header[8:]) != 0 {
+		return nil, errors.New("qcow2 images with a backing file are not supported")
+	}
+	clusterBits := be.Uint32(header[20:])
+	if clusterBits < 9 || clusterBits > 21 {
+		return nil, fmt.Errorf("qcow2 cluster size 2^%d is not valid", clusterBits)
+	}
+	size := be.Uint64(header[24:])
+	if size > 1<<62 {
+		return nil, fmt.Errorf("qcow2 size %d is not valid", size)
+	}
+	if be.Uint32(header[32:]) != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	if version == 3 {
+		_, err = io.ReadFull(file, header[72:])
+		if err != nil {
+			return nil, errors.New("qcow2 header is truncated")
+		}
+		incompatible := be.Uint64(header[72:])
+		if incompatible&^qcow2DirtyBit != 0 {
+			// corrupt, external data file, compression other than
+			// deflate, extended L2 entries, or something newer
+			return nil, fmt.Errorf("qcow2 incompatible features %#x are not supported", incompatible)
+		}
+	}
+
+	l1Size := be.Uint32(header[36:])
+	l1Offset := be.Uint64(header[40:])
+	// enough L1 entries to cover the whole disk, and no more
+	clusterSize := uint64(1) << clusterBits
+	l2Entries := clusterSize / 8
+	if uint64(l1Size) < (size+clusterSize*l2Entries-1)/(clusterSize*l2Entries) || l1Size > 32<<20 {
+		return nil, fmt.Errorf("qcow2 L1 table size %d does not match the disk size", l1Size)
+	}
+	l1Bytes := make([]byte, 8*int(l1Size))
+	_, err = file.ReadAt(l1Bytes, int64(l1Offset))
+	if err != nil {
+		return nil, fmt.Errorf("error reading qcow2 L1 table: %w", err)
+	}
+	l1 := make([]uint64, l1Size)
+	for i := range l1 {
+		l1[i] = be.Uint64(l1Bytes[8*i:])
+	}
+
+	return &qcow2Image{
+		file:        file,
+		Size:        int64(size),
+		clusterBits: uint(clusterBits),
+		l1:          l1,
+	}, nil
+}
+
+func (q *qcow2Image) Close() error {
+	return q.file.Close()
+}
+
+// read the L2 table at offset, keeping it for next time
+func (q *qcow2Image) l2Table(offset uint64) ([]uint64, error) {
+	if q.l2 != nil && q.l2Offset == offset {
+		return q.l2, nil
+	}
+	table := make([]byte, 1<<q.clusterBits)
+	_, err := q.file.ReadAt(table, int64(offset))
+	if err != nil {
+		return nil, fmt.Errorf("error reading qcow2 L2 table: %w", err)
+	}
+	l2 := make([]uint64, len(table)/8)
+	for i := range l2 {
+		l2[i] = binary.BigEndian.Uint64(table[8*i:])
+	}
+	q.l2 = l2
+	q.l2Offset = offset
+	return l2, nil
+}
+
+// fill p with the part of a cluster at offset within it. entry is the
+// cluster's L2 entry.
+func (q *qcow2Image) readCluster(p []byte, entry uint64, offset int64) error {
+	clusterSize := 1 << q.clusterBits
+	if entry&qcow2Compressed != 0 {
+		// the offset and size share the rest of the entry, where the
+		// split depends on the cluster size
+		sizeShift := 62 - (q.clusterBits - 8)
+		hostOffset := entry & (1<<sizeShift - 1)
+		sectors := (entry>>sizeShift)&(1<<(q.clusterBits-8)-1) + 1
+		compressed := make([]byte, sectors*512-hostOffset%512)
+		n, err := q.file.ReadAt(compressed, int64(hostOffset))
+		// the last compressed cluster can end before the sectors do
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		cluster := make([]byte, clusterSize)
+		_, err = io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), cluster)
+		if err != nil {
+			return fmt.Errorf("qcow2 compressed cluster at %d is corrupt: %w", hostOffset, err)
+		}
+		copy(p, cluster[offset:])
+		return nil
+	}
+
+	hostOffset := entry & qcow2OffsetMask
+	if entry&qcow2ZeroFlag != 0 || hostOffset == 0 {
+		// zero or never written (with no backing file to fall through to)
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	}
+	_, err := q.file.ReadAt(p, int64(hostOffset)+offset)
+	if err != nil {
+		return fmt.Errorf("error reading qcow2 cluster at %d: %w", hostOffset, err)
+	}
+	return nil
+}
+
+// read the disk's contents at offset. Anything past the end of the disk
+// reads as zeros.
+func (q *qcow2Image) ReadAt(p []byte, offset int64) (int, error) {
+	clusterSize := int64(1) << q.clusterBits
+	l2Entries := clusterSize / 8
+	done := 0
+	for done < len(p) {
+		within := offset % clusterSize
+		n := clusterSize - within
+		if n > int64(len(p)-done) {
+			n = int64(len(p) - done)
+		}
+		chunk := p[done : done+int(n)]
+
+		cluster := offset / clusterSize
+		l1Index := cluster / l2Entries
+		var entry uint64
+		if offset < q.Size && l1Index < int64(len(q.l1)) {
+			if l2Offset := q.l1[l1Index] & qcow2OffsetMask; l2Offset != 0 {
+				l2, err := q.l2Table(l2Offset)
+				if err != nil {
+					return done, err
+				}
+				entry = l2[cluster%l2Entries]
+			}
+		}
+		err := q.readCluster(chunk, entry, within)
+		if err != nil {
+			return done, err
+		}
+		done += int(n)
+		offset += n
+	}
+	return done, nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Replica is another folder (ex: a mounted NAS or USB drive) that complete
+// backups are copied to, laid out the same as LocalPath. Each has its own
+// retention.
+type Replica struct {
+	// shown in messages and show-backups, ex: "nas2"
+	Name string
+	Path string
+	// copy each backup as soon as it finishes, instead of waiting for the
+	// end of the schedule
+	AfterEachBackup bool
+	CopyRetention
+}
+
+// files are copied this much at a time, and blocks of zeros this size are
+// skipped instead of written
+const replicaBlockSize = 1 << 20
+
+var zeroBlock = make([]byte, replicaBlockSize)
+
+func validateReplicas() error {
+	names := make(map[string]bool)
+	localPath, err := filepath.Abs(Config.SMB.LocalPath)
+	if err != nil {
+		return err
+	}
+	for i, replica := range Config.Replicas {
+		if replica.Name == "" {
+			return fmt.Errorf("Replica %d Name not set", i+1)
+		}
+		if strings.ContainsAny(replica.Name, `/\`) {
+			return fmt.Errorf("Replica %s Name should not contain slashes", replica.Name)
+		}
+		if names[replica.Name] {
+			return fmt.Errorf("there is more than one Replica named %s", replica.Name)
+		}
+		names[replica.Name] = true
+
+		if replica.Path == "" {
+			return fmt.Errorf("Replica %s Path not set", replica.Name)
+		}
+		if !filepath.IsAbs(replica.Path) {
+			return fmt.Errorf("Replica %s Path must be absolute", replica.Name)
+		}
+		rel, err := filepath.Rel(localPath, replica.Path)
+		if err == nil && (rel == "." || !strings.HasPrefix(rel, "..")) {
+			return fmt.Errorf("Replica %s Path can not be in SMB LocalPath", replica.Name)
+		}
+		// a mount that went missing would look like an empty folder
+		fileInfo, err := os.Stat(replica.Path)
+		if err != nil {
+			return fmt.Errorf("Replica %s Path does not exist", replica.Name)
+		}
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("Replica %s Path is not a directory", replica.Name)
+		}
+
+		err = replica.validate("Replica " + replica.Name)
+		if err != nil {
+			return fmt.Errorf("Replica %s %w", replica.Name, err)
+		}
+	}
+	return nil
+}
+
+// make sure only one process copies or deletes a replica of a backup at a
+// time
+func LockReplica(replica Replica, backupName, command string) (*Lock, error) {
+	folder := filepath.Join(Config.SMB.LocalPath, vmLocksFolderName)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(folder, "replica "+replica.Name+" "+backupName+".lock")
+	return acquireLock(file, "copy of "+backupName+" on "+replica.Name, command)
+}
+
+func isZeroBlock(data []byte) bool {
+	for len(data) > len(zeroBlock) {
+		if !bytes.Equal(data[:len(zeroBlock)], zeroBlock) {
+			return false
+		}
+		data = data[len(zeroBlock):]
+	}
+	return bytes.Equal(data, zeroBlock[:len(data)])
+}
+
+// copy a file unless dst already matches it. The copy is written to
+// dst.part, which is picked back up if an earlier copy was interrupted, and
+// only renamed to dst once its SHA-256 matches. Blocks of zeros are skipped
+// instead of written, so disk images stay sparse.
+func replicateFile(ctx context.Context, src, dst string) error {
+	debugReturn := DebugCall(src, dst)
+
+	info, err := os.Stat(src)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	hash, err := fileSHA256(src)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && dstInfo.Size() == info.Size() {
+		if dstHash, err := fileSHA256(dst); err == nil && dstHash == hash {
+			debugReturn(nil)
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer in.Close()
+	tmpFile := dst + ".part"
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer out.Close()
+
+	// carry on from the last whole block of an earlier attempt. Anything
+	// after that is thrown away, so skipped blocks read back as zeros.
+	partInfo, err := out.Stat()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	offset := partInfo.Size() / replicaBlockSize * replicaBlockSize
+	if offset > info.Size() {
+		offset = 0
+	}
+	err = out.Truncate(offset)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	buf := make([]byte, replicaBlockSize)
+	for offset < info.Size() {
+		if ctx.Err() != nil {
+			debugReturn(ctx.Err())
+			return ctx.Err()
+		}
+		n, err := in.ReadAt(buf, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && offset+int64(n) == info.Size()) {
+			debugReturn(err)
+			return err
+		}
+		if !isZeroBlock(buf[:n]) {
+			_, err = out.WriteAt(buf[:n], offset)
+			if err != nil {
+				debugReturn(err)
+				return err
+			}
+		}
+		offset += int64(n)
+	}
+	// skipped blocks at the end still have to count towards the size
+	err = out.Truncate(info.Size())
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	copied, err := fileSHA256(tmpFile)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	if copied != hash {
+		os.Remove(tmpFile)
+		err := fmt.Errorf("copy of %s to %s is corrupt (SHA-256 %s, expected %s)", src, dst, copied, hash)
+		debugReturn(err)
+		return err
+	}
+	err = os.Rename(tmpFile, dst)
+
+	debugReturn(err)
+	return err
+}
+
+// copy a complete backup to a replica. Files that were already copied are
+// skipped, and the manifest goes last, so the copy only looks complete once
+// it is.
+func replicateBackup(ctx context.Context, replica Replica, backupName string) error {
+	debugReturn := DebugCall(replica.Name, backupName)
+
+	manifest, err := readManifest(backupName)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	lock, err := LockReplica(replica, backupName, "copy "+backupName+" to "+replica.Name)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	fmt.Printf("Copying %s to %s\n", backupName, replica.Name)
+	src := filepath.Join(Config.SMB.LocalPath, backupName)
+	dst := filepath.Join(replica.Path, backupName)
+	files := append([]ManifestFile(nil), manifest.Files...)
+	files = append(files, ManifestFile{Name: manifestFileName})
+	for _, file := range files {
+		dstFile := filepath.Join(dst, filepath.FromSlash(file.Name))
+		err = os.MkdirAll(filepath.Dir(dstFile), 0755)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+		err = replicateFile(ctx, filepath.Join(src, filepath.FromSlash(file.Name)), dstFile)
+		if err != nil {
+			debugReturn(err)
+			return err
+		}
+	}
+
+	debugReturn(nil)
+	return nil
+}
+
+// list the backups on a replica, newest first
+func replicaCopies(replica Replica) ([]backupCopy, error) {
+	debugReturn := DebugCall(replica.Name)
+
+	entries, err := os.ReadDir(replica.Path)
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+	var copies []backupCopy
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t, _, err := parseDateTime(entry.Name())
+		if err != nil {
+			continue
+		}
+		c := backupCopy{Name: entry.Name(), Time: t}
+		file := filepath.Join(replica.Path, entry.Name(), manifestFileName)
+		manifest, err := readManifestFile(file)
+		switch {
+		case err == nil:
+			c.Complete = true
+			c.VMUUID = manifest.VMUUID
+		case !errors.Is(err, os.ErrNotExist):
+			// a damaged manifest still means the copy finished
+			fmt.Fprintf(os.Stderr, "Failed to read manifest: %s\n", err)
+			c.Complete = true
+		}
+		copies = append(copies, c)
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].Time.After(copies[j].Time)
+	})
+
+	debugReturn(len(copies), nil)
+	return copies, nil
+}
+
+// delete a backup from a replica, manifest first so it never looks complete
+// when it isn't
+func deleteReplica(replica Replica, backupName string) error {
+	debugReturn := DebugCall(replica.Name, backupName)
+
+	lock, err := LockReplica(replica, backupName, "delete "+backupName+" from "+replica.Name)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	defer lock.Release()
+
+	folder := filepath.Join(replica.Path, backupName)
+	err = os.Remove(filepath.Join(folder, manifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		debugReturn(err)
+		return err
+	}
+	err = os.RemoveAll(folder)
+
+	debugReturn(err)
+	return err
+}
+
+// copy backups to each replica that its retention rules keep, and delete
+// copies they don't. With --dry-run it only says what it would do. If a
+// VM's copy fails, its old copies on that replica aren't deleted this time.
+// Failures are returned together once everything else has been tried.
+func SyncReplicas(ctx context.Context) error {
+	debugReturn := DebugCall()
+
+	folders, err := BackupFolders()
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	var failures []string
+	for _, replica := range Config.Replicas {
+		copies, err := replicaCopies(replica)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list backups on %s: %s\n", replica.Name, err)
+			failures = append(failures, fmt.Sprintf("listing %s: %s", replica.Name, err))
+			continue
+		}
+		toCopy, deletions := planCopies(replica.policy("Replica "+replica.Name), folders, copies)
+
+		if dryRun {
+			for _, folder := range toCopy {
+				fmt.Printf("Would copy %s to %s\n", folder.Name, replica.Name)
+			}
+			for _, deletion := range deletions {
+				fmt.Printf("Would delete %s from %s: %s\n", copies[deletion.Index].Name, replica.Name, deletion.Reason)
+			}
+			if len(toCopy) == 0 && len(deletions) == 0 {
+				fmt.Printf("%s is up to date\n", replica.Name)
+			}
+			continue
+		}
+
+		failedVMs := make(map[string]bool)
+		for _, folder := range toCopy {
+			err := replicateBackup(ctx, replica, folder.Name)
+			if ctx.Err() != nil {
+				debugReturn(ctx.Err())
+				return ctx.Err()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to copy %s to %s: %s\n", folder.Name, replica.Name, err)
+				failures = append(failures, fmt.Sprintf("copy of %s to %s: %s", folder.Name, replica.Name, err))
+				failedVMs[folder.VMUUID] = true
+			}
+		}
+		for _, deletion := range deletions {
+			c := copies[deletion.Index]
+			if c.VMUUID != "" && failedVMs[c.VMUUID] {
+				fmt.Printf("Keeping %s on %s until the newer copy works\n", c.Name, replica.Name)
+				continue
+			}
+			fmt.Printf("Deleting %s from %s: %s\n", c.Name, replica.Name, deletion.Reason)
+			err := deleteReplica(replica, c.Name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to delete %s from %s: %s\n", c.Name, replica.Name, err)
+				failures = append(failures, fmt.Sprintf("deletion of %s from %s: %s", c.Name, replica.Name, err))
+			}
+		}
+	}
+
+	if len(failures) != 0 {
+		err = fmt.Errorf("%d replica operations failed:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	debugReturn(err)
+	return err
+}
+
+// copy a backup that just finished to each replica with AfterEachBackup
+// set. Failures are emailed, but the backup itself still worked, and the
+// next sync will try again.
+func replicateAfterBackup(ctx context.Context, vmName, backupName string) {
+	for _, replica := range Config.Replicas {
+		if !replica.AfterEachBackup {
+			continue
+		}
+		err := replicateBackup(ctx, replica, backupName)
+		if err != nil && ctx.Err() == nil {
+			emailError(
+				"Replica copy failed",
+				"Backup of %s completed, but it could not be copied to %s: %s",
+				vmName,
+				replica.Name,
+				err,
+			)
+		}
+	}
+}
+
+// return where each backup has been copied to, keyed by backup name. Copies
+// that haven't finished are marked, ex: "nas2 (partial)".
+func replicaLocations() map[string][]string {
+	locations := make(map[string][]string)
+	for _, replica := range Config.Replicas {
+		copies, err := replicaCopies(replica)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list backups on %s: %s\n", replica.Name, err)
+			continue
+		}
+		for _, c := range copies {
+			location := replica.Name
+			if !c.Complete {
+				location += " (partial)"
+			}
+			locations[c.Name] = append(locations[c.Name], location)
+		}
+	}
+	return locations
+}
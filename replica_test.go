@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the complete backups on a replica, newest first
+func replicaNames(t *testing.T, replica Replica) []string {
+	copies, err := replicaCopies(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range copies {
+		if c.Complete {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+func TestReplicaSync(t *testing.T) {
+	const day = 24 * time.Hour
+	ctx := context.Background()
+	fake := setupFakeScale(t)
+	fake.AddVM("web01")
+	nas := Replica{Name: "nas2", Path: t.TempDir(), CopyRetention: CopyRetention{MaxBackups: 1}}
+	usb := Replica{Name: "usb", Path: t.TempDir(), CopyRetention: CopyRetention{MaxBackups: 3}}
+	Config.Replicas = []Replica{nas, usb}
+
+	var names []string
+	for _, age := range []time.Duration{3 * day, 2 * day, 1 * day} {
+		name := DateTimePrefix(clock.Now().Add(-age), "web01")
+		names = append(names, name)
+		err := Backup(ctx, "web01", name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// left behind by a copy that was interrupted, of a backup that is gone
+	partial := DateTimePrefix(clock.Now().Add(-10*day), "web01")
+	err := os.MkdirAll(filepath.Join(usb.Path, partial), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SyncReplicas(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replicaNames(t, nas); len(got) != 1 || got[0] != names[2] {
+		t.Errorf("expected only %s on nas2, got %v", names[2], got)
+	}
+	if got := replicaNames(t, usb); len(got) != 3 {
+		t.Errorf("expected 3 backups on usb, got %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(usb.Path, partial)); !os.IsNotExist(err) {
+		t.Error("partial copy should have been deleted")
+	}
+	manifest, err := readManifest(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range manifest.Files {
+		local, err := os.ReadFile(filepath.Join(Config.SMB.LocalPath, names[2], file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := os.ReadFile(filepath.Join(nas.Path, names[2], file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(local, copied) {
+			t.Errorf("copy of %s does not match", file.Name)
+		}
+	}
+
+	name := DateTimePrefix(clock.Now(), "web01")
+	names = append(names, name)
+	err = Backup(ctx, "web01", name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SyncReplicas(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replicaNames(t, nas); len(got) != 1 || got[0] != names[3] {
+		t.Errorf("expected only %s on nas2, got %v", names[3], got)
+	}
+	got := replicaNames(t, usb)
+	if len(got) != 3 || got[0] != names[3] || got[2] != names[1] {
+		t.Errorf("expected %v on usb, got %v", []string{names[3], names[2], names[1]}, got)
+	}
+
+	locations := replicaLocations()
+	if strings.Join(locations[names[3]], ", ") != "nas2, usb" {
+		t.Errorf("expected %s on nas2 and usb, got %v", names[3], locations[names[3]])
+	}
+	if strings.Join(locations[names[2]], ", ") != "usb" {
+		t.Errorf("expected %s on usb only, got %v", names[2], locations[names[2]])
+	}
+}
+
+func TestReplicaAfterEachBackup(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("web01")
+	nas := Replica{Name: "nas2", Path: t.TempDir(), AfterEachBackup: true}
+	Config.Replicas = []Replica{nas}
+
+	name := DateTimePrefix(clock.Now(), "web01")
+	err := Backup(context.Background(), "web01", name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replicaNames(t, nas); len(got) != 1 || got[0] != name {
+		t.Errorf("expected %s on nas2, got %v", name, got)
+	}
+}
+
+func TestReplicateFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.qcow2")
+	dst := filepath.Join(dir, "copy.qcow2")
+
+	// data, a block of zeros (which isn't written), then half a block
+	data := make([]byte, replicaBlockSize*5/2)
+	for i := range data[:replicaBlockSize] {
+		data[i] = byte(i % 251)
+	}
+	for i := 2 * replicaBlockSize; i < len(data); i++ {
+		data[i] = byte(i % 241)
+	}
+	err := os.WriteFile(src, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted copy with a good first block and some of the next
+	part := append(append([]byte(nil), data[:replicaBlockSize]...), "garbage"...)
+	err = os.WriteFile(dst+".part", part, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replicateFile(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, data) {
+		t.Error("resumed copy does not match")
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Error(".part file was left behind")
+	}
+
+	// a copy that already matches is left alone
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes(dst, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replicateFile(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dst); err != nil || !info.ModTime().Equal(old) {
+		t.Error("matching copy was rewritten")
+	}
+
+	// a bad block from an earlier attempt is caught, and thrown away so
+	// the next attempt works
+	err = os.Remove(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dst+".part", make([]byte, replicaBlockSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replicateFile(ctx, src, dst)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("expected a corrupt copy error, got %v", err)
+	}
+	err = replicateFile(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err = os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, data) {
+		t.Error("copy does not match")
+	}
+}
+
+func TestValidateReplicas(t *testing.T) {
+	setupFakeScale(t)
+	tests := []struct {
+		replicas []Replica
+		err      string
+	}{
+		{[]Replica{{Name: "nas2", Path: t.TempDir()}}, ""},
+		{[]Replica{{Path: t.TempDir()}}, "Name not set"},
+		{[]Replica{{Name: "nas2", Path: t.TempDir()}, {Name: "nas2", Path: t.TempDir()}}, "more than one"},
+		{[]Replica{{Name: "nas2", Path: "relative"}}, "must be absolute"},
+		{[]Replica{{Name: "nas2", Path: filepath.Join(t.TempDir(), "missing")}}, "does not exist"},
+		{[]Replica{{Name: "nas2", Path: Config.SMB.LocalPath}}, "can not be in SMB LocalPath"},
+		{[]Replica{{Name: "nas2", Path: filepath.Join(Config.SMB.LocalPath, "copies")}}, "can not be in SMB LocalPath"},
+	}
+	for _, test := range tests {
+		Config.Replicas = test.replicas
+		err := validateReplicas()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%+v: unexpected error: %s", test.replicas, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%+v: expected error containing %q, got %v", test.replicas, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// changes to make to a VM as it is restored. Zero values leave the VM as it
+// was when it was backed up.
+type RestoreOverrides struct {
+	VCPUs int
+	// bytes
+	Memory uint64
+	// replaces all tags, nil to keep the tags from the backup
+	Tags *string
+	// stop the VM if it is running once the restore completes
+	PoweredOff bool
+	// disconnect every NIC
+	DisconnectNICs bool
+	// move every NIC to this VLAN
+	VLAN *int
+}
+
+// set by restore and interactive-restore flags
+var restoreOverrides RestoreOverrides
+
+func addRestoreFlags(flags *flag.FlagSet) {
+	flags.IntVar(&restoreOverrides.VCPUs, "cpus", 0, "number of vCPUs for the restored VM")
+	flags.Func(
+		"memory",
+		"memory for the restored VM (ex: 8GiB)",
+		func(s string) error {
+			memory, err := humanize.ParseBytes(s)
+			if err != nil {
+				return err
+			}
+			if memory == 0 {
+				return fmt.Errorf("memory must be greater than 0")
+			}
+			restoreOverrides.Memory = memory
+			return nil
+		},
+	)
+	flags.Func(
+		"tags",
+		"comma separated tags for the restored VM, replacing the original tags",
+		func(s string) error {
+			var tags []string
+			for _, tag := range strings.Split(s, ",") {
+				tag = strings.TrimSpace(tag)
+				if tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			joined := strings.Join(tags, ",")
+			restoreOverrides.Tags = &joined
+			return nil
+		},
+	)
+	flags.BoolVar(
+		&restoreOverrides.PoweredOff,
+		"powered-off",
+		false,
+		"make sure the restored VM is left powered off",
+	)
+	flags.BoolVar(
+		&restoreOverrides.DisconnectNICs,
+		"disconnect-nics",
+		false,
+		"disconnect every NIC on the restored VM",
+	)
+	flags.Func(
+		"vlan",
+		"move every NIC on the restored VM to this VLAN",
+		func(s string) error {
+			vlan, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			if vlan < 0 || vlan > 4094 {
+				return fmt.Errorf("VLAN must be between 0 and 4094")
+			}
+			restoreOverrides.VLAN = &vlan
+			return nil
+		},
+	)
+}
+
+// the import template for a new VM with these overrides
+func (o RestoreOverrides) template(newVMName string) VMTemplate {
+	return VMTemplate{
+		Name:    newVMName,
+		NumVCPU: o.VCPUs,
+		Mem:     int64(o.Memory),
+		Tags:    o.Tags,
+	}
+}
+
+// human readable list of overrides, empty if there are none
+func (o RestoreOverrides) String() string {
+	var changes []string
+	if o.VCPUs != 0 {
+		changes = append(changes, fmt.Sprintf("%d vCPUs", o.VCPUs))
+	}
+	if o.Memory != 0 {
+		changes = append(changes, humanize.IBytes(o.Memory)+" memory")
+	}
+	if o.Tags != nil {
+		changes = append(changes, fmt.Sprintf("tags %q", *o.Tags))
+	}
+	if o.PoweredOff {
+		changes = append(changes, "powered off")
+	}
+	if o.DisconnectNICs {
+		changes = append(changes, "NICs disconnected")
+	}
+	if o.VLAN != nil {
+		changes = append(changes, fmt.Sprintf("NICs on VLAN %d", *o.VLAN))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// make the changes that can't go in the import template. NICs are dealt
+// with before the power state so a running VM is isolated as soon as
+// possible.
+func (o RestoreOverrides) apply(ctx context.Context, vmUUID string) error {
+	debugReturn := DebugCall(o, vmUUID)
+
+	if !o.DisconnectNICs && o.VLAN == nil && !o.PoweredOff {
+		debugReturn(nil)
+		return nil
+	}
+
+	vm, err := Scale.GetVM(ctx, vmUUID)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+
+	if o.DisconnectNICs || o.VLAN != nil {
+		var update NetDevUpdate
+		if o.DisconnectNICs {
+			connected := false
+			update.Connected = &connected
+		}
+		update.VLAN = o.VLAN
+		for _, nic := range vm.NetDevs {
+			taskTag, err := Scale.UpdateNetDev(ctx, nic.UUID, update)
+			if err != nil {
+				err = fmt.Errorf("failed to update NIC %s: %w", nic.MacAddress, err)
+				debugReturn(err)
+				return err
+			}
+			_, err = Scale.WaitForTask(ctx, taskTag, WaitOptions{
+				Timeout: 10 * time.Minute,
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to update NIC %s: %w", nic.MacAddress, err)
+				debugReturn(err)
+				return err
+			}
+			fmt.Printf("Updated NIC %s\n", nic.MacAddress)
+		}
+	}
+
+	if o.PoweredOff && vm.State != "SHUTOFF" {
+		taskTag, err := Scale.VMAction(ctx, vmUUID, "STOP")
+		if err != nil {
+			err = fmt.Errorf("failed to power off VM: %w", err)
+			debugReturn(err)
+			return err
+		}
+		_, err = Scale.WaitForTask(ctx, taskTag, WaitOptions{
+			Timeout: 10 * time.Minute,
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to power off VM: %w", err)
+			debugReturn(err)
+			return err
+		}
+		fmt.Println("Powered off VM")
+	}
+
+	debugReturn(nil)
+	return nil
+}
+
+// return the format a backup's disk images were exported in, going by their
+// file extensions (converted copies don't count). Returns "" if the backup
+// has no disk images.
+func backupFormat(backupName string) (string, error) {
+	var format string
+	err := filepath.WalkDir(
+		filepath.Join(Config.SMB.LocalPath, backupName),
+		func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || isConvertedImage(path) {
+				return err
+			}
+			ext := filepath.Ext(strings.TrimSuffix(path, encryptedSuffix))
+			for _, f := range exportFormats {
+				if strings.EqualFold(ext, "."+f) {
+					format = f
+					return filepath.SkipAll
+				}
+			}
+			return nil
+		},
+	)
+	return format, err
+}
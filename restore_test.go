@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreOverrides(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("web01", "backup", "prod")
+	Backup(context.Background(), "web01", "manual web01", false)
+
+	// pretend the cluster starts VMs as soon as they are imported, so we
+	// can tell --powered-off did something
+	fake.SetImportedState("RUNNING")
+	tags := "drtest"
+	vlan := 999
+	restoreOverrides = RestoreOverrides{
+		VCPUs:          4,
+		Memory:         8 << 30,
+		Tags:           &tags,
+		PoweredOff:     true,
+		DisconnectNICs: true,
+		VLAN:           &vlan,
+	}
+
+	Restore(context.Background(), "manual web01", "web01-drtest")
+
+	vm := fake.VM("web01-drtest")
+	if vm == nil {
+		t.Fatal("restored VM was not created")
+	}
+	if vm.NumVCPU != 4 || vm.Mem != 8<<30 {
+		t.Errorf("expected 4 vCPUs and 8GiB, got %d vCPUs and %d bytes", vm.NumVCPU, vm.Mem)
+	}
+	if vm.Tags != "drtest" {
+		t.Errorf("expected tags %q, got %q", "drtest", vm.Tags)
+	}
+	if vm.State != "SHUTOFF" {
+		t.Errorf("expected VM to be powered off, got %s", vm.State)
+	}
+	for _, nic := range vm.NetDevs {
+		if nic.Connected || nic.VLAN != 999 {
+			t.Errorf("NIC %s should be disconnected on VLAN 999: %+v", nic.MacAddress, nic)
+		}
+	}
+}
+
+func TestRestoreWithoutOverrides(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("web01", "backup")
+	Backup(context.Background(), "web01", "manual web01", false)
+
+	Restore(context.Background(), "manual web01", "web01-restored")
+
+	if fake.lastImport.Template.NumVCPU != 0 ||
+		fake.lastImport.Template.Mem != 0 ||
+		fake.lastImport.Template.Tags != nil {
+		t.Errorf("template should only set the name: %+v", fake.lastImport.Template)
+	}
+	for _, req := range fake.Requests() {
+		if req == "POST /rest/v1/VirDomain/action" || strings.HasPrefix(req, "PATCH ") {
+			t.Errorf("no follow-up changes expected, got %s", req)
+		}
+	}
+}
+
+func TestRestoreOverridesString(t *testing.T) {
+	vlan := 20
+	tests := []struct {
+		overrides RestoreOverrides
+		want      string
+	}{
+		{RestoreOverrides{}, ""},
+		{RestoreOverrides{VCPUs: 2, Memory: 2 << 30}, "2 vCPUs, 2.0 GiB memory"},
+		{RestoreOverrides{DisconnectNICs: true, VLAN: &vlan}, "NICs disconnected, NICs on VLAN 20"},
+		{RestoreOverrides{PoweredOff: true}, "powered off"},
+	}
+	for _, test := range tests {
+		got := test.overrides.String()
+		if got != test.want {
+			t.Errorf("%+v: expected %q, got %q", test.overrides, test.want, got)
+		}
+	}
+}
+
+func TestRestoreUsesBackupFormat(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	Config.Transfer.Format = ptr("vmdk")
+	err := Backup(context.Background(), "web01", "manual web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(Config.SMB.LocalPath, "manual web01", vm.BlockDevs[0].UUID+".vmdk")); err != nil {
+		t.Fatalf("expected a vmdk disk image: %s", err)
+	}
+
+	// the config has changed since
+	Config.Transfer.Format = ptr("qcow2")
+	Restore(context.Background(), "manual web01", "web01-restored")
+	if fake.VM("web01-restored") == nil {
+		t.Fatal("restored VM was not created")
+	}
+	if fake.lastImport.Source.Format != "vmdk" {
+		t.Errorf("expected a vmdk import, got %q", fake.lastImport.Source.Format)
+	}
+}
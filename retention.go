@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// why a backup is kept, or why it isn't
+type retention struct {
+	// the rules that keep this backup, ex: "last 7", "daily", "monthly"
+	KeptBy []string
+	// older than MaxAge, which no rule can override
+	TooOld bool
+	// nothing else keeps it, but it is the VM's newest backup
+	Newest bool
+}
+
+func (r retention) Kept() bool {
+	return r.Newest || (len(r.KeptBy) != 0 && !r.TooOld)
+}
+
+// a grandfather-father-son rule: keep the newest backup from each of the
+// last Keep days/weeks/months/years that have a backup
+type gfsRule struct {
+	Name   string
+	Keep   int
+	period func(t time.Time) string
+}
+
+func (p BackupPolicy) gfsRules() []gfsRule {
+	return []gfsRule{
+		{"daily", p.KeepDaily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+		{"yearly", p.KeepYearly, func(t time.Time) string {
+			return t.Format("2006")
+		}},
+	}
+}
+
+// return true if any of KeepDaily, KeepWeekly, KeepMonthly, or KeepYearly
+// are set
+func (p BackupPolicy) usesGFS() bool {
+	return p.KeepDaily != 0 || p.KeepWeekly != 0 || p.KeepMonthly != 0 || p.KeepYearly != 0
+}
+
+// work out which of a VM's backups (newest first) the policy keeps. Without
+// GFS rules the newest MaxBackups are kept. With them, a backup is kept if
+// it is one of the newest MaxBackups (if MaxBackups is set) or any GFS rule
+// keeps it. Either way, nothing older than MaxAge is kept, except that a
+// VM's newest backup is never deleted. Failed and unfinished backups aren't
+// listed by Backups, so that is its newest good one.
+func applyRetention(policy BackupPolicy, backupTimes []time.Time) []retention {
+	result := make([]retention, len(backupTimes))
+
+	keepLast := policy.MaxBackups
+	if policy.usesGFS() && keepLast == math.MaxInt64 {
+		keepLast = 0
+	}
+	lastRule := fmt.Sprintf("last %d", keepLast)
+	if keepLast == math.MaxInt64 {
+		// only MaxAge limits these
+		lastRule = "MaxAge"
+	}
+	for i, backupTime := range backupTimes {
+		if i < keepLast {
+			result[i].KeptBy = append(result[i].KeptBy, lastRule)
+		}
+		result[i].TooOld = since(backupTime) > policy.MaxAge
+	}
+
+	for _, rule := range policy.gfsRules() {
+		kept := 0
+		lastPeriod := ""
+		for i, backupTime := range backupTimes {
+			if kept >= rule.Keep {
+				break
+			}
+			// backups are newest first, so the first one we see in each
+			// period is the newest in it
+			period := rule.period(backupTime)
+			if period == lastPeriod {
+				continue
+			}
+			lastPeriod = period
+			result[i].KeptBy = append(result[i].KeptBy, rule.Name)
+			kept++
+		}
+	}
+
+	if len(result) != 0 && !result[0].Kept() {
+		result[0].Newest = true
+	}
+
+	return result
+}
+
+// describe a policy's retention rules, for messages
+func (p BackupPolicy) describeRetention() string {
+	var rules []string
+	if p.MaxBackups != math.MaxInt64 {
+		rules = append(rules, fmt.Sprintf("last %d", p.MaxBackups))
+	}
+	for _, rule := range p.gfsRules() {
+		if rule.Keep != 0 {
+			rules = append(rules, fmt.Sprintf("%d %s", rule.Keep, rule.Name))
+		}
+	}
+	return strings.Join(rules, ", ")
+}
+
+// explain why backup i of total (newest first) isn't kept, for messages
+func (p BackupPolicy) deletionReason(kept retention, i, total int) string {
+	switch {
+	case kept.TooOld:
+		return fmt.Sprintf(
+			"older than %s MaxAge of %s",
+			p.Name,
+			describeAge(p.MaxAge),
+		)
+	case p.usesGFS():
+		return fmt.Sprintf(
+			"not kept by any %s rule (%s)",
+			p.Name,
+			p.describeRetention(),
+		)
+	default:
+		return fmt.Sprintf(
+			"backup %d of %d, %s MaxBackups is %d",
+			i+1,
+			total,
+			p.Name,
+			p.MaxBackups,
+		)
+	}
+}
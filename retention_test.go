@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	// a Friday
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	setClock(t, now)
+
+	// a backup every day at noon for 60 days, newest first
+	var backupTimes []time.Time
+	for i := 0; i < 60; i++ {
+		backupTimes = append(backupTimes, now.AddDate(0, 0, -i))
+	}
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 12, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		policy BackupPolicy
+		want   map[time.Time][]string
+		tooOld int
+	}{
+		{
+			name: "MaxBackups only",
+			policy: BackupPolicy{
+				MaxBackups: 2,
+				MaxAge:     time.Duration(math.MaxInt64),
+			},
+			want: map[time.Time][]string{
+				date(3, 15): {"last 2"},
+				date(3, 14): {"last 2"},
+			},
+		},
+		{
+			name: "GFS",
+			policy: BackupPolicy{
+				MaxBackups:  math.MaxInt64,
+				MaxAge:      time.Duration(math.MaxInt64),
+				KeepDaily:   3,
+				KeepWeekly:  2,
+				KeepMonthly: 2,
+			},
+			want: map[time.Time][]string{
+				date(3, 15): {"daily", "weekly", "monthly"},
+				date(3, 14): {"daily"},
+				date(3, 13): {"daily"},
+				// the Sunday that ends the week before
+				date(3, 10): {"weekly"},
+				// leap day
+				date(2, 29): {"monthly"},
+			},
+		},
+		{
+			name: "GFS with MaxBackups and MaxAge",
+			policy: BackupPolicy{
+				MaxBackups:  1,
+				MaxAge:      10 * 24 * time.Hour,
+				KeepDaily:   2,
+				KeepMonthly: 2,
+			},
+			want: map[time.Time][]string{
+				date(3, 15): {"last 1", "daily", "monthly"},
+				date(3, 14): {"daily"},
+			},
+			// February's monthly backup is past MaxAge, along with
+			// everything else older than 10 days
+			tooOld: 49,
+		},
+		{
+			name: "MaxAge only",
+			policy: BackupPolicy{
+				MaxBackups: math.MaxInt64,
+				MaxAge:     36 * time.Hour,
+			},
+			want: map[time.Time][]string{
+				date(3, 15): {"MaxAge"},
+				date(3, 14): {"MaxAge"},
+			},
+			tooOld: 58,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make(map[time.Time][]string)
+			tooOld := 0
+			for i, kept := range applyRetention(test.policy, backupTimes) {
+				if kept.TooOld {
+					tooOld++
+				}
+				if kept.Kept() {
+					got[backupTimes[i]] = kept.KeptBy
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("kept %v, want %v", got, test.want)
+			}
+			if tooOld != test.tooOld {
+				t.Errorf("%d backups past MaxAge, want %d", tooOld, test.tooOld)
+			}
+		})
+	}
+}
+
+func TestRetentionKeepsNewest(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	setClock(t, now)
+	backupTimes := []time.Time{
+		now.AddDate(0, 0, -20),
+		now.AddDate(0, 0, -30),
+	}
+	policy := BackupPolicy{
+		MaxBackups: 5,
+		MaxAge:     10 * 24 * time.Hour,
+	}
+
+	got := applyRetention(policy, backupTimes)
+	if !got[0].Kept() || !got[0].Newest {
+		t.Errorf("the newest backup should be kept even past MaxAge: %+v", got[0])
+	}
+	if got[1].Kept() {
+		t.Errorf("older backups past MaxAge should not be kept: %+v", got[1])
+	}
+}
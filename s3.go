@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrS3NotFound = errors.New("S3 object not found")
+
+// S3Error is returned for any non-2xx response from an S3 server. Use
+// errors.Is with ErrS3NotFound to check for missing objects and uploads.
+type S3Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Code
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("S3 %s %s: HTTP %d: %s", e.Method, e.Key, e.StatusCode, msg)
+}
+
+func (e *S3Error) Is(target error) bool {
+	return target == ErrS3NotFound && e.StatusCode == http.StatusNotFound
+}
+
+// a client for one bucket on an S3-compatible server. Requests are signed
+// with AWS Signature Version 4 and use path-style URLs
+// (https://endpoint/bucket/key), which MinIO and most other S3-compatible
+// servers expect.
+type S3Client struct {
+	Endpoint  url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	HTTP      *http.Client
+
+	// transient failures are retried this many times, waiting
+	// RetryBackoff before the first retry and doubling each time after
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// an object in a listing, or from a HEAD request
+type S3Object struct {
+	Key  string
+	Size int64
+	// hex MD5 of the object for single-part uploads, or of the part MD5s
+	// followed by -<number of parts> for multipart uploads
+	ETag string
+	// x-amz-meta-* headers, keys lowercase without the prefix. Listings
+	// don't include these.
+	Meta map[string]string
+}
+
+// a part of a multipart upload
+type S3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+// characters that don't need escaping in SigV4 canonical URIs and queries
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// add AWS Signature Version 4 headers to a request. payloadHash is the hex
+// SHA-256 of the body, which the server checks.
+func (c *S3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// sign the host and everything S3 might care about
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" ||
+			lower == "content-type" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var queryKeys []string
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	var canonicalQuery []string
+	for _, key := range queryKeys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// send a signed request for key (the bucket itself if key is empty). On
+// success the caller must close the response body. Transient failures are
+// retried, except for POSTs (starting and completing multipart uploads),
+// which are not safe to repeat blindly.
+func (c *S3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	reqURL := c.Endpoint
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		reqURL.Path += "/" + key
+	}
+	reqURL.RawPath = s3Escape(reqURL.Path, true)
+	reqURL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	payloadHash := sha256Hex(body)
+
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.ContentLength = int64(len(body))
+		c.sign(req, payloadHash, clock.Now())
+
+		resp, err := c.HTTP.Do(req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		transient := err != nil || transientStatus(resp.StatusCode)
+		if attempt < c.MaxRetries && idempotent(method) && transient {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+			s3Err := &S3Error{
+				Method:     method,
+				Key:        key,
+				StatusCode: resp.StatusCode,
+			}
+			// HEAD responses have no body, and not all servers send XML
+			respBody, _ := io.ReadAll(resp.Body)
+			xml.Unmarshal(respBody, s3Err)
+			return nil, s3Err
+		}
+		return resp, nil
+	}
+}
+
+// send a request and decode its XML response into out (if out is not nil)
+// return true for methods S3 lets us repeat without changing the outcome.
+// Repeating CreateMultipartUpload leaves an orphaned upload behind, and
+// repeating CompleteMultipartUpload fails with NoSuchUpload if the first
+// attempt worked.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func transientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func (c *S3Client) doXML(ctx context.Context, method, key string, query url.Values, body []byte, out any) error {
+	resp, err := c.do(ctx, method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	err = xml.Unmarshal(respBody, out)
+	if err != nil {
+		return fmt.Errorf("error decoding S3 response for %s %s: %w", method, key, err)
+	}
+	return nil
+}
+
+func metaHeaders(meta map[string]string) http.Header {
+	header := make(http.Header)
+	for name, value := range meta {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+	return header
+}
+
+// upload a small object in one request. The server checks it against
+// Content-MD5, and we check the ETag it returns.
+func (c *S3Client) PutObject(ctx context.Context, key string, data []byte, meta map[string]string) error {
+	debugReturn := DebugCall(key, len(data), meta)
+
+	sum := md5.Sum(data)
+	header := metaHeaders(meta)
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, data)
+	if err != nil {
+		debugReturn(err)
+		return err
+	}
+	resp.Body.Close()
+
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag != hex.EncodeToString(sum[:]) {
+		err = fmt.Errorf("S3 PUT %s: checksum mismatch (ETag %s)", key, etag)
+	}
+	debugReturn(err)
+	return err
+}
+
+func objectFromHeaders(key string, header http.Header) *S3Object {
+	object := &S3Object{
+		Key:  key,
+		ETag: strings.Trim(header.Get("ETag"), `"`),
+		Meta: make(map[string]string),
+	}
+	object.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if meta, found := strings.CutPrefix(lower, "x-amz-meta-"); found && len(values) != 0 {
+			object.Meta[meta] = values[0]
+		}
+	}
+	return object
+}
+
+func (c *S3Client) HeadObject(ctx context.Context, key string) (*S3Object, error) {
+	debugReturn := DebugCall(key)
+
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		debugReturn(nil, err)
+		return nil, err
+	}
+	resp.Body.Close()
+	object := objectFromHeaders(key, resp.Header)
+
+	debugReturn(object, nil)
+	return object, nil
+}
+
+// start downloading an object. The caller must close the returned reader.
+func (c *S3Client) GetObject(ctx context.Context, key string) (io.ReadCloser, *S3Object, error) {
+	debugReturn := DebugCall(key)
+
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		debugReturn(nil, nil, err)
+		return nil, nil, err
+	}
+	object := objectFromHeaders(key, resp.Header)
+
+	debugReturn("body", object, nil)
+	return resp.Body, object, nil
+}
+
+func (c *S3Client) DeleteObject(ctx context.Context, key string) error {
+	debugReturn := DebugCall(key)
+
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	debugReturn(err)
+	return err
+}
+
+// list every object whose key starts with prefix
+func (c *S3Client) ListObjects(ctx context.Context, prefix string) ([]S3Object, error) {
+	debugReturn := DebugCall(prefix)
+
+	var objects []S3Object
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				Size int64  `xml:"Size"`
+				ETag string `xml:"ETag"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err := c.doXML(ctx, http.MethodGet, "", query, nil, &result)
+		if err != nil {
+			debugReturn(nil, err)
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, S3Object{
+				Key:  content.Key,
+				Size: content.Size,
+				ETag: strings.Trim(content.ETag, `"`),
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	debugReturn(len(objects), nil)
+	return objects, nil
+}
+
+// start a multipart upload and return its upload ID
+func (c *S3Client) CreateMultipartUpload(ctx context.Context, key string, meta map[string]string) (string, error) {
+	debugReturn := DebugCall(key, meta)
+
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, metaHeaders(meta), nil)
+	if err != nil {
+		debugReturn("", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err == nil && result.UploadID == "" {
+		err = fmt.Errorf("S3 POST %s: no upload ID returned", key)
+	}
+
+	debugReturn(result.UploadID, err)
+	return result.UploadID, err
+}
+
+// upload one part of a multipart upload and return its ETag, after
+// checking it matches what we sent
+func (c *S3Client) UploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	debugReturn := DebugCall(key, uploadID, partNumber, len(data))
+
+	sum := md5.Sum(data)
+	header := make(http.Header)
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, query, header, data)
+	if err != nil {
+		debugReturn("", err)
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if etag != hex.EncodeToString(sum[:]) {
+		err = fmt.Errorf("S3 PUT %s part %d: checksum mismatch (ETag %s)", key, partNumber, etag)
+	}
+	debugReturn(etag, err)
+	return etag, err
+}
+
+// list the parts of a multipart upload the server already has
+func (c *S3Client) ListParts(ctx context.Context, key, uploadID string) ([]S3Part, error) {
+	debugReturn := DebugCall(key, uploadID)
+
+	var parts []S3Part
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		var result struct {
+			Parts                []S3Part `xml:"Part"`
+			IsTruncated          bool     `xml:"IsTruncated"`
+			NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+		}
+		err := c.doXML(ctx, http.MethodGet, key, query, nil, &result)
+		if err != nil {
+			debugReturn(nil, err)
+			return nil, err
+		}
+		for _, part := range result.Parts {
+			part.ETag = strings.Trim(part.ETag, `"`)
+			parts = append(parts, part)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	debugReturn(parts, nil)
+	return parts, nil
+}
+
+// finish a multipart upload and return the object's ETag
+func (c *S3Client) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []S3Part) (string, error) {
+	debugReturn := DebugCall(key, uploadID, parts)
+
+	type completePart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var request struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+	for _, part := range parts {
+		request.Parts = append(request.Parts, completePart{part.PartNumber, `"` + part.ETag + `"`})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		panic(err)
+	}
+
+	// if a retry finds the upload gone, the earlier attempt probably
+	// worked and we just never heard back, so check for the object S3
+	// would have made out of these parts
+	var partMD5s [][]byte
+	for _, part := range parts {
+		sum, _ := hex.DecodeString(part.ETag)
+		partMD5s = append(partMD5s, sum)
+	}
+	expected := multipartETag(partMD5s)
+
+	var etag string
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		err = c.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, &result)
+		if err == nil {
+			etag = strings.Trim(result.ETag, `"`)
+			break
+		}
+		if attempt > 0 && errors.Is(err, ErrS3NotFound) {
+			object, headErr := c.HeadObject(ctx, key)
+			if headErr == nil && object.ETag == expected {
+				etag, err = object.ETag, nil
+			}
+			break
+		}
+		var s3Err *S3Error
+		transient := !errors.As(err, &s3Err) || transientStatus(s3Err.StatusCode)
+		if attempt >= c.MaxRetries || !transient || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			debugReturn("", ctx.Err())
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	debugReturn(etag, err)
+	return etag, err
+}
+
+func (c *S3Client) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	debugReturn := DebugCall(key, uploadID)
+
+	resp, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	debugReturn(err)
+	return err
+}
+
+// the ETag S3 gives an object uploaded in parts with these MD5s
+func multipartETag(partMD5s [][]byte) string {
+	var all []byte
+	for _, sum := range partMD5s {
+		all = append(all, sum...)
+	}
+	sum := md5.Sum(all)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(partMD5s))
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,16 +10,34 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	tofu "github.com/9072997/golang-tofu"
 )
 
 type VM struct {
-	UUID        string     `json:"uuid"`
-	Name        string     `json:"name"`
-	Tags        string     `json:"tags"`
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+	Tags string `json:"tags"`
+	// State can be: RUNNING, BLOCKED, PAUSED, SHUTDOWN, SHUTOFF, or CRASHED
+	State       string     `json:"state"`
+	NumVCPU     int        `json:"numVCPU"`
+	Mem         int64      `json:"mem"`
 	IsTransient bool       `json:"isTransient"`
 	BlockDevs   []BlockDev `json:"blockDevs"`
+	NetDevs     []NetDev   `json:"netDevs"`
+}
+
+type NetDev struct {
+	UUID          string `json:"uuid"`
+	VirDomainUUID string `json:"virDomainUUID"`
+	Type          string `json:"type"`
+	MacAddress    string `json:"macAddress"`
+	VLAN          int    `json:"vlan"`
+	Connected     bool   `json:"connected"`
+}
+
+// fields left nil are not changed
+type NetDevUpdate struct {
+	VLAN      *int  `json:"vlan,omitempty"`
+	Connected *bool `json:"connected,omitempty"`
 }
 
 type BlockDev struct {
@@ -33,11 +50,15 @@ type BlockDev struct {
 }
 
 type Snapshot struct {
-	DomainUUID                string `json:"domainUUID"`
-	Label                     string `json:"label"`
-	Type                      string `json:"type"`
-	LocalRetainUntilTimestamp int64  `json:"localRetainUntilTimestamp"`
-	Replication               bool   `json:"replication"`
+	UUID       string `json:"uuid,omitempty"`
+	DomainUUID string `json:"domainUUID"`
+	Label      string `json:"label"`
+	// Type can be: USER, AUTOMATED, or SUPPORT
+	Type string `json:"type"`
+	// unix timestamps. A retain timestamp of 0 means forever.
+	Timestamp                 int64 `json:"timestamp,omitempty"`
+	LocalRetainUntilTimestamp int64 `json:"localRetainUntilTimestamp"`
+	Replication               bool  `json:"replication"`
 }
 
 type DiskFromSnapshotOpts struct {
@@ -81,38 +102,45 @@ type ImportOptions struct {
 		AllowNonSequentialWrites bool   `json:"allowNonSequentialWrites"`
 		ParallelCountPerTransfer int    `json:"parallelCountPerTransfer"`
 	} `json:"source"`
-	Template struct {
-		Name string `json:"name"`
-	} `json:"template"`
+	Template VMTemplate `json:"template"`
 }
 
-func VMs(searchTag string) (map[string]string, error) {
-	debugReturn := DebugCall(searchTag)
+// settings for a VM created by an import. Zero values are left as they
+// were in the backup.
+type VMTemplate struct {
+	Name    string  `json:"name"`
+	NumVCPU int     `json:"numVCPU,omitempty"`
+	Mem     int64   `json:"mem,omitempty"`
+	Tags    *string `json:"tags,omitempty"`
+}
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomain",
-	}
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	resp, err := DebugHTTP(client, req)
+type VMAction struct {
+	VirDomainUUID string `json:"virDomainUUID"`
+	// ActionType can be: START, SHUTDOWN, STOP, REBOOT, or RESET
+	ActionType string `json:"actionType"`
+}
+
+// list all VMs on the cluster, including transient ones
+func (c *ScaleClient) VMList(ctx context.Context) ([]VM, error) {
+	debugReturn := DebugCall()
+
+	var vms []VM
+	err := c.do(ctx, "GET", "/rest/v1/VirDomain", nil, nil, &vms)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-	var vms []VM
-	err = json.NewDecoder(resp.Body).Decode(&vms)
+
+	debugReturn(vms, nil)
+	return vms, nil
+}
+
+// map the names of non-transient VMs to their UUIDs. VMs that share a name
+// only appear once (see duplicateVMNames), so use VMList to act on VMs.
+func (c *ScaleClient) VMs(ctx context.Context, searchTag string) (map[string]string, error) {
+	debugReturn := DebugCall(searchTag)
+
+	vms, err := c.VMList(ctx)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
@@ -127,18 +155,8 @@ func VMs(searchTag string) (map[string]string, error) {
 
 		// if a search tag was specified, but this VM doesn't have it
 		// skip the VM
-		if searchTag != "" {
-			tags := strings.Split(vm.Tags, ",")
-			found := false
-			for _, tag := range tags {
-				if tag == searchTag {
-					found = true
-					break
-				}
-			}
-			if !found {
-				continue
-			}
+		if searchTag != "" && !hasTag(vm.Tags, searchTag) {
+			continue
 		}
 
 		vmMap[vm.Name] = vm.UUID
@@ -148,33 +166,31 @@ func VMs(searchTag string) (map[string]string, error) {
 	return vmMap, nil
 }
 
-func VMDisks(vmUUID string) ([]BlockDev, error) {
-	debugReturn := DebugCall(vmUUID)
-
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomain/" + url.PathEscape(vmUUID),
-	}
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+// find a (non-transient) VM by name. Returns nil if there isn't one.
+func findVM(vms []VM, name string) *VM {
+	for i, vm := range vms {
+		if vm.Name == name && !vm.IsTransient {
+			return &vms[i]
+		}
 	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	resp, err := DebugHTTP(client, req)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+	return nil
+}
+
+// return true if tag is in a comma separated list of tags
+func hasTag(tags, tag string) bool {
+	for _, t := range strings.Split(tags, ",") {
+		if t == tag {
+			return true
+		}
 	}
-	defer resp.Body.Close()
+	return false
+}
+
+func (c *ScaleClient) GetVM(ctx context.Context, vmUUID string) (*VM, error) {
+	debugReturn := DebugCall(vmUUID)
+
 	var vms []VM
-	err = json.NewDecoder(resp.Body).Decode(&vms)
+	err := c.do(ctx, "GET", "/rest/v1/VirDomain/"+url.PathEscape(vmUUID), nil, nil, &vms)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
@@ -186,37 +202,59 @@ func VMDisks(vmUUID string) ([]BlockDev, error) {
 		return nil, err
 	}
 
-	debugReturn(vms[0].BlockDevs, nil)
-	return vms[0].BlockDevs, nil
+	debugReturn(vms[0], nil)
+	return &vms[0], nil
 }
 
-func Disks() ([]BlockDev, error) {
-	debugReturn := DebugCall()
+func (c *ScaleClient) VMDisks(ctx context.Context, vmUUID string) ([]BlockDev, error) {
+	debugReturn := DebugCall(vmUUID)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
+	vm, err := c.GetVM(ctx, vmUUID)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomain",
-	}
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
+
+	debugReturn(vm.BlockDevs, nil)
+	return vm.BlockDevs, nil
+}
+
+func (c *ScaleClient) UpdateNetDev(ctx context.Context, netDevUUID string, update NetDevUpdate) (string, error) {
+	debugReturn := DebugCall(netDevUUID, update)
+
+	var task Task
+	err := c.do(ctx, "PATCH", "/rest/v1/VirDomainNetDevice/"+url.PathEscape(netDevUUID), nil, update, &task)
 	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+		debugReturn("", err)
+		return "", err
 	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	resp, err := DebugHTTP(client, req)
+	debugReturn(task.TaskTag, nil)
+	return task.TaskTag, nil
+}
+
+// start, stop, etc. a VM. See VMAction for the available actions.
+func (c *ScaleClient) VMAction(ctx context.Context, vmUUID, actionType string) (string, error) {
+	debugReturn := DebugCall(vmUUID, actionType)
+
+	actions := []VMAction{{
+		VirDomainUUID: vmUUID,
+		ActionType:    actionType,
+	}}
+	var task Task
+	err := c.do(ctx, "POST", "/rest/v1/VirDomain/action", nil, actions, &task)
 	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+		debugReturn("", err)
+		return "", err
 	}
-	defer resp.Body.Close()
+	debugReturn(task.TaskTag, nil)
+	return task.TaskTag, nil
+}
+
+func (c *ScaleClient) Disks(ctx context.Context) ([]BlockDev, error) {
+	debugReturn := DebugCall()
+
 	var vms []VM
-	err = json.NewDecoder(resp.Body).Decode(&vms)
+	err := c.do(ctx, "GET", "/rest/v1/VirDomain", nil, nil, &vms)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
@@ -231,93 +269,71 @@ func Disks() ([]BlockDev, error) {
 	return disks, nil
 }
 
-func CreateSnapshot(vmUUID, snapshotName string, duration time.Duration) (*Task, error) {
-	debugReturn := DebugCall(vmUUID, snapshotName, duration)
+// create a snapshot that is kept for duration (or forever if duration is 0)
+func (c *ScaleClient) CreateSnapshot(ctx context.Context, vmUUID, snapshotName, snapshotType string, duration time.Duration) (*Task, error) {
+	debugReturn := DebugCall(vmUUID, snapshotName, snapshotType, duration)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+	var expireTime int64
+	if duration != 0 {
+		expireTime = clock.Now().Add(duration).Unix()
 	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomainSnapshot",
-	}
-	expireTime := time.Now().Add(duration).Unix()
-	reqBody, err := json.Marshal(Snapshot{
+	snapshot := Snapshot{
 		DomainUUID:                vmUUID,
 		Label:                     snapshotName,
-		Type:                      "AUTOMATED",
+		Type:                      snapshotType,
 		LocalRetainUntilTimestamp: expireTime,
 		Replication:               false,
-	})
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewReader(reqBody))
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
 	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := DebugHTTP(client, req)
+	var task Task
+	err := c.do(ctx, "POST", "/rest/v1/VirDomainSnapshot", nil, snapshot, &task)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-	var task Task
-	err = json.NewDecoder(resp.Body).Decode(&task)
+	debugReturn(task, nil)
+	return &task, nil
+}
+
+// list snapshots of all VMs
+func (c *ScaleClient) Snapshots(ctx context.Context) ([]Snapshot, error) {
+	debugReturn := DebugCall()
+
+	var snapshots []Snapshot
+	err := c.do(ctx, "GET", "/rest/v1/VirDomainSnapshot", nil, nil, &snapshots)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
-	debugReturn(task, nil)
-	return &task, nil
+
+	debugReturn(snapshots, nil)
+	return snapshots, nil
 }
 
-func DiskFromSnapshot(src BlockDev, snap, dstVMUUID string) (string, error) {
-	debugReturn := DebugCall(src)
+func (c *ScaleClient) DeleteSnapshot(ctx context.Context, snapUUID string) (string, error) {
+	debugReturn := DebugCall(snapUUID)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
+	var task Task
+	err := c.do(ctx, "DELETE", "/rest/v1/VirDomainSnapshot/"+url.PathEscape(snapUUID), nil, nil, &task)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
 	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomainBlockDevice/" + url.PathEscape(src.UUID) + "/clone",
-	}
+	debugReturn(task.TaskTag, nil)
+	return task.TaskTag, nil
+}
+
+func (c *ScaleClient) DiskFromSnapshot(ctx context.Context, src BlockDev, snap, dstVMUUID string) (string, error) {
+	debugReturn := DebugCall(src)
+
 	var opts DiskFromSnapshotOpts
 	opts.Options.RegenerateDiskID = false
 	opts.SnapUUID = snap
 	opts.Template.VirDomainUUID = dstVMUUID
 	opts.Template.Type = src.Type
 	opts.Template.Capacity = src.Capacity
-	reqBody, err := json.Marshal(opts)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewReader(reqBody))
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := DebugHTTP(client, req)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	defer resp.Body.Close()
+	apiPath := "/rest/v1/VirDomainBlockDevice/" + url.PathEscape(src.UUID) + "/clone"
 	var task Task
-	err = json.NewDecoder(resp.Body).Decode(&task)
+	err := c.do(ctx, "POST", apiPath, nil, opts, &task)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
@@ -326,33 +342,11 @@ func DiskFromSnapshot(src BlockDev, snap, dstVMUUID string) (string, error) {
 	return task.TaskTag, nil
 }
 
-func GetTask(taskTag string) (*Task, error) {
+func (c *ScaleClient) GetTask(ctx context.Context, taskTag string) (*Task, error) {
 	debugReturn := DebugCall(taskTag)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/TaskTag/" + url.PathEscape(taskTag),
-	}
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	resp, err := DebugHTTP(client, req)
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
-	}
-	defer resp.Body.Close()
 	var tasks []Task
-	err = json.NewDecoder(resp.Body).Decode(&tasks)
+	err := c.do(ctx, "GET", "/rest/v1/TaskTag/"+url.PathEscape(taskTag), nil, nil, &tasks)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
@@ -367,53 +361,61 @@ func GetTask(taskTag string) (*Task, error) {
 	return &tasks[0], nil
 }
 
-func Export(vmUUID, folder string) (string, error) {
-	debugReturn := DebugCall(vmUUID, folder)
+// list every task the cluster knows about
+func (c *ScaleClient) Tasks(ctx context.Context) ([]Task, error) {
+	debugReturn := DebugCall()
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomain/" + url.PathEscape(vmUUID) + "/export",
-	}
-	var exportOptions ExportOptions
-	exportOptions.Target.PathURI = (&url.URL{
-		Scheme: "smb",
-		User: url.UserPassword(
-			smbUserAndDomain(),
-			Config.SMB.Password,
-		),
-		Host: Config.SMB.Host,
-		Path: path.Join("/", Config.SMB.ShareName, folder),
-	}).String()
-	exportOptions.Target.Format = "qcow2"
-	exportOptions.Target.Compress = false
-	exportOptions.Target.AllowNonSequentialWrites = true
-	exportOptions.Target.ParallelCountPerTransfer = 16
-	reqBody, err := json.Marshal(exportOptions)
+	var tasks []Task
+	err := c.do(ctx, "GET", "/rest/v1/TaskTag", nil, nil, &tasks)
 	if err != nil {
-		debugReturn("", err)
-		return "", err
+		debugReturn(nil, err)
+		return nil, err
 	}
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewReader(reqBody))
+	debugReturn(len(tasks), nil)
+	return tasks, nil
+}
+
+// count export and import tasks that are running or waiting to run,
+// whoever started them. Tasks don't have a type field, so we go by the
+// description (ex: "Export VM %@").
+func (c *ScaleClient) ActiveTransfers(ctx context.Context) (int, error) {
+	debugReturn := DebugCall()
+
+	tasks, err := c.Tasks(ctx)
 	if err != nil {
-		debugReturn("", err)
-		return "", err
+		debugReturn(0, err)
+		return 0, err
 	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := DebugHTTP(client, req)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
+
+	count := 0
+	for _, task := range tasks {
+		switch task.State {
+		case "UNINITIALIZED", "QUEUED", "RUNNING":
+		default:
+			continue
+		}
+		description := strings.ToLower(task.FormattedDescription)
+		if strings.Contains(description, "export") || strings.Contains(description, "import") {
+			count++
+		}
 	}
-	defer resp.Body.Close()
+
+	debugReturn(count, nil)
+	return count, nil
+}
+
+func (c *ScaleClient) Export(ctx context.Context, vmUUID, folder string, transfer TransferSettings) (string, error) {
+	debugReturn := DebugCall(vmUUID, folder, transfer)
+
+	var exportOptions ExportOptions
+	exportOptions.Target.PathURI = smbURI(folder)
+	exportOptions.Target.Format = transfer.Format
+	exportOptions.Target.Compress = transfer.Compress
+	exportOptions.Target.AllowNonSequentialWrites = transfer.AllowNonSequentialWrites
+	exportOptions.Target.ParallelCountPerTransfer = transfer.ParallelCountPerTransfer
+	apiPath := "/rest/v1/VirDomain/" + url.PathEscape(vmUUID) + "/export"
 	var task Task
-	err = json.NewDecoder(resp.Body).Decode(&task)
+	err := c.do(ctx, "POST", apiPath, nil, exportOptions, &task)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
@@ -422,53 +424,18 @@ func Export(vmUUID, folder string) (string, error) {
 	return task.TaskTag, nil
 }
 
-func Import(newVMName, folder string) (string, error) {
-	debugReturn := DebugCall(newVMName, folder)
+func (c *ScaleClient) Import(ctx context.Context, template VMTemplate, folder string, transfer TransferSettings) (string, error) {
+	debugReturn := DebugCall(template, folder, transfer)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirDomain/import",
-	}
+	// compression is detected automatically on import
 	var importOptions ImportOptions
-	importOptions.Source.PathURI = (&url.URL{
-		Scheme: "smb",
-		User: url.UserPassword(
-			smbUserAndDomain(),
-			Config.SMB.Password,
-		),
-		Host: Config.SMB.Host,
-		Path: path.Join("/", Config.SMB.ShareName, folder),
-	}).String()
-	importOptions.Source.Format = "qcow2"
-	importOptions.Source.AllowNonSequentialWrites = true
-	importOptions.Source.ParallelCountPerTransfer = 16
-	importOptions.Template.Name = newVMName
-	reqBody, err := json.Marshal(importOptions)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewReader(reqBody))
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := DebugHTTP(client, req)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	defer resp.Body.Close()
+	importOptions.Source.PathURI = smbURI(folder)
+	importOptions.Source.Format = transfer.Format
+	importOptions.Source.AllowNonSequentialWrites = transfer.AllowNonSequentialWrites
+	importOptions.Source.ParallelCountPerTransfer = transfer.ParallelCountPerTransfer
+	importOptions.Template = template
 	var task Task
-	err = json.NewDecoder(resp.Body).Decode(&task)
+	err := c.do(ctx, "POST", "/rest/v1/VirDomain/import", nil, importOptions, &task)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
@@ -477,52 +444,39 @@ func Import(newVMName, folder string) (string, error) {
 	return task.TaskTag, nil
 }
 
-func Upload(filename string, fileSize int64, file io.Reader) (string, error) {
+// Upload streams the file to Scale. Since the body can only be read once,
+// this is the one request that is never retried.
+func (c *ScaleClient) Upload(ctx context.Context, filename string, fileSize int64, file io.Reader) (string, error) {
 	debugReturn := DebugCall(filename, fileSize, file)
 
-	client, err := tofu.GetTofuClient(Config.Scale.CertFingerprint)
+	apiURL := c.BaseURL
+	apiURL.Path = "/rest/v1/VirtualDisk/upload"
+	apiURL.RawQuery = url.Values{
+		"filename": []string{filename},
+		"filesize": []string{strconv.FormatInt(fileSize, 10)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "PUT", apiURL.String(), file)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
 	}
-	apiURL := url.URL{
-		Scheme: "https",
-		Host:   Config.Scale.Host,
-		Path:   "/rest/v1/VirtualDisk/upload",
-		RawQuery: url.Values{
-			"filename": []string{filename},
-			"filesize": []string{strconv.FormatInt(fileSize, 10)},
-		}.Encode(),
-	}
-	req, err := http.NewRequest("PUT", apiURL.String(), file)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	req.SetBasicAuth(Config.Scale.Username, Config.Scale.Password)
+	req.SetBasicAuth(c.Username, c.Password)
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.ContentLength = fileSize
-	resp, err := client.Do(req)
-	if err != nil {
-		debugReturn("", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
+	resp, err := DebugHTTP(c.HTTP, req)
 	if err != nil {
 		debugReturn("", err)
 		return "", err
 	}
 
 	var task Task
-	err = json.Unmarshal(respBody, &task)
+	err = decodeResponse(req, resp, &task)
 	if err != nil {
-		err := fmt.Errorf("error unmarshalling task: %w\n%s", err, respBody)
 		debugReturn("", err)
 		return "", err
 	}
 	if task.CreatedUUID == "" {
-		err := fmt.Errorf("task createdUUID is empty: %s", respBody)
+		err := fmt.Errorf("task createdUUID is empty")
 		debugReturn("", err)
 		return "", err
 	}
@@ -531,6 +485,19 @@ func Upload(filename string, fileSize int64, file io.Reader) (string, error) {
 	return task.CreatedUUID, nil
 }
 
+// build the URI Scale uses to reach a folder on our share
+func smbURI(folder string) string {
+	return (&url.URL{
+		Scheme: "smb",
+		User: url.UserPassword(
+			smbUserAndDomain(),
+			Config.SMB.Password,
+		),
+		Host: Config.SMB.Host,
+		Path: path.Join("/", Config.SMB.ShareName, folder),
+	}).String()
+}
+
 func smbUserAndDomain() string {
 	if Config.SMB.Domain == "" {
 		return Config.SMB.Username
@@ -1,53 +1,81 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/hyperjumptech/jiffy"
+	"github.com/dustin/go-humanize"
 )
 
-// return true if we are currently in the scheduled backup window
+// return true if we are currently in a scheduled backup window and it
+// isn't a blackout date
 func ScheduleIsActive() bool {
 	debugReturn := DebugCall()
 
-	// we already validated these when we validated the config
-	start, err := time.Parse("3:04 PM", Config.Schedule.StartTime)
-	if err != nil {
-		panic(err)
+	now := clock.Now()
+	for _, window := range windowIntervals(now, 1) {
+		// start 1 minute early just in case whatever launches this
+		// program is a little off
+		start := window.Start.Add(-1 * time.Minute)
+		if now.After(start) && now.Before(window.End) {
+			debugReturn(true)
+			return true
+		}
 	}
-	end, err := time.Parse("3:04 PM", Config.Schedule.EndTime)
-	if err != nil {
-		panic(err)
-	}
-
-	// subtract 1 minute from the start time just in case whatever launches
-	// this program is a little off
-	start = start.Add(-1 * time.Minute)
-
-	// current time without date or timezone
-	now := time.Now()
-	nowTime := time.Date(
-		0, 1, 1,
-		now.Hour(), now.Minute(), now.Second(), now.Nanosecond(),
-		time.UTC,
-	)
-
-	if start.Before(end) {
-		// if the schedule does not cross midnight
-		ret := nowTime.After(start) && nowTime.Before(end)
-		debugReturn(ret)
-		return ret
-	} else {
-		// if the schedule does cross midnight
-		ret := nowTime.After(start) || nowTime.Before(end)
-		debugReturn(ret)
-		return ret
+
+	debugReturn(false)
+	return false
+}
+
+// how often to check whether the cluster has room for another export
+var clusterPollInterval = 30 * time.Second
+
+// wait until the cluster is running fewer than Concurrency exports and
+// imports, counting ours and anyone else's (started by hand, by another
+// scale-backup, or by replication). Returns false if we were interrupted
+// or the backup window closed while we waited. If we can't get the list of
+// tasks, we go ahead and rely on our own limit.
+func waitForClusterSlot(ctx context.Context) bool {
+	debugReturn := DebugCall()
+
+	waiting := false
+	for {
+		active, err := Scale.ActiveTransfers(ctx)
+		if ctx.Err() != nil {
+			debugReturn(false)
+			return false
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check running tasks on the cluster: %s\n", err)
+			debugReturn(true)
+			return true
+		}
+		if active < Config.Schedule.Concurrency {
+			debugReturn(true)
+			return true
+		}
+
+		if !waiting {
+			fmt.Printf(
+				"Cluster is already running %d exports/imports. Waiting for one to finish...\n",
+				active,
+			)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(clusterPollInterval):
+		}
+		if ctx.Err() == nil && !ScheduleIsActive() {
+			fmt.Println("Backup window closed while waiting for the cluster")
+			debugReturn(false)
+			return false
+		}
 	}
 }
 
@@ -68,154 +96,199 @@ func parseDateTime(fullName string) (time.Time, string, error) {
 	return t, name, err
 }
 
-// search local path for backups, listing each one for each VM
+// search local path for backups, listing each one under the VM name it was
+// made with (see groupBackups to follow renames). Only backups that
+// finished count (see BackupFolder.Usable).
 func Backups() (map[string][]time.Time, error) {
 	debugReturn := DebugCall()
 
-	entries, err := os.ReadDir(Config.SMB.LocalPath)
+	folders, err := BackupFolders()
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
 
+	backups := usableBackups(folders)
+	debugReturn(backups, nil)
+	return backups, nil
+}
+
+// group the usable backups in a list of folders by the VM name in the folder
+func usableBackups(folders []BackupFolder) map[string][]time.Time {
+	// folders are sorted newest first, so the backups for each VM are too
 	backups := make(map[string][]time.Time)
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		t, name, err := parseDateTime(entry.Name())
-		if err != nil {
-			continue
+	for _, folder := range folders {
+		if folder.Usable() {
+			backups[folder.VMName] = append(backups[folder.VMName], folder.Time)
 		}
-		backups[name] = append(backups[name], t)
 	}
+	return backups
+}
 
-	// sort the backups for each VM (newest first)
-	for _, times := range backups {
-		sort.Slice(times, func(i, j int) bool {
-			return times[i].After(times[j])
-		})
-	}
+// a VM that is due for a backup, and why it is where it is in the queue
+type QueuedVM struct {
+	Name   string
+	UUID   string
+	Policy BackupPolicy
+	// zero if the VM has never been backed up
+	LastBackup time.Time
+	// how far past due it is (MaxInt64 if never backed up)
+	Overdue time.Duration
+	// including FailureBoost if the last scheduled backup failed
+	Priority int
+	// explains Priority, for show-queue
+	PriorityFrom string
+	LastFailed   bool
+	// bytes allocated on the cluster, for Order = "smallest"
+	Size int64
+}
 
-	debugReturn(backups, nil)
-	return backups, nil
+// explain why a VM is where it is in the queue
+func (vm QueuedVM) Why() string {
+	var reasons []string
+	if vm.PriorityFrom != "" {
+		priority := vm.Priority
+		if vm.LastFailed {
+			priority -= Config.Schedule.FailureBoost
+		}
+		reasons = append(reasons, fmt.Sprintf("priority %d from %s", priority, vm.PriorityFrom))
+	}
+	if vm.LastFailed && Config.Schedule.FailureBoost != 0 {
+		reasons = append(reasons, fmt.Sprintf(
+			"last scheduled backup failed (+%d priority)",
+			Config.Schedule.FailureBoost,
+		))
+	} else if vm.LastFailed {
+		reasons = append(reasons, "last scheduled backup failed")
+	}
+	if Config.Schedule.Order == "smallest" {
+		reasons = append(reasons, humanize.Bytes(uint64(vm.Size))+" on the cluster")
+	}
+	if vm.LastBackup.IsZero() {
+		reasons = append(reasons, "never backed up")
+	} else {
+		reasons = append(reasons, describeAge(vm.Overdue)+" overdue")
+	}
+	return strings.Join(reasons, ", ")
 }
 
-// list VMs that need to be backed up, sorted by priority
-func BackupQueue(interval time.Duration) ([]string, error) {
-	debugReturn := DebugCall(interval)
+// list VMs that need to be backed up, in the order they should be backed
+// up. Higher priority VMs come first. Within a priority, VMs are ordered
+// most overdue first, or smallest first if Order is "smallest". A VM is
+// due once its last backup is older than its policy's BackupInterval, plus
+// its Tolerance if withTolerance is set.
+func BackupQueue(ctx context.Context, withTolerance bool) ([]string, error) {
+	debugReturn := DebugCall(withTolerance)
 
-	// get a list of all VMs
-	vms, err := VMs(Config.Schedule.Tag)
+	queue, err := backupQueue(ctx, withTolerance)
 	if err != nil {
 		debugReturn(nil, err)
 		return nil, err
 	}
 
-	// get a list of all backups
-	backups, err := Backups()
-	if err != nil {
-		debugReturn(nil, err)
-		return nil, err
+	// return a list of VM names
+	var vmNames []string
+	for _, vm := range queue {
+		vmNames = append(vmNames, vm.Name)
 	}
+	debugReturn(vmNames, nil)
+	return vmNames, nil
+}
 
-	// get backup ages for all VMs (MaxInt64 if never backed up)
-	backupAges := make(map[string]time.Duration)
-	for name := range vms {
-		// if the VM has never been backed up
-		if _, exists := backups[name]; !exists {
-			backupAges[name] = time.Duration(math.MaxInt64)
-			continue
-		}
-
-		lastBackup := backups[name][0]
-		backupAges[name] = time.Since(lastBackup)
+func backupQueue(ctx context.Context, withTolerance bool) ([]QueuedVM, error) {
+	// get a list of all VMs
+	vms, err := Scale.VMList(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	// list VMs to backup
-	type vmToBackup struct {
-		name string
-		age  time.Duration
+	// get a list of all backups, by VM so renamed VMs keep their history
+	folders, err := BackupFolders()
+	if err != nil {
+		return nil, err
 	}
-	var vmsToBackup []vmToBackup
-	for name, age := range backupAges {
-		if age > interval {
-			vmsToBackup = append(vmsToBackup, vmToBackup{name, age})
+	backups := make(map[string][]time.Time)
+	for _, group := range groupBackups(folders, vms) {
+		if group.VM != nil {
+			backups[group.UUID] = group.Usable()
 		}
 	}
 
-	// sort VMs to backup by age (oldest first)
-	sort.Slice(vmsToBackup, func(i, j int) bool {
-		return vmsToBackup[j].age < vmsToBackup[i].age
-	})
-
-	// return a list of VM names
-	var vmNames []string
-	for _, vm := range vmsToBackup {
-		vmNames = append(vmNames, vm.name)
+	// VMs with an export already running don't need another one
+	jobs, err := loadJobs()
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool)
+	for _, job := range jobs {
+		running[job.VMUUID] = true
 	}
-	debugReturn(vmNames, nil)
-	return vmNames, nil
-}
-
-// delete old backups
-func Cleanup() error {
-	debugReturn := DebugCall()
 
-	backups, err := Backups()
+	// the queue still works without history, VMs just don't get boosted
+	history, err := loadHistory()
 	if err != nil {
-		debugReturn(err)
-		return err
+		fmt.Fprintf(os.Stderr, "Failed to load backup history: %s\n", err)
 	}
 
-	maxAge := time.Duration(math.MaxInt64)
-	if Config.Schedule.MaxAge != "" {
-		// already validated from when we validated the config
-		maxAge, err = jiffy.DurationOf(Config.Schedule.MaxAge)
-		if err != nil {
-			panic(err)
+	var queue []QueuedVM
+	for _, vm := range vms {
+		if vm.IsTransient || running[vm.UUID] {
+			continue
+		}
+		if Config.Schedule.Tag != "" && !hasTag(vm.Tags, Config.Schedule.Tag) {
+			continue
 		}
-	}
 
-	maxBackups := math.MaxInt64
-	if Config.Schedule.MaxBackups != 0 {
-		maxBackups = Config.Schedule.MaxBackups
-	}
+		queued := QueuedVM{
+			Name:    vm.Name,
+			UUID:    vm.UUID,
+			Policy:  PolicyFor(vm.Name, vm.Tags),
+			Overdue: time.Duration(math.MaxInt64),
+		}
 
-	var backupsToDelete []string
-	for vmName, backupTimes := range backups {
-		for i, backupTime := range backupTimes {
-			// if backup is too old
-			if time.Since(backupTime) > maxAge {
-				folderName := DateTimePrefix(backupTime, vmName)
-				backupsToDelete = append(backupsToDelete, folderName)
+		// VMs that have never been backed up are always due
+		if vmBackups := backups[vm.UUID]; len(vmBackups) != 0 {
+			due := queued.Policy.Interval
+			if withTolerance {
+				due += queued.Policy.Tolerance
 			}
-
-			// if there are too many backups
-			if i >= maxBackups {
-				folderName := DateTimePrefix(backupTime, vmName)
-				backupsToDelete = append(backupsToDelete, folderName)
+			queued.LastBackup = vmBackups[0]
+			age := since(queued.LastBackup)
+			if age <= due {
+				continue
 			}
+			queued.Overdue = age - due
 		}
-	}
 
-	// sanity check that we are deleting less than 50% of backups
-	deletionPercentage := 100 * float64(len(backupsToDelete)) / float64(len(backups))
-	if deletionPercentage > 50 {
-		err := fmt.Errorf("refusing to delete %.0f%% of backups", deletionPercentage)
-		debugReturn(err)
-		return err
-	}
+		queued.Priority = queued.Policy.Priority
+		if queued.Priority != 0 {
+			queued.PriorityFrom = queued.Policy.Name + " policy"
+		}
+		if priority, ok := tagPriority(vm.Name, vm.Tags); ok {
+			queued.Priority = priority
+			queued.PriorityFrom = "tag"
+		}
+		if lastAttemptFailed(history, vm.UUID, vm.Name) {
+			queued.LastFailed = true
+			queued.Priority += Config.Schedule.FailureBoost
+		}
 
-	// delete backups
-	for _, folderName := range backupsToDelete {
-		err := os.RemoveAll(filepath.Join(Config.SMB.LocalPath, folderName))
-		if err != nil {
-			debugReturn(err)
-			return err
+		for _, disk := range vm.BlockDevs {
+			queued.Size += int64(disk.Allocation)
 		}
+
+		queue = append(queue, queued)
 	}
 
-	debugReturn(nil)
-	return nil
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].Priority != queue[j].Priority {
+			return queue[i].Priority > queue[j].Priority
+		}
+		if Config.Schedule.Order == "smallest" {
+			return queue[i].Size < queue[j].Size
+		}
+		return queue[i].Overdue > queue[j].Overdue
+	})
+
+	return queue, nil
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func setClock(t *testing.T, now time.Time) *fakeClock {
+	saved := clock
+	t.Cleanup(func() { clock = saved })
+	c := &fakeClock{now: now}
+	clock = c
+	return c
+}
+
+// create empty backup folders for each VM, aged relative to the clock
+func makeBackups(t *testing.T, ages map[string][]time.Duration) {
+	for vmName, vmAges := range ages {
+		for _, age := range vmAges {
+			name := DateTimePrefix(clock.Now().Add(-age), vmName)
+			err := os.Mkdir(filepath.Join(Config.SMB.LocalPath, name), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// list backup ages for each VM, newest first
+func backupAges(t *testing.T) map[string][]time.Duration {
+	backups, err := Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages := make(map[string][]time.Duration)
+	for vmName, times := range backups {
+		for _, backupTime := range times {
+			ages[vmName] = append(ages[vmName], since(backupTime))
+		}
+	}
+	return ages
+}
+
+func TestScheduleIsActive(t *testing.T) {
+	savedConfig := Config
+	t.Cleanup(func() { Config = savedConfig })
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone data not available:", err)
+	}
+
+	day := func(hour, min, sec int) time.Time {
+		return time.Date(2024, 3, 14, hour, min, sec, 0, time.Local)
+	}
+	tests := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		want       bool
+	}{
+		{"same day, inside", "9:00 AM", "5:00 PM", day(12, 0, 0), true},
+		{"same day, before", "9:00 AM", "5:00 PM", day(8, 0, 0), false},
+		{"same day, after", "9:00 AM", "5:00 PM", day(17, 30, 0), false},
+		{"same day, at end", "9:00 AM", "5:00 PM", day(17, 0, 0), false},
+		{"midnight, evening", "5:00 PM", "6:00 AM", day(23, 59, 59), true},
+		{"midnight, at midnight", "5:00 PM", "6:00 AM", day(0, 0, 0), true},
+		{"midnight, morning", "5:00 PM", "6:00 AM", day(5, 59, 0), true},
+		{"midnight, after end", "5:00 PM", "6:00 AM", day(6, 0, 1), false},
+		{"midnight, afternoon", "5:00 PM", "6:00 AM", day(14, 0, 0), false},
+		{"start fudge, 30s early", "5:00 PM", "6:00 AM", day(16, 59, 30), true},
+		{"start fudge, 2m early", "5:00 PM", "6:00 AM", day(16, 58, 0), false},
+		{"start fudge, just before fudge", "5:00 PM", "6:00 AM", day(16, 59, 0), false},
+		// clocks jump from 2:00 AM to 3:00 AM on 2024-03-10 in New York.
+		// The window is based on wall-clock time, so it ends at 3:00 AM
+		// local time even though that is only 30 minutes after 1:30 AM.
+		{"DST, before jump", "1:30 AM", "3:00 AM", time.Date(2024, 3, 10, 1, 45, 0, 0, newYork), true},
+		{"DST, after jump", "1:30 AM", "3:00 AM", time.Date(2024, 3, 10, 1, 45, 0, 0, newYork).Add(30 * time.Minute), false},
+		// clocks fall back from 2:00 AM to 1:00 AM on 2024-11-03, so 1:30
+		// AM happens twice and both are inside the window
+		{"DST, first 1:30", "1:00 AM", "2:00 AM", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC).In(newYork), true},
+		{"DST, second 1:30", "1:00 AM", "2:00 AM", time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC).In(newYork), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Config.Schedule.StartTime = test.start
+			Config.Schedule.EndTime = test.end
+			setClock(t, test.now)
+			got := ScheduleIsActive()
+			if got != test.want {
+				t.Errorf("ScheduleIsActive() at %s = %v, want %v", test.now, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDateTimePrefix(t *testing.T) {
+	backupTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+	name := DateTimePrefix(backupTime, "My VM")
+	if name != "2024-01-02_15-04-05 My VM" {
+		t.Errorf("unexpected folder name %q", name)
+	}
+	parsedTime, vmName, err := parseDateTime(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsedTime.Equal(backupTime) || vmName != "My VM" {
+		t.Errorf("round trip gave %s %q", parsedTime, vmName)
+	}
+	_, _, err = parseDateTime("not a backup")
+	if err == nil {
+		t.Error("expected an error for a folder without a timestamp")
+	}
+}
+
+func TestBackupQueue(t *testing.T) {
+	fake := setupFakeScale(t)
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+	Config.Schedule.Tag = "BackMeUp"
+	Config.Schedule.BackupInterval = "7 days"
+	for _, name := range []string{"new", "stale", "staler", "fresh"} {
+		fake.AddVM(name, "BackMeUp")
+	}
+	fake.AddVM("untagged")
+	makeBackups(t, map[string][]time.Duration{
+		"stale":    {8 * 24 * time.Hour},
+		"staler":   {9 * 24 * time.Hour, time.Hour * 24 * 30},
+		"fresh":    {6 * 24 * time.Hour},
+		"untagged": {30 * 24 * time.Hour},
+		"deleted":  {30 * 24 * time.Hour},
+	})
+
+	queue, err := BackupQueue(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"new", "staler", "stale"}
+	if !reflect.DeepEqual(queue, want) {
+		t.Errorf("BackupQueue() = %v, want %v", queue, want)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name       string
+		maxBackups int
+		maxAge     string
+		before     map[string][]time.Duration
+		after      map[string][]time.Duration
+	}{
+		{
+			name:       "MaxBackups only",
+			maxBackups: 2,
+			before: map[string][]time.Duration{
+				"a": {1 * day, 2 * day, 3 * day},
+				"b": {1 * day},
+				"c": {1 * day},
+			},
+			after: map[string][]time.Duration{
+				"a": {1 * day, 2 * day},
+				"b": {1 * day},
+				"c": {1 * day},
+			},
+		},
+		{
+			name:   "MaxAge only",
+			maxAge: "10 days",
+			before: map[string][]time.Duration{
+				"a": {1 * day, 5 * day, 20 * day},
+				"b": {2 * day},
+				"c": {3 * day},
+			},
+			after: map[string][]time.Duration{
+				"a": {1 * day, 5 * day},
+				"b": {2 * day},
+				"c": {3 * day},
+			},
+		},
+		{
+			name:       "MaxBackups and MaxAge",
+			maxBackups: 3,
+			maxAge:     "10 days",
+			before: map[string][]time.Duration{
+				"a": {1 * day, 5 * day, 8 * day, 20 * day},
+				"b": {2 * day},
+				"c": {3 * day},
+			},
+			after: map[string][]time.Duration{
+				"a": {1 * day, 5 * day, 8 * day},
+				"b": {2 * day},
+				"c": {3 * day},
+			},
+		},
+		{
+			// MaxAge used to remove all of a deleted VM's backups, but
+			// the newest backup of every VM is now kept (see
+			// applyRetention), so this one has to be deleted by hand
+			name:       "MaxAge keeps the newest backup of deleted VMs",
+			maxBackups: 5,
+			maxAge:     "10 days",
+			before: map[string][]time.Duration{
+				"a":       {1 * day},
+				"b":       {1 * day},
+				"deleted": {15 * day, 20 * day},
+			},
+			after: map[string][]time.Duration{
+				"a":       {1 * day},
+				"b":       {1 * day},
+				"deleted": {15 * day},
+			},
+		},
+		{
+			name:       "safety check",
+			maxBackups: 1,
+			before: map[string][]time.Duration{
+				"a": {1 * day, 2 * day, 3 * day, 4 * day},
+			},
+			after: map[string][]time.Duration{
+				"a": {1 * day, 2 * day, 3 * day, 4 * day},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupFakeScale(t)
+			setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+			Config.Schedule.MaxBackups = test.maxBackups
+			Config.Schedule.MaxAge = test.maxAge
+			makeBackups(t, test.before)
+
+			err := Cleanup(context.Background())
+			if err != nil {
+				t.Errorf("Cleanup() error = %v", err)
+			}
+			got := backupAges(t)
+			for _, ages := range got {
+				sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+			}
+			if !reflect.DeepEqual(got, test.after) {
+				t.Errorf("backups after Cleanup() = %v, want %v", got, test.after)
+			}
+		})
+	}
+}
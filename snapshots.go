@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clone-disk labels its temporary snapshots with this followed by the UUID
+// of the disk being cloned
+const cloneSnapshotPrefix = "clone-"
+
+func ShowSnapshots(ctx context.Context, vmName string) {
+	DebugCall(vmName)
+
+	vms, err := Scale.VMs(ctx, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of VMs: %s\n", err)
+		return
+	}
+	vmUUID, exists := vms[vmName]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "VM %s not found\n", vmName)
+		return
+	}
+
+	snapshots, err := Scale.Snapshots(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of snapshots: %s\n", err)
+		return
+	}
+
+	// oldest first
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp < snapshots[j].Timestamp
+	})
+	for _, snap := range snapshots {
+		if snap.DomainUUID != vmUUID {
+			continue
+		}
+		created := time.Unix(snap.Timestamp, 0).Format("2006-01-02 03:04 PM")
+		retain := "forever"
+		if snap.LocalRetainUntilTimestamp != 0 {
+			retain = "until " + time.Unix(snap.LocalRetainUntilTimestamp, 0).Format("2006-01-02 03:04 PM")
+		}
+		fmt.Printf(
+			"%s: %s %s (%s, kept %s)\n",
+			snap.UUID,
+			created,
+			snap.Label,
+			snap.Type,
+			retain,
+		)
+	}
+}
+
+// take a snapshot, kept for retain (or forever if retain is 0)
+func CreateSnapshot(ctx context.Context, vmName, label string, retain time.Duration) {
+	DebugCall(vmName, label, retain)
+
+	vms, err := Scale.VMs(ctx, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of VMs: %s\n", err)
+		return
+	}
+	vmUUID, exists := vms[vmName]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "VM %s not found\n", vmName)
+		return
+	}
+
+	task, err := Scale.CreateSnapshot(ctx, vmUUID, label, "USER", retain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create snapshot: %s\n", err)
+		return
+	}
+	_, err = Scale.WaitForTask(ctx, task.TaskTag, WaitOptions{
+		Timeout:  time.Hour,
+		Progress: printTaskProgress("Snapshot"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Snapshot failed: %s\n", err)
+		return
+	}
+	fmt.Printf("Created snapshot %s\n", task.CreatedUUID)
+}
+
+func DeleteSnapshot(ctx context.Context, snapUUID string) {
+	DebugCall(snapUUID)
+
+	err := deleteSnapshot(ctx, snapUUID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete snapshot %s: %s\n", snapUUID, err)
+		return
+	}
+	fmt.Printf("Deleted snapshot %s\n", snapUUID)
+}
+
+func deleteSnapshot(ctx context.Context, snapUUID string) error {
+	taskTag, err := Scale.DeleteSnapshot(ctx, snapUUID)
+	if err != nil {
+		return err
+	}
+	_, err = Scale.WaitForTask(ctx, taskTag, WaitOptions{
+		Timeout: time.Hour,
+	})
+	return err
+}
+
+// delete temporary snapshots left behind by clone-disk. Those are the
+// AUTOMATED ones labeled with cloneSnapshotPrefix, so a user's snapshot that
+// happens to share the prefix is left alone. A snapshot is stale once its
+// retention has run out and it is older than olderThan (so we don't pull one
+// out from under a clone that is still running).
+func PruneSnapshots(ctx context.Context, olderThan time.Duration) {
+	DebugCall(olderThan)
+
+	snapshots, err := Scale.Snapshots(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get list of snapshots: %s\n", err)
+		return
+	}
+
+	now := clock.Now()
+	pruned := 0
+	for _, snap := range snapshots {
+		if snap.Type != "AUTOMATED" || !strings.HasPrefix(snap.Label, cloneSnapshotPrefix) {
+			continue
+		}
+		retained := snap.LocalRetainUntilTimestamp == 0 ||
+			now.Before(time.Unix(snap.LocalRetainUntilTimestamp, 0))
+		if retained {
+			continue
+		}
+		if now.Sub(time.Unix(snap.Timestamp, 0)) < olderThan {
+			continue
+		}
+
+		fmt.Printf("Deleting snapshot %s (%s)\n", snap.UUID, snap.Label)
+		err := deleteSnapshot(ctx, snap.UUID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete snapshot %s: %s\n", snap.UUID, err)
+			continue
+		}
+		pruned++
+	}
+	fmt.Printf("Deleted %d stale snapshots\n", pruned)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCreateAndDeleteSnapshot(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	ctx := context.Background()
+
+	CreateSnapshot(ctx, "web01", "before-upgrade", 0)
+
+	snapshots, err := Scale.Snapshots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected 1 snapshot, got %d", len(snapshots))
+	}
+	snap := snapshots[0]
+	if snap.DomainUUID != vm.UUID || snap.Label != "before-upgrade" || snap.Type != "USER" {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+	if snap.LocalRetainUntilTimestamp != 0 {
+		t.Error("snapshot without --retain should be kept forever")
+	}
+
+	DeleteSnapshot(ctx, snap.UUID)
+	if fake.HasSnapshot(snap.UUID) {
+		t.Error("snapshot was not deleted")
+	}
+}
+
+func TestSnapshotRetentionUsesClock(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("web01")
+	ctx := context.Background()
+	now := setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)).Now()
+
+	CreateSnapshot(ctx, "web01", "before-upgrade", time.Hour)
+
+	snapshots, err := Scale.Snapshots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected 1 snapshot, got %d", len(snapshots))
+	}
+	want := now.Add(time.Hour).Unix()
+	if got := snapshots[0].LocalRetainUntilTimestamp; got != want {
+		t.Errorf("expected the snapshot to be retained until %d, got %d", want, got)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	setClock(t, time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local))
+
+	stale := fake.AddSnapshot(vm, "clone-disk-1", "AUTOMATED", 2*time.Hour, time.Minute)
+	recent := fake.AddSnapshot(vm, "clone-disk-2", "AUTOMATED", 10*time.Minute, time.Minute)
+	retained := fake.AddSnapshot(vm, "clone-disk-3", "AUTOMATED", 2*time.Hour, 0)
+	user := fake.AddSnapshot(vm, "before-upgrade", "USER", 2*time.Hour, time.Minute)
+	userClone := fake.AddSnapshot(vm, "clone-test", "USER", 2*time.Hour, time.Minute)
+
+	PruneSnapshots(context.Background(), time.Hour)
+
+	if fake.HasSnapshot(stale) {
+		t.Error("stale clone snapshot should be deleted")
+	}
+	if !fake.HasSnapshot(recent) {
+		t.Error("recent clone snapshot might still be in use and should be kept")
+	}
+	if !fake.HasSnapshot(retained) {
+		t.Error("clone snapshot that is retained forever should be kept")
+	}
+	if !fake.HasSnapshot(user) {
+		t.Error("non-clone snapshot should be kept")
+	}
+	if !fake.HasSnapshot(userClone) {
+		t.Error("user snapshot labeled like a clone snapshot should be kept")
+	}
+}
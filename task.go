@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// how often WaitForTask checks on a task unless told otherwise
+var defaultPollInterval = 5 * time.Second
+
+var (
+	ErrTaskFailed      = errors.New("task failed")
+	ErrTaskNotStarted  = errors.New("task failed to start")
+	ErrTaskTimeout     = errors.New("timed out waiting for task")
+	ErrTaskStalled     = errors.New("task stalled")
+	ErrTaskUnreachable = errors.New("cannot retrieve task status")
+)
+
+type WaitOptions struct {
+	// how often to check on the task (default defaultPollInterval)
+	PollInterval time.Duration
+	// give up if the task hasn't finished after this long (0 = never)
+	Timeout time.Duration
+	// give up if a running task's progress doesn't change for this long.
+	// Time spent QUEUED behind other tasks doesn't count. (0 = never)
+	StallTimeout time.Duration
+	// give up after this many failed polls in a row (default 5)
+	MaxErrors int
+	// called whenever the state or progress of the task changes
+	Progress func(Task)
+}
+
+type TaskResult struct {
+	Task     Task
+	Started  time.Time
+	Finished time.Time
+}
+
+func (r *TaskResult) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// TaskError is returned by WaitForTask. Use errors.Is with one of the
+// ErrTask* values to find out why we stopped waiting.
+type TaskError struct {
+	TaskTag string
+	Reason  error
+	// the last status we got, nil if we never got one
+	Task *Task
+	// the error from the last failed poll, if any
+	Err error
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.TaskTag, e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Task != nil {
+		taskJSON, _ := json.MarshalIndent(e.Task, "", "\t")
+		msg += "\n" + string(taskJSON)
+	}
+	return msg
+}
+
+func (e *TaskError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Reason}
+	}
+	return []error{e.Reason, e.Err}
+}
+
+// poll a task until it completes, fails, or we give up on it
+func (c *ScaleClient) WaitForTask(ctx context.Context, taskTag string, opts WaitOptions) (*TaskResult, error) {
+	debugReturn := DebugCall(taskTag, opts.PollInterval, opts.Timeout, opts.StallTimeout)
+
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.MaxErrors == 0 {
+		opts.MaxErrors = 5
+	}
+	if opts.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	result := &TaskResult{Started: time.Now()}
+	fail := func(reason error, task *Task, err error) (*TaskResult, error) {
+		taskErr := &TaskError{
+			TaskTag: taskTag,
+			Reason:  reason,
+			Task:    task,
+			Err:     err,
+		}
+		debugReturn(nil, taskErr.Error())
+		return nil, taskErr
+	}
+
+	var last *Task
+	lastChange := time.Now()
+	errCount := 0
+	for {
+		task, err := c.GetTask(ctx, taskTag)
+		if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && opts.Timeout != 0 {
+				return fail(ErrTaskTimeout, last, nil)
+			}
+			return fail(ctx.Err(), last, nil)
+		}
+		if err != nil {
+			errCount++
+			if errCount > opts.MaxErrors {
+				return fail(ErrTaskUnreachable, last, err)
+			}
+		} else {
+			changed := last == nil ||
+				last.State != task.State ||
+				last.ProgressPercent != task.ProgressPercent
+			if changed {
+				lastChange = time.Now()
+				if opts.Progress != nil {
+					opts.Progress(*task)
+				}
+			}
+			last = task
+
+			switch task.State {
+			case "COMPLETE":
+				result.Task = *task
+				result.Finished = time.Now()
+				debugReturn(result, nil)
+				return result, nil
+			case "ERROR":
+				return fail(ErrTaskFailed, task, nil)
+			case "QUEUED":
+				errCount = 0
+				// waiting on other tasks is not a stall
+				lastChange = time.Now()
+			case "RUNNING":
+				errCount = 0
+				stalled := opts.StallTimeout != 0 &&
+					time.Since(lastChange) > opts.StallTimeout
+				if stalled {
+					return fail(ErrTaskStalled, task, nil)
+				}
+			case "UNINITIALIZED":
+				errCount++
+				if errCount > opts.MaxErrors {
+					return fail(ErrTaskNotStarted, task, nil)
+				}
+			default:
+				errCount++
+				if errCount > opts.MaxErrors {
+					unknown := fmt.Errorf("unknown task state %q", task.State)
+					return fail(ErrTaskFailed, task, unknown)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// reported at the top of the loop
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// return a WaitOptions.Progress function that prints status updates to
+// stdout, prefixed with label
+func printTaskProgress(label string) func(Task) {
+	return func(task Task) {
+		switch task.State {
+		case "QUEUED":
+			fmt.Println("Waiting for other tasks on the cluster to complete...")
+		case "RUNNING":
+			fmt.Printf("%s: %d%% complete\n", label, task.ProgressPercent)
+		}
+	}
+}
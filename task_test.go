@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForTask(t *testing.T) {
+	fake := setupFakeScale(t)
+	vm := fake.AddVM("web01")
+	ctx := context.Background()
+
+	// success, with a progress update for every state change
+	task, err := Scale.CreateSnapshot(ctx, vm.UUID, "test", "USER", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	result, err := Scale.WaitForTask(ctx, task.TaskTag, WaitOptions{
+		Progress: func(task Task) { states = append(states, task.State) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Task.State != "COMPLETE" || result.Task.CreatedUUID == "" {
+		t.Errorf("unexpected result %+v", result.Task)
+	}
+	if len(states) != 3 {
+		t.Errorf("expected QUEUED, RUNNING, COMPLETE updates, got %v", states)
+	}
+
+	// failure
+	fake.FailNext("snapshot")
+	task, err = Scale.CreateSnapshot(ctx, vm.UUID, "test", "USER", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Scale.WaitForTask(ctx, task.TaskTag, WaitOptions{})
+	if !errors.Is(err, ErrTaskFailed) {
+		t.Errorf("expected task failure, got %v", err)
+	}
+
+	// a task that doesn't exist
+	_, err = Scale.WaitForTask(ctx, "no-such-task", WaitOptions{MaxErrors: 1})
+	if !errors.Is(err, ErrTaskUnreachable) {
+		t.Errorf("expected unreachable task, got %v", err)
+	}
+
+	// a task that never finishes runs into the overall timeout
+	fake.Hold("snapshot")
+	task, err = Scale.CreateSnapshot(ctx, vm.UUID, "test", "USER", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Scale.WaitForTask(ctx, task.TaskTag, WaitOptions{
+		PollInterval: 5 * time.Millisecond,
+		Timeout:      100 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrTaskTimeout) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	// a running task whose progress doesn't move has stalled. The fake
+	// keeps held tasks RUNNING at 50%.
+	task, err = Scale.CreateSnapshot(ctx, vm.UUID, "test", "USER", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Scale.WaitForTask(ctx, task.TaskTag, WaitOptions{
+		PollInterval: 5 * time.Millisecond,
+		Timeout:      10 * time.Second,
+		StallTimeout: 50 * time.Millisecond,
+	})
+	var taskErr *TaskError
+	if !errors.Is(err, ErrTaskStalled) || !errors.As(err, &taskErr) {
+		t.Errorf("expected stalled task, got %v", err)
+	} else if taskErr.Task == nil || taskErr.Task.State != "RUNNING" || taskErr.Task.ProgressPercent != 50 {
+		t.Errorf("expected the last status of the stalled task, got %+v", taskErr.Task)
+	}
+	fake.Release("snapshot")
+
+	// cancellation
+	task, err = Scale.CreateSnapshot(ctx, vm.UUID, "test", "USER", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = Scale.WaitForTask(cancelled, task.TaskTag, WaitOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// disk image formats Scale can export to
+var exportFormats = []string{"qcow2", "vhdx", "vmdk"}
+
+// TransferOptions control how Scale moves disk images to and from our
+// share, and what we convert them to after a backup. Fields left nil fall
+// through to the next layer: command line flags, then per-VM overrides,
+// then the [Transfer] section, then the built-in defaults.
+type TransferOptions struct {
+	Format                   *string
+	Compress                 *bool
+	AllowNonSequentialWrites *bool
+	ParallelCountPerTransfer *int
+	// one of convertFormats, or "none"
+	Convert *string
+}
+
+// TransferOverride applies to VMs matching VMName (a path.Match pattern)
+// and/or Tag. If both are set, both have to match.
+type TransferOverride struct {
+	VMName string
+	Tag    string
+	TransferOptions
+}
+
+// the result of resolving all the layers of TransferOptions
+type TransferSettings struct {
+	Format                   string
+	Compress                 bool
+	AllowNonSequentialWrites bool
+	ParallelCountPerTransfer int
+	Convert                  string
+}
+
+// overrides from the command line for this invocation
+var transferFlags TransferOptions
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func (o TransferOptions) applyTo(s *TransferSettings) {
+	if o.Format != nil {
+		s.Format = *o.Format
+	}
+	if o.Compress != nil {
+		s.Compress = *o.Compress
+	}
+	if o.AllowNonSequentialWrites != nil {
+		s.AllowNonSequentialWrites = *o.AllowNonSequentialWrites
+	}
+	if o.ParallelCountPerTransfer != nil {
+		s.ParallelCountPerTransfer = *o.ParallelCountPerTransfer
+	}
+	if o.Convert != nil {
+		s.Convert = *o.Convert
+	}
+}
+
+func (o TransferOptions) validate() error {
+	if o.Format != nil {
+		valid := false
+		for _, format := range exportFormats {
+			if *o.Format == format {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf(
+				"Format must be one of %s",
+				strings.Join(exportFormats, ", "),
+			)
+		}
+	}
+	if o.ParallelCountPerTransfer != nil && *o.ParallelCountPerTransfer < 1 {
+		return errors.New("ParallelCountPerTransfer must be at least 1")
+	}
+	if o.Convert != nil {
+		valid := *o.Convert == "none"
+		for _, format := range convertFormats {
+			if *o.Convert == format {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf(
+				"Convert must be none or one of %s",
+				strings.Join(convertFormats, ", "),
+			)
+		}
+	}
+	return nil
+}
+
+func (o TransferOverride) matches(vmName, tags string) bool {
+	return vmMatches(o.VMName, o.Tag, vmName, tags)
+}
+
+// work out the transfer settings for a VM with the given name and tags
+// (as a comma separated list, the way Scale gives them to us)
+func TransferSettingsFor(vmName, tags string) TransferSettings {
+	debugReturn := DebugCall(vmName, tags)
+
+	settings := TransferSettings{
+		Format:                   "qcow2",
+		Compress:                 false,
+		AllowNonSequentialWrites: true,
+		ParallelCountPerTransfer: 16,
+		Convert:                  "none",
+	}
+	Config.Transfer.TransferOptions.applyTo(&settings)
+	for _, override := range Config.Transfer.Overrides {
+		if override.matches(vmName, tags) {
+			override.TransferOptions.applyTo(&settings)
+		}
+	}
+	transferFlags.applyTo(&settings)
+
+	debugReturn(settings)
+	return settings
+}
+
+// add --format, --compress, --non-sequential-writes, --parallel, and
+// --convert flags that set transferFlags
+func addTransferFlags(flags *flag.FlagSet) {
+	flags.Func(
+		"format",
+		"disk image format ("+strings.Join(exportFormats, ", ")+")",
+		func(s string) error {
+			transferFlags.Format = &s
+			return transferFlags.validate()
+		},
+	)
+	flags.Func(
+		"compress",
+		"compress disk images (true or false)",
+		func(s string) error {
+			compress, err := strconv.ParseBool(s)
+			transferFlags.Compress = &compress
+			return err
+		},
+	)
+	flags.Func(
+		"non-sequential-writes",
+		"allow non-sequential writes (true or false)",
+		func(s string) error {
+			allow, err := strconv.ParseBool(s)
+			transferFlags.AllowNonSequentialWrites = &allow
+			return err
+		},
+	)
+	flags.Func(
+		"parallel",
+		"number of parallel writes per transfer",
+		func(s string) error {
+			count, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			transferFlags.ParallelCountPerTransfer = &count
+			return transferFlags.validate()
+		},
+	)
+	flags.Func(
+		"convert",
+		"convert qcow2 disk images after a backup (none, "+strings.Join(convertFormats, ", ")+")",
+		func(s string) error {
+			transferFlags.Convert = &s
+			return transferFlags.validate()
+		},
+	)
+}
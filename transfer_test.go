@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTransferSettingsFor(t *testing.T) {
+	savedConfig := Config
+	savedFlags := transferFlags
+	t.Cleanup(func() {
+		Config = savedConfig
+		transferFlags = savedFlags
+	})
+
+	Config.Transfer.TransferOptions = TransferOptions{
+		ParallelCountPerTransfer: ptr(8),
+	}
+	Config.Transfer.Overrides = []TransferOverride{
+		{
+			Tag:             "SlowNAS",
+			TransferOptions: TransferOptions{ParallelCountPerTransfer: ptr(2)},
+		},
+		{
+			VMName:          "fs*",
+			TransferOptions: TransferOptions{Compress: ptr(true)},
+		},
+		{
+			VMName: "fs*",
+			Tag:    "Linux",
+			TransferOptions: TransferOptions{
+				Format: ptr("vmdk"),
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		vmName string
+		tags   string
+		flags  TransferOptions
+		want   TransferSettings
+	}{
+		{
+			name:   "global only",
+			vmName: "dc01",
+			want:   TransferSettings{"qcow2", false, true, 8, "none"},
+		},
+		{
+			name:   "tag override",
+			vmName: "dc01",
+			tags:   "Windows,SlowNAS",
+			want:   TransferSettings{"qcow2", false, true, 2, "none"},
+		},
+		{
+			name:   "name and tag overrides stack",
+			vmName: "fs01",
+			tags:   "SlowNAS",
+			want:   TransferSettings{"qcow2", true, true, 2, "none"},
+		},
+		{
+			name:   "name and tag must both match",
+			vmName: "fs01",
+			tags:   "Linux",
+			want:   TransferSettings{"vmdk", true, true, 8, "none"},
+		},
+		{
+			name:   "flags win",
+			vmName: "fs01",
+			tags:   "SlowNAS",
+			flags: TransferOptions{
+				Compress:                 ptr(false),
+				AllowNonSequentialWrites: ptr(false),
+				Convert:                  ptr("raw"),
+			},
+			want: TransferSettings{"qcow2", false, false, 2, "raw"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transferFlags = test.flags
+			got := TransferSettingsFor(test.vmName, test.tags)
+			if got != test.want {
+				t.Errorf("TransferSettingsFor(%q, %q) = %+v, want %+v", test.vmName, test.tags, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackupTransferSettings(t *testing.T) {
+	fake := setupFakeScale(t)
+	fake.AddVM("fs01", "SlowNAS")
+	Config.Transfer.Overrides = []TransferOverride{{
+		Tag: "SlowNAS",
+		TransferOptions: TransferOptions{
+			ParallelCountPerTransfer: ptr(4),
+			Compress:                 ptr(true),
+		},
+	}}
+
+	Backup(context.Background(), "fs01", "manual fs01", false)
+	if fake.lastExport.Target.ParallelCountPerTransfer != 4 || !fake.lastExport.Target.Compress {
+		t.Errorf("export did not use the override: %+v", fake.lastExport.Target)
+	}
+
+	Restore(context.Background(), "manual fs01", "fs01-restored")
+	if fake.lastImport.Source.ParallelCountPerTransfer != 16 {
+		t.Errorf("restore of a manual backup should use defaults: %+v", fake.lastImport.Source)
+	}
+}
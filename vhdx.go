@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+	"unicode/utf16"
+)
+
+// Fixed VHDX files are laid out as:
+//
+//	headers and region tables (1MB)
+//	an empty log (1MB)
+//	metadata (1MB)
+//	block allocation table (BAT), a whole number of MB
+//	the disk's contents, starting on a convertBlockSize boundary
+//
+// Blocks are convertBlockSize too, so every block of the disk lands on the
+// same alignment as in a raw image (and at the same offsets within it as in
+// the qcow2 image's clusters), which lets ZFS dedupe them.
+//
+// See https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx
+
+const (
+	vhdxLogOffset      = 1 << 20
+	vhdxLogLength      = 1 << 20
+	vhdxMetadataOffset = 2 << 20
+	vhdxMetadataLength = 1 << 20
+	vhdxBATOffset      = 3 << 20
+	vhdxSectorSize     = 512
+	// a BAT entry for a block that is all there, in the low bits
+	vhdxBlockFullyPresent = 6
+)
+
+var (
+	vhdxBATRegion          = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion     = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters     = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskID      = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// the on-disk form of a GUID, where the first three groups are little endian
+func vhdxGUID(s string) []byte {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic("invalid GUID " + s)
+	}
+	guid := append([]byte(nil), raw...)
+	guid[0], guid[1], guid[2], guid[3] = raw[3], raw[2], raw[1], raw[0]
+	guid[4], guid[5] = raw[5], raw[4]
+	guid[6], guid[7] = raw[7], raw[6]
+	return guid
+}
+
+// a (version 4 looking) GUID derived from seed, so converting the same
+// image again gives the same file
+func derivedGUID(seed string) []byte {
+	hash := sha256.Sum256([]byte(seed))
+	guid := hash[:16]
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid
+}
+
+// n rounded up to a multiple of to
+func roundUp(n, to int64) int64 {
+	return (n + to - 1) / to * to
+}
+
+// return everything in a fixed VHDX of a disk of size bytes before the
+// disk's contents, and how many bytes of contents follow it. seed makes the
+// file's GUIDs (ex: the backup and file name).
+func vhdxPrefix(size int64, seed string) ([]byte, int64) {
+	le := binary.LittleEndian
+	size = roundUp(size, vhdxSectorSize)
+	blocks := (size + convertBlockSize - 1) / convertBlockSize
+	// a sector bitmap entry (unused without a parent) follows every
+	// chunkRatio block entries
+	chunkRatio := int64(1<<23) * vhdxSectorSize / convertBlockSize
+	batEntries := blocks
+	if blocks > 0 {
+		batEntries += (blocks - 1) / chunkRatio
+	}
+	batLength := roundUp(batEntries*8, 1<<20)
+	if batLength == 0 {
+		batLength = 1 << 20
+	}
+	payloadOffset := roundUp(vhdxBATOffset+batLength, convertBlockSize)
+	prefix := make([]byte, payloadOffset)
+
+	// file type identifier
+	copy(prefix, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("scale-backup")) {
+		le.PutUint16(prefix[8+2*i:], c)
+	}
+
+	// two copies of the header. The one with the higher sequence number
+	// is current.
+	for i, offset := range []int{64 << 10, 128 << 10} {
+		header := prefix[offset : offset+4<<10]
+		copy(header, "head")
+		le.PutUint64(header[8:], uint64(i+1))
+		copy(header[16:], derivedGUID(seed+" file write"))
+		copy(header[32:], derivedGUID(seed+" data write"))
+		// a zero log GUID means the log is empty
+		le.PutUint16(header[66:], 1)
+		le.PutUint32(header[68:], vhdxLogLength)
+		le.PutUint64(header[72:], vhdxLogOffset)
+		le.PutUint32(header[4:], crc32.Checksum(header, crc32c))
+	}
+
+	// two copies of the region table
+	for _, offset := range []int{192 << 10, 256 << 10} {
+		table := prefix[offset : offset+64<<10]
+		copy(table, "regi")
+		le.PutUint32(table[8:], 2)
+		regions := []struct {
+			guid   []byte
+			offset int64
+			length int64
+		}{
+			{vhdxBATRegion, vhdxBATOffset, batLength},
+			{vhdxMetadataRegion, vhdxMetadataOffset, vhdxMetadataLength},
+		}
+		for i, region := range regions {
+			entry := table[16+32*i:]
+			copy(entry, region.guid)
+			le.PutUint64(entry[16:], uint64(region.offset))
+			le.PutUint32(entry[24:], uint32(region.length))
+			// required
+			le.PutUint32(entry[28:], 1)
+		}
+		le.PutUint32(table[4:], crc32.Checksum(table, crc32c))
+	}
+
+	// metadata: a table of items, with the items after it
+	metadata := prefix[vhdxMetadataOffset : vhdxMetadataOffset+vhdxMetadataLength]
+	copy(metadata, "metadata")
+	const (
+		isVirtualDisk = 2
+		isRequired    = 4
+	)
+	items := []struct {
+		guid  []byte
+		flags uint32
+		data  []byte
+	}{
+		// block size, then flags: leave blocks allocated (fixed), no parent
+		{vhdxFileParameters, isRequired, le.AppendUint32(le.AppendUint32(nil, convertBlockSize), 1)},
+		{vhdxVirtualDiskSize, isVirtualDisk | isRequired, le.AppendUint64(nil, uint64(size))},
+		{vhdxVirtualDiskID, isVirtualDisk | isRequired, derivedGUID(seed + " disk")},
+		{vhdxLogicalSectorSize, isVirtualDisk | isRequired, le.AppendUint32(nil, vhdxSectorSize)},
+		{vhdxPhysicalSectorSize, isVirtualDisk | isRequired, le.AppendUint32(nil, 4096)},
+	}
+	le.PutUint16(metadata[10:], uint16(len(items)))
+	itemOffset := 64 << 10
+	for i, item := range items {
+		entry := metadata[32+32*i:]
+		copy(entry, item.guid)
+		le.PutUint32(entry[16:], uint32(itemOffset))
+		le.PutUint32(entry[20:], uint32(len(item.data)))
+		le.PutUint32(entry[24:], item.flags)
+		copy(metadata[itemOffset:], item.data)
+		itemOffset += len(item.data)
+	}
+
+	// every block is present, in order, right after the BAT
+	bat := prefix[vhdxBATOffset : vhdxBATOffset+batLength]
+	for block := int64(0); block < blocks; block++ {
+		entry := block + block/chunkRatio
+		fileOffset := payloadOffset + block*convertBlockSize
+		le.PutUint64(bat[8*entry:], uint64(fileOffset>>20)<<20|vhdxBlockFullyPresent)
+	}
+
+	return prefix, blocks * convertBlockSize
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a period when scheduled backups may start. Days are the days
+// of the week the window starts on (every day if empty). A window that
+// crosses midnight ends the next morning, and one whose StartTime and
+// EndTime are the same lasts 24 hours.
+type Window struct {
+	Days      []string
+	StartTime string
+	EndTime   string
+}
+
+// a concrete stretch of time when backups may run
+type interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// how far ahead we look for the next window. Long enough to get past a
+// year's worth of blackout dates.
+const windowSearchDays = 400
+
+// the configured windows. Without [[Schedule.Windows]] StartTime and
+// EndTime make one window every day.
+func scheduleWindows() []Window {
+	if len(Config.Schedule.Windows) != 0 {
+		return Config.Schedule.Windows
+	}
+	return []Window{{
+		StartTime: Config.Schedule.StartTime,
+		EndTime:   Config.Schedule.EndTime,
+	}}
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := day.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a day of the week", s)
+}
+
+func (w Window) validate() error {
+	for _, day := range w.Days {
+		_, err := parseWeekday(day)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := time.Parse("3:04 PM", w.StartTime)
+	if err != nil {
+		return fmt.Errorf("StartTime is not a valid time")
+	}
+	_, err = time.Parse("3:04 PM", w.EndTime)
+	if err != nil {
+		return fmt.Errorf("EndTime is not a valid time")
+	}
+	return nil
+}
+
+// return true if the window starts on this day of the week
+func (w Window) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		// we already validated these when we validated the config
+		d, _ := parseWeekday(name)
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// the window that starts on the same date as day, using day's time zone.
+// Times are wall-clock times, so DST changes make windows shorter or
+// longer rather than shifting them.
+func (w Window) on(day time.Time) interval {
+	// we already validated these when we validated the config
+	start, err := time.Parse("3:04 PM", w.StartTime)
+	if err != nil {
+		panic(err)
+	}
+	end, err := time.Parse("3:04 PM", w.EndTime)
+	if err != nil {
+		panic(err)
+	}
+
+	y, m, d := day.Date()
+	loc := day.Location()
+	iv := interval{
+		Start: time.Date(y, m, d, start.Hour(), start.Minute(), 0, 0, loc),
+		End:   time.Date(y, m, d, end.Hour(), end.Minute(), 0, 0, loc),
+	}
+	if !start.Before(end) {
+		// crosses midnight
+		iv.End = time.Date(y, m, d+1, end.Hour(), end.Minute(), 0, 0, loc)
+	}
+	return iv
+}
+
+// a blackout rule, true for days when no backups should run
+type blackout func(day time.Time) bool
+
+var lastDaysRegex = regexp.MustCompile(`^last (?:day|(\d+) days) of (?:the )?month$`)
+
+// parse a Blackouts entry. These are accepted:
+//
+//	2024-11-29                 a single date
+//	12-25                      a date every year
+//	2024-12-23 to 2025-01-02   an inclusive range of dates
+//	12-24 to 01-01             the same range every year
+//	last day of month          for month-end close
+//	last 3 days of month
+func parseBlackout(s string) (blackout, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+
+	if match := lastDaysRegex.FindStringSubmatch(s); match != nil {
+		n := 1
+		if match[1] != "" {
+			n, _ = strconv.Atoi(match[1])
+		}
+		if n < 1 || n > 28 {
+			return nil, fmt.Errorf("%q: number of days must be between 1 and 28", s)
+		}
+		return func(day time.Time) bool {
+			y, m, d := day.Date()
+			daysInMonth := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+			return d > daysInMonth-n
+		}, nil
+	}
+
+	from, to, isRange := strings.Cut(s, " to ")
+	if !isRange {
+		to = from
+	}
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+
+	// every year
+	fromMD, fromErr := time.Parse("01-02", from)
+	toMD, toErr := time.Parse("01-02", to)
+	if fromErr == nil && toErr == nil {
+		first := int(fromMD.Month())*100 + fromMD.Day()
+		last := int(toMD.Month())*100 + toMD.Day()
+		return func(day time.Time) bool {
+			md := int(day.Month())*100 + day.Day()
+			if first <= last {
+				return md >= first && md <= last
+			}
+			// wraps around new year
+			return md >= first || md <= last
+		}, nil
+	}
+
+	// specific dates
+	fromDate, fromErr := time.Parse("2006-01-02", from)
+	toDate, toErr := time.Parse("2006-01-02", to)
+	if fromErr == nil && toErr == nil {
+		if toDate.Before(fromDate) {
+			return nil, fmt.Errorf("%q ends before it starts", s)
+		}
+		return func(day time.Time) bool {
+			y, m, d := day.Date()
+			date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+			return !date.Before(fromDate) && !date.After(toDate)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%q is not a date, range of dates, or \"last N days of month\"", s)
+}
+
+// return true if no backups should run on this date
+func blackedOut(day time.Time) bool {
+	for _, entry := range Config.Schedule.Blackouts {
+		// we already validated these when we validated the config
+		isBlackout, err := parseBlackout(entry)
+		if err != nil {
+			panic(err)
+		}
+		if isBlackout(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// list the times backups may run from the day before from through the
+// next `days` days, in order. Overlapping windows are merged and blackout
+// dates are cut out.
+func windowIntervals(from time.Time, days int) []interval {
+	y, m, d := from.Date()
+	loc := from.Location()
+
+	// every window that starts in the range. Start the day before so we
+	// catch windows that cross midnight into today.
+	var windows []interval
+	for i := -1; i <= days; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		for _, window := range scheduleWindows() {
+			if window.startsOn(day.Weekday()) {
+				windows = append(windows, window.on(day))
+			}
+		}
+	}
+
+	// split windows at midnight and drop the pieces on blackout dates
+	var pieces []interval
+	for _, window := range windows {
+		start := window.Start
+		for start.Before(window.End) {
+			sy, sm, sd := start.Date()
+			midnight := time.Date(sy, sm, sd+1, 0, 0, 0, 0, loc)
+			end := window.End
+			if midnight.Before(end) {
+				end = midnight
+			}
+			if !blackedOut(start) {
+				pieces = append(pieces, interval{start, end})
+			}
+			start = end
+		}
+	}
+
+	// merge pieces that touch or overlap
+	sort.Slice(pieces, func(i, j int) bool {
+		return pieces[i].Start.Before(pieces[j].Start)
+	})
+	var merged []interval
+	for _, piece := range pieces {
+		last := len(merged) - 1
+		if last >= 0 && !piece.Start.After(merged[last].End) {
+			if piece.End.After(merged[last].End) {
+				merged[last].End = piece.End
+			}
+			continue
+		}
+		merged = append(merged, piece)
+	}
+	return merged
+}
+
+// return the window we are in, or the next one if we aren't in one. ok
+// is false if there are no windows coming up (ex: everything is blacked
+// out).
+func NextWindow() (window interval, ok bool) {
+	now := clock.Now()
+	for _, iv := range windowIntervals(now, windowSearchDays) {
+		if iv.End.After(now) {
+			return iv, true
+		}
+	}
+	return interval{}, false
+}
+
+// describe when backups can run next, for messages and show-queue
+func describeNextWindow() string {
+	window, ok := NextWindow()
+	if !ok {
+		return "no backup window in the next year"
+	}
+	const layout = "Mon 2006-01-02 03:04 PM"
+	if !window.Start.After(clock.Now()) {
+		return "backup window open until " + window.End.Format(layout)
+	}
+	return fmt.Sprintf(
+		"next backup window %s to %s",
+		window.Start.Format(layout),
+		window.End.Format(layout),
+	)
+}
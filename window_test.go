@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindows(t *testing.T) {
+	savedConfig := Config
+	t.Cleanup(func() { Config = savedConfig })
+
+	Config.Schedule.StartTime = ""
+	Config.Schedule.EndTime = ""
+	Config.Schedule.Windows = []Window{
+		{
+			Days:      []string{"Mon", "tue", "Wednesday", "Thu", "Fri"},
+			StartTime: "7:00 PM",
+			EndTime:   "6:00 AM",
+		},
+		{
+			Days:      []string{"Sat", "Sun"},
+			StartTime: "12:00 AM",
+			EndTime:   "12:00 AM",
+		},
+	}
+	Config.Schedule.Blackouts = []string{"2024-03-29", "12-25"}
+
+	// 2024-03-11 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 3, day, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"Monday afternoon", at(11, 14, 0), false},
+		{"Monday night", at(11, 20, 0), true},
+		{"Tuesday morning", at(12, 5, 59), true},
+		{"Tuesday after window", at(12, 6, 0), false},
+		// Sunday's all day window ends at midnight, and there is no
+		// window starting Monday morning
+		{"Monday early morning", at(11, 3, 0), false},
+		{"Friday night", at(15, 23, 0), true},
+		{"Saturday noon", at(16, 12, 0), true},
+		{"Sunday night", at(17, 23, 59), true},
+		// Thursday night runs into a blackout date at midnight
+		{"Thursday night", at(28, 23, 0), true},
+		{"blackout morning", at(29, 1, 0), false},
+		{"blackout night", at(29, 20, 0), false},
+		{"after blackout", at(30, 0, 30), true},
+		{"yearly blackout", time.Date(2024, 12, 25, 21, 0, 0, 0, time.Local), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setClock(t, test.now)
+			got := ScheduleIsActive()
+			if got != test.want {
+				t.Errorf("ScheduleIsActive() at %s = %v, want %v", test.now, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	savedConfig := Config
+	t.Cleanup(func() { Config = savedConfig })
+
+	Config.Schedule.Windows = nil
+	Config.Schedule.StartTime = "7:00 PM"
+	Config.Schedule.EndTime = "6:00 AM"
+	Config.Schedule.Blackouts = []string{"2024-03-12 to 2024-03-13"}
+
+	// Monday afternoon. Monday's window is cut off by the blackout at
+	// midnight, and the next one starts on Thursday at midnight.
+	setClock(t, time.Date(2024, 3, 11, 14, 0, 0, 0, time.Local))
+	window, ok := NextWindow()
+	if !ok {
+		t.Fatal("expected a window")
+	}
+	if want := time.Date(2024, 3, 11, 19, 0, 0, 0, time.Local); !window.Start.Equal(want) {
+		t.Errorf("expected window to start at %s, got %s", want, window.Start)
+	}
+	if want := time.Date(2024, 3, 12, 0, 0, 0, 0, time.Local); !window.End.Equal(want) {
+		t.Errorf("expected window to end at %s, got %s", want, window.End)
+	}
+
+	setClock(t, time.Date(2024, 3, 12, 1, 0, 0, 0, time.Local))
+	window, ok = NextWindow()
+	if !ok {
+		t.Fatal("expected a window")
+	}
+	if want := time.Date(2024, 3, 14, 0, 0, 0, 0, time.Local); !window.Start.Equal(want) {
+		t.Errorf("expected window to start at %s, got %s", want, window.Start)
+	}
+
+	Config.Schedule.Blackouts = []string{"01-01 to 12-31"}
+	_, ok = NextWindow()
+	if ok {
+		t.Error("expected no window when every day is blacked out")
+	}
+}
+
+func TestParseBlackout(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 12, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		blackout string
+		day      time.Time
+		want     bool
+	}{
+		{"2024-11-29", date(2024, 11, 29), true},
+		{"2024-11-29", date(2025, 11, 29), false},
+		{"12-25", date(2030, 12, 25), true},
+		{"12-25", date(2030, 12, 26), false},
+		{"2024-12-23 to 2025-01-02", date(2024, 12, 31), true},
+		{"2024-12-23 to 2025-01-02", date(2025, 1, 3), false},
+		{"12-24 to 01-01", date(2027, 1, 1), true},
+		{"12-24 to 01-01", date(2027, 1, 2), false},
+		{"12-24 to 01-01", date(2027, 12, 23), false},
+		{"last day of month", date(2024, 2, 29), true},
+		{"last day of month", date(2023, 2, 28), true},
+		{"last day of month", date(2024, 2, 28), false},
+		{"Last 3 days of the month", date(2024, 4, 28), true},
+		{"last 3 days of month", date(2024, 4, 27), false},
+	}
+	for _, test := range tests {
+		isBlackout, err := parseBlackout(test.blackout)
+		if err != nil {
+			t.Errorf("parseBlackout(%q): %s", test.blackout, err)
+			continue
+		}
+		if got := isBlackout(test.day); got != test.want {
+			t.Errorf("%q on %s = %v, want %v", test.blackout, test.day.Format("2006-01-02"), got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"tomorrow", "2024-13-01", "2024-02-02 to 2024-02-01", "last 0 days of month", "12-25 to 2024-12-26"} {
+		_, err := parseBlackout(bad)
+		if err == nil {
+			t.Errorf("parseBlackout(%q) should have failed", bad)
+		}
+	}
+}